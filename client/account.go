@@ -0,0 +1,247 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/jroimartin/gocui"
+)
+
+// sendAccountRequest sends an action on the account, signed with its identity key
+func (app *ChatApp) sendAccountRequest(method string, path string, action string, deviceID common.DeviceID) (*http.Response, error) {
+	request, err := common.SignAccountRequest(app.userPrivKeyBundle.IdentityKey, action, app.userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return app.sendSignedRequest(method, path, request)
+}
+
+func (app *ChatApp) sendSignedRequest(method string, path string, request *common.AccountRequest) (*http.Response, error) {
+	payloadBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	httpRequest, err := http.NewRequest(method, app.transport.httpURL(path), bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	resp, err := app.transport.httpClient.Do(httpRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	return resp, nil
+}
+
+// Register registers the account with its identity key, which is a no-op if it already is
+func (app *ChatApp) Register() error {
+	resp, err := app.sendAccountRequest(http.MethodPost, fmt.Sprintf("%s/%s", configs.AccountsPath, app.userID), common.AccountRegister, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned non-OK status: %v", resp.Status)
+	}
+	return nil
+}
+
+// getAccount fetches the common.Account at path, ErrUnknownUser if there is none
+func (app *ChatApp) getAccount(path string) (*common.Account, error) {
+	resp, err := app.transport.httpClient.Get(app.transport.httpURL(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrUnknownUser
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned non-OK status: %v", resp.Status)
+	}
+	var account common.Account
+	if err := json.NewDecoder(resp.Body).Decode(&account); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &account, nil
+}
+
+// GetAccount returns the account with this ID, with its current username
+func (app *ChatApp) GetAccount(userID string) (*common.Account, error) {
+	return app.getAccount(fmt.Sprintf("%s/%s", configs.AccountsPath, userID))
+}
+
+// ResolveUsername returns the account that has this username now
+func (app *ChatApp) ResolveUsername(username string) (*common.Account, error) {
+	return app.getAccount(fmt.Sprintf("%s/%s", configs.UsernamesPath, common.NormalizeUsername(username)))
+}
+
+// SetUsername sets the username of the account, the previous one is freed
+func (app *ChatApp) SetUsername(username string) error {
+	username, err := common.ValidateUsername(username)
+	if err != nil {
+		return err
+	}
+	request, err := common.SignUsernameRequest(app.userPrivKeyBundle.IdentityKey, app.userID, username)
+	if err != nil {
+		return err
+	}
+	resp, err := app.sendSignedRequest(http.MethodPut, fmt.Sprintf("%s/%s/username", configs.AccountsPath, app.userID), request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return ErrUsernameTaken
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned non-OK status: %v", resp.Status)
+	}
+	app.username = username
+	if err := SaveLocalAccount(app.config.SecretDir, username, app.userID); err != nil {
+		logger.Errorf("Error saving username: %v", err)
+	}
+	return nil
+}
+
+// ClaimUsername gives the account the username this device was started with if it has none yet,
+// otherwise the username of the account is used
+func (app *ChatApp) ClaimUsername() error {
+	account, err := app.GetAccount(app.userID)
+	if err != nil {
+		return err
+	}
+	if account.Username != "" {
+		app.username = account.Username
+		return SaveLocalAccount(app.config.SecretDir, account.Username, app.userID)
+	}
+	return app.SetUsername(app.username)
+}
+
+// changeUsername renames the account, peers see the new username the next time they open the chat
+func (app *ChatApp) changeUsername(username string) error {
+	previous := app.username
+	if err := app.SetUsername(username); err != nil {
+		return fmt.Errorf("failed to change username: %w", err)
+	}
+	app.appendNotice("You changed your username from %s to %s", previous, app.username)
+	return nil
+}
+
+// Unregister deletes the account and everything the server stores about it, on every device
+func (app *ChatApp) Unregister() error {
+	resp, err := app.sendAccountRequest(http.MethodDelete, fmt.Sprintf("%s/%s", configs.AccountsPath, app.userID), common.AccountUnregister, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned non-OK status: %v", resp.Status)
+	}
+	return nil
+}
+
+// RevokeDevice removes the keys of another device of the account from the server, e.g. a lost one
+func (app *ChatApp) RevokeDevice(deviceID common.DeviceID) error {
+	if deviceID == app.deviceID {
+		return fmt.Errorf("cannot revoke this device, use /unregister to delete the account")
+	}
+	resp, err := app.sendAccountRequest(http.MethodDelete, fmt.Sprintf("%s/%s/%d", configs.PublishKeysPath, app.userID, deviceID), common.AccountRevokeDevice, deviceID)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("device %d is not registered", deviceID)
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned non-OK status: %v", resp.Status)
+	}
+
+	app.appendNotice("Device %d revoked", deviceID)
+	return nil
+}
+
+// unregister deletes the account once the user typed its username to confirm, then quits
+func (app *ChatApp) unregister(confirmation string) error {
+	if common.NormalizeUsername(confirmation) != app.username {
+		return fmt.Errorf("type /unregister %s to delete your account from the server", app.username)
+	}
+	if err := app.Unregister(); err != nil {
+		return fmt.Errorf("failed to delete account: %w", err)
+	}
+
+	logger.Info("Account deleted")
+	app.Gui.Update(func(g *gocui.Gui) error {
+		return app.quit(g, nil)
+	})
+	return nil
+}
+
+// The key files of the devices are named after the account ID, which does not change when the account is renamed.
+// The usernames an account had on this machine map to its ID in the accounts file of the secret directory.
+
+// accountsFileName returns the file of secretDir mapping usernames to account IDs
+func accountsFileName(secretDir string) string {
+	return filepath.Join(secretDir, "accounts.json")
+}
+
+// LocalAccountID returns the ID of the account a username belonged to on this machine, empty if there is none
+func LocalAccountID(secretDir string, username string) (string, error) {
+	accounts, err := loadLocalAccounts(secretDir)
+	if err != nil {
+		return "", err
+	}
+	return accounts[common.NormalizeUsername(username)], nil
+}
+
+// SaveLocalAccount records that username belongs to the account accountID on this machine
+func SaveLocalAccount(secretDir string, username string, accountID string) error {
+	accounts, err := loadLocalAccounts(secretDir)
+	if err != nil {
+		return err
+	}
+	username = common.NormalizeUsername(username)
+	if accounts[username] == accountID {
+		return nil
+	}
+	accounts[username] = accountID
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal accounts: %w", err)
+	}
+
+	// Written to another file first, so that a crash does not lose the accounts
+	fileName := accountsFileName(secretDir)
+	if err := os.WriteFile(fileName+".tmp", data, 0o600); err != nil {
+		return fmt.Errorf("failed to write accounts: %w", err)
+	}
+	if err := os.Rename(fileName+".tmp", fileName); err != nil {
+		return fmt.Errorf("failed to write accounts: %w", err)
+	}
+	return nil
+}
+
+func loadLocalAccounts(secretDir string) (map[string]string, error) {
+	accounts := make(map[string]string)
+	data, err := os.ReadFile(accountsFileName(secretDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return accounts, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read accounts: %w", err)
+	}
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("failed to decode accounts: %w", err)
+	}
+	return accounts, nil
+}
@@ -0,0 +1,324 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/gocui"
+)
+
+// Typing indicators and presence are sent to the devices of the recipient in ephemeral messages: the server
+// drops them if the device is offline, and the client does not keep them in the outbox while disconnected.
+// Apart from the presence announced once connected, they only go to the devices that told us they are online,
+// so a recipient hiding its presence does not get typing indicators either.
+
+// peerActivity is what a device of the recipient shared of its activity
+type peerActivity struct {
+	// typingAt is when the device last said the recipient was typing, zero once it stopped
+	typingAt time.Time
+	// online is set by the last presence of the device, which was received at seenAt.
+	// Once offline, seenAt is when it was last seen, zero if it does not share it.
+	online bool
+	seenAt time.Time
+}
+
+// isOnline reports whether the device is online at now: it did not tell it went offline, and told it is
+// online less than PresenceTimeout ago
+func (a *peerActivity) isOnline(now time.Time) bool {
+	return a.online && now.Sub(a.seenAt) < configs.PresenceTimeout
+}
+
+// isTyping reports whether the recipient is typing on the device at now
+func (a *peerActivity) isTyping(now time.Time) bool {
+	return !a.typingAt.IsZero() && now.Sub(a.typingAt) < configs.TypingTimeout
+}
+
+// peerActivities holds the activity of each device of the recipient
+type peerActivities map[deviceAddress]*peerActivity
+
+// status returns the activity of the recipient as shown in the chat title: typing or online if it is on any
+// of its devices, otherwise when it was last seen on one. Empty if there is nothing to show.
+func (p peerActivities) status(now time.Time) string {
+	online := false
+	var seenAt time.Time
+	for _, a := range p {
+		if a.isTyping(now) {
+			return "typing..."
+		}
+		if a.isOnline(now) {
+			online = true
+		} else if a.seenAt.After(seenAt) {
+			seenAt = a.seenAt
+		}
+	}
+	if online {
+		return "online"
+	}
+	if seenAt.IsZero() {
+		return ""
+	}
+	if y, m, d := seenAt.Date(); y == now.Year() && m == now.Month() && d == now.Day() {
+		return "last seen " + seenAt.Format("15:04")
+	}
+	return "last seen " + seenAt.Format("Jan 2 15:04")
+}
+
+// online returns the devices of the recipient online at now
+func (p peerActivities) online(now time.Time) map[deviceAddress]bool {
+	devices := make(map[deviceAddress]bool)
+	for address, a := range p {
+		if a.isOnline(now) {
+			devices[address] = true
+		}
+	}
+	return devices
+}
+
+// peerStatus returns the activity of the recipient as shown in the chat title
+func (app *ChatApp) peerStatus(now time.Time) string {
+	app.activityLock.Lock()
+	defer app.activityLock.Unlock()
+	return app.peers.status(now)
+}
+
+// onlineDevices returns the devices of the recipient that are online
+func (app *ChatApp) onlineDevices(now time.Time) map[deviceAddress]bool {
+	app.activityLock.Lock()
+	defer app.activityLock.Unlock()
+	return app.peers.online(now)
+}
+
+// receiveActivity applies a typing indicator or a presence sent by a device of the recipient
+func (app *ChatApp) receiveActivity(from deviceAddress, content *common.Content) {
+	now := time.Now()
+	app.activityLock.Lock()
+	peer, ok := app.peers[from]
+	if !ok {
+		peer = &peerActivity{}
+		app.peers[from] = peer
+	}
+	var reply bool
+	switch content.Type {
+	case common.ContentTyping:
+		peer.typingAt = time.Time{}
+		if content.Typing {
+			peer.typingAt = now
+		}
+	case common.ContentPresence:
+		// A device coming online does not know our presence yet, as it was dropped while it was offline
+		reply = content.Online && !peer.isOnline(now)
+		peer.online = content.Online
+		peer.seenAt = now
+		if !content.Online {
+			peer.seenAt = time.Time{}
+			if content.LastSeen > 0 {
+				peer.seenAt = time.Unix(content.LastSeen, 0)
+			}
+		}
+	case common.ContentText:
+		// A message was sent, the recipient stopped typing it
+		peer.typingAt = time.Time{}
+	}
+	app.activityLock.Unlock()
+
+	app.updateGui(app.updateStatus)
+	if reply {
+		app.sendPresence(true)
+	}
+}
+
+// inputChanged is called when the user edits the message input. The recipient is told the user is typing
+// at most every TypingInterval, and that it stopped once there is no message in the input again.
+func (app *ChatApp) inputChanged(empty bool) {
+	if !app.config.TypingIndicators {
+		return
+	}
+	now := time.Now()
+	app.activityLock.Lock()
+	send := false
+	if !empty {
+		send = app.typingSentAt.IsZero() || now.Sub(app.typingSentAt) >= configs.TypingInterval
+		if send {
+			app.typingSentAt = now
+		}
+		app.lastKeystroke = now
+	} else if !app.typingSentAt.IsZero() {
+		app.typingSentAt = time.Time{}
+		send = true
+	}
+	app.activityLock.Unlock()
+
+	if send {
+		app.sendActivity(&common.Content{Type: common.ContentTyping, Typing: !empty}, false)
+	}
+}
+
+// messageSent stops the typing indicator without telling the recipient, the message does
+func (app *ChatApp) messageSent() {
+	app.activityLock.Lock()
+	app.typingSentAt = time.Time{}
+	app.activityLock.Unlock()
+}
+
+// setSharePresence turns sharing our presence on or off, and tells the recipient right away
+func (app *ChatApp) setSharePresence(share bool) {
+	app.activityLock.Lock()
+	app.sharePresence = share
+	app.activityLock.Unlock()
+
+	app.sendPresence(true)
+	if share {
+		app.appendNotice("Your presence is shared with %s", app.recipientName)
+	} else {
+		app.appendNotice("Your presence is hidden from %s", app.recipientName)
+	}
+}
+
+// sendPresence tells the online devices of the recipient whether we are online, or that our presence is hidden
+func (app *ChatApp) sendPresence(online bool) {
+	app.sendActivity(app.presence(online), false)
+}
+
+// announcePresence tells every device of the recipient that we are online, once connected. Those that are
+// offline tell us when they come online again, the presence is dropped for them.
+func (app *ChatApp) announcePresence() {
+	app.sendActivity(app.presence(true), true)
+}
+
+// presence returns the presence sent to the recipient
+func (app *ChatApp) presence(online bool) *common.Content {
+	now := time.Now()
+	app.activityLock.Lock()
+	defer app.activityLock.Unlock()
+	content := &common.Content{Type: common.ContentPresence}
+	if app.sharePresence {
+		content.Online = online
+		if !online {
+			content.LastSeen = now.Unix()
+		}
+	}
+	app.presenceSentAt = now
+	return content
+}
+
+// sendActivity sends content in ephemeral messages to the devices of the recipient we have a session with,
+// only those online unless all is set. It never starts a session.
+func (app *ChatApp) sendActivity(content *common.Content, all bool) {
+	if app.identityChanged() {
+		return
+	}
+	online := app.onlineDevices(time.Now())
+	for _, dev := range app.deviceList() {
+		if dev.Address.UserID != app.recipientID || !(all || online[dev.Address]) {
+			continue
+		}
+		if !app.sendEphemeral(dev, content) {
+			return
+		}
+	}
+}
+
+// ephemeral is activity waiting for the writer, to be encrypted for a device right before it is written
+type ephemeral struct {
+	dev     *peerDevice
+	content *common.Content
+}
+
+// sendEphemeral queues content for dev if the client is connected and the outbox is empty, otherwise it
+// returns false. It is only encrypted when it is written: every message encrypted for a device advances its
+// ratchet, and the receiver keeps a skipped key for each one it never gets.
+func (app *ChatApp) sendEphemeral(dev *peerDevice, content *common.Content) bool {
+	app.connLock.Lock()
+	// Messages waiting in the outbox go first, so that they are received in the order they were encrypted in
+	if app.connState != stateConnected || len(app.outbox) > 0 {
+		app.connLock.Unlock()
+		return false
+	}
+	app.ephemerals = append(app.ephemerals, ephemeral{dev: dev, content: content})
+	app.connLock.Unlock()
+
+	app.wakeWriter()
+	return true
+}
+
+// encryptEphemeral encrypts e and stores the sessions with the device, whose ratchet moved on: loading older
+// sessions would encrypt the next messages with the same keys again. It returns nil if there is no session with
+// the device, or encryption or storing failed.
+func (app *ChatApp) encryptEphemeral(e ephemeral) []byte {
+	app.sessionLock.Lock()
+	var (
+		msg *common.MessageBundle
+		err error
+	)
+	if len(e.dev.Sessions) > 0 {
+		msg, err = app.encryptMessage(e.dev, e.content)
+		if err != nil {
+			err = fmt.Errorf("failed to encrypt: %w", err)
+		} else if err = app.saveDevice(app.store(), e.dev); err != nil {
+			err = fmt.Errorf("failed to save sessions: %w", err)
+		}
+	}
+	app.sessionLock.Unlock()
+	if err != nil {
+		logger.Errorf("Error sending activity to %s: %v", e.dev.Address, err)
+		return nil
+	} else if msg == nil {
+		return nil
+	}
+
+	msg.Ephemeral = true
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		logger.Errorf("Error marshalling activity: %v", err)
+		return nil
+	}
+	return msgJSON
+}
+
+// runActivity tells the recipient we stopped typing or are still online, and refreshes the activity of the
+// recipient shown in the title as it expires, until the app quits
+func (app *ChatApp) runActivity() {
+	ticker := time.NewTicker(configs.ActivityCheckInterval)
+	defer ticker.Stop()
+
+	var shown string
+	for {
+		select {
+		case <-app.closing:
+			return
+		case now := <-ticker.C:
+			app.activityLock.Lock()
+			stopTyping := !app.typingSentAt.IsZero() && now.Sub(app.lastKeystroke) >= configs.TypingInterval
+			if stopTyping {
+				app.typingSentAt = time.Time{}
+			}
+			heartbeat := app.sharePresence && now.Sub(app.presenceSentAt) >= configs.PresenceInterval
+			app.activityLock.Unlock()
+
+			if stopTyping {
+				app.sendActivity(&common.Content{Type: common.ContentTyping}, false)
+			}
+			if heartbeat {
+				app.sendPresence(true)
+			}
+			if status := app.peerStatus(now); status != shown {
+				shown = status
+				app.updateGui(app.updateStatus)
+			}
+		}
+	}
+}
+
+// inputEditor edits the message input like gocui.DefaultEditor, and tells the recipient the user is typing
+// a message. Commands are not messages.
+func (app *ChatApp) inputEditor() gocui.Editor {
+	return gocui.EditorFunc(func(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+		gocui.DefaultEditor.Edit(v, key, ch, mod)
+		input := strings.TrimSpace(v.Buffer())
+		app.inputChanged(input == "" || strings.HasPrefix(input, commandPrefix))
+	})
+}
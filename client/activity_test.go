@@ -0,0 +1,58 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerActivityStatus(t *testing.T) {
+	now := time.Date(2026, time.March, 10, 12, 0, 0, 0, time.Local)
+	phone := deviceAddress{UserID: "bob", DeviceID: 1}
+	laptop := deviceAddress{UserID: "bob", DeviceID: 2}
+	peers := peerActivities{phone: {}}
+	assert.Empty(t, peers.status(now))
+
+	peers[phone].online, peers[phone].seenAt = true, now
+	assert.Equal(t, "online", peers.status(now))
+	peers[phone].typingAt = now
+	assert.Equal(t, "typing...", peers.status(now))
+
+	// Typing expires if the recipient never said it stopped, presence if it stopped sending it
+	later := now.Add(configs.TypingTimeout)
+	assert.Equal(t, "online", peers.status(later))
+	later = now.Add(configs.PresenceTimeout)
+	assert.Empty(t, peers.online(later))
+	assert.Equal(t, "last seen 12:00", peers.status(later))
+	assert.Equal(t, "last seen Mar 10 12:00", peers.status(now.Add(24*time.Hour)))
+
+	// The recipient is online if any of its devices is, and was last seen on the last one
+	peers[laptop] = &peerActivity{online: true, seenAt: later}
+	assert.Equal(t, map[deviceAddress]bool{laptop: true}, peers.online(later))
+	assert.Equal(t, "online", peers.status(later))
+	peers[laptop].online = false
+	assert.Equal(t, "last seen "+later.Format("15:04"), peers.status(later))
+
+	peers = peerActivities{phone: {}}
+	assert.Empty(t, peers.status(now), "hidden presence")
+}
+
+func TestEphemeralSessionSaved(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	bobDev := alice.devices[bob.address()]
+	exchange(t, alice, bob, "hi bob")
+
+	// The ratchet moved on for the typing indicator, a restart must not encrypt with the same keys again
+	require.NotNil(t, alice.encryptEphemeral(ephemeral{dev: bobDev, content: &common.Content{Type: common.ContentTyping}}))
+	restarted := newTestDevice(t, "alice", common.PrimaryDeviceID, &alice.userPrivKeyBundle.IdentityKey)
+	restarted.config.RedisAddress = alice.config.RedisAddress
+	restarted.recipientID = bob.userID
+	restarted.devices[bob.address()] = &peerDevice{Address: bob.address(), Bundle: bobDev.Bundle}
+	require.NoError(t, restarted.load())
+	assert.Equal(t, bobDev.activeSession().Ratchet.CurrentState.Ns, restarted.devices[bob.address()].activeSession().Ratchet.CurrentState.Ns)
+}
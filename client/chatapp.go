@@ -2,18 +2,15 @@ package client
 
 import (
 	"bytes"
-	"context"
-	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"minimal-signal/common"
 	"minimal-signal/configs"
-	"minimal-signal/protocol/doubleratchet"
-	"minimal-signal/protocol/x3dh/alice"
 	"minimal-signal/protocol/x3dh/bob"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 
@@ -25,66 +22,181 @@ import (
 var logger = logrus.New()
 
 type ChatApp struct {
+	config      *configs.ClientConfig
+	transport   *transport
 	Gui         *gocui.Gui
 	recipientID string
-	messages    []string
-	wsConn      *websocket.Conn
+	// recipientName is the username of the recipient when the chat was opened
+	recipientName string
+	// contacts are the users this device chatted with, offered when choosing the recipient, and whether
+	// they are still registered
+	contacts []contact
+
+	// connLock guards the connection to the server and the outbox
+	connLock  sync.Mutex
+	wsConn    *websocket.Conn
+	connState connState
+	// retryAt is when the client connects again, while disconnected
+	retryAt time.Time
+	// outbox holds the encrypted messages waiting to be sent, in order, and ephemerals the activity sent
+	// once the outbox is empty
+	outbox           [][]byte
+	ephemerals       []ephemeral
+	reconnectBackoff backoff
+	// writerWake tells the writer goroutine there is something to send
+	writerWake chan struct{}
+	// writeLock serializes the writes to the connection, which are made without holding connLock
+	writeLock sync.Mutex
+
+	// messageLock guards the chat history and the disappearing message timer of the conversation
 	messageLock sync.Mutex
-	userID      string
-	wg          sync.WaitGroup
+	messages    chatHistory
+	expireTimer time.Duration
+	// userID is the account ID, derived from the identity key, username is its current alias
+	userID   string
+	username string
+	deviceID common.DeviceID
+	wg       sync.WaitGroup
+	// closing is closed when the app quits, to stop the background goroutines
+	closing chan struct{}
+
+	// activityLock guards the typing indicators and presence, ours and the recipient's
+	activityLock  sync.Mutex
+	peers         peerActivities
+	sharePresence bool
+	// typingSentAt is when the recipient was last told the user is typing, zero if it was told it stopped
+	typingSentAt   time.Time
+	lastKeystroke  time.Time
+	presenceSentAt time.Time
+
+	// rdbLock guards rdb, the client of the Redis the state is stored in, see store
+	rdbLock sync.Mutex
+	rdb     *redis.Client
 
 	// crypto stuff
 	userPrivKeyBundle bob.BobPrekeyBundle
-	otherIDKeyBundle  alice.BobPublicPrekeyBundle
-	ratchet           *doubleratchet.DoubleRatchet
-	initHandshake     *common.X3DHHandshakeBundle
+	// sessionLock guards the fields below, which are used by both the UI and the listener goroutine
+	sessionLock       sync.Mutex
+	recipientIdentity *contactIdentity
+	// devices holds the devices of the recipient and our other devices
+	devices map[deviceAddress]*peerDevice
 }
 
-// NewChatApp initializes a new ChatApp
-func NewChatApp(userID string, userKeyBundle *bob.BobPrekeyBundle) *ChatApp {
-	return &ChatApp{userID: userID, userPrivKeyBundle: *userKeyBundle}
+// NewChatApp initializes a new ChatApp for one device of a user. username is only claimed if the account has
+// none yet, see ClaimUsername.
+func NewChatApp(config *configs.ClientConfig, username string, deviceID common.DeviceID, userKeyBundle *bob.BobPrekeyBundle) (*ChatApp, error) {
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up connections to the server: %w", err)
+	}
+	identityKey, err := userKeyBundle.IdentityKey.Public()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public identity key: %w", err)
+	}
+	return &ChatApp{
+		config:            config,
+		transport:         transport,
+		userID:            common.AccountID(*identityKey),
+		username:          username,
+		sharePresence:     config.SharePresence,
+		deviceID:          deviceID,
+		userPrivKeyBundle: *userKeyBundle,
+		devices:           make(map[deviceAddress]*peerDevice),
+		peers:             make(peerActivities),
+		closing:           make(chan struct{}),
+		writerWake:        make(chan struct{}, 1),
+		reconnectBackoff:  backoff{min: configs.ReconnectMinDelay, max: configs.ReconnectMaxDelay},
+	}, nil
 }
 
 // connectToWebSocket connects to the WebSocket server.
 // Already has recipientID set.
 func (app *ChatApp) connectToWebSocket() error {
-	serverUrl := fmt.Sprintf("ws://%s%s?from=%s&to=%s", configs.ServerAddress, configs.WebSocketPath, app.userID, app.recipientID)
-	conn, _, err := websocket.DefaultDialer.Dial(serverUrl, nil)
+	conn, err := app.dial()
 	if err != nil {
-		return fmt.Errorf("failed to connect to WebSocket server: %w", err)
+		return err
 	}
-	app.wsConn = conn
 
-	// Get other's keys from server
-	theirKeys, err := app.GetKeys(app.recipientID)
-	if err != nil {
+	// The recipient's identity key is pinned on first contact, the server must not be able to replace it
+	if err := app.loadIdentity(); err != nil {
+		return fmt.Errorf("failed to load identity of %s: %w", app.recipientName, err)
+	}
+
+	// Get the recipient's and our other devices' keys from server
+	if _, _, err := app.refreshDevices(); err != nil {
 		logger.Fatalf("Error getting recipient keys: %v", err)
 	}
-	app.otherIDKeyBundle = *theirKeys
+	if err := app.saveIdentity(); err != nil {
+		return fmt.Errorf("failed to save identity of %s: %w", app.recipientName, err)
+	}
 
 	if err = app.load(); err != nil {
 		if !errors.Is(err, redis.Nil) {
 			return fmt.Errorf("failed to load data: %w", err)
 		}
 	}
+	if app.identityChanged() {
+		app.warnIdentityChanged()
+	}
 
-	app.wg.Add(1)
+	app.wg.Add(4)
+	go func() {
+		defer app.wg.Done()
+		app.runConnection(conn)
+	}()
+	go func() {
+		defer app.wg.Done()
+		app.runWriter()
+	}()
 	go func() {
 		defer app.wg.Done()
-		app.listenForMessages()
+		app.runExpiry()
+	}()
+	go func() {
+		defer app.wg.Done()
+		app.runActivity()
 	}()
 
 	return nil
 }
 
-// listenForMessages listens for incoming WebSocket messages
-func (app *ChatApp) listenForMessages() {
+// listenForMessages listens for incoming WebSocket messages until the connection is closed
+func (app *ChatApp) listenForMessages(conn *websocket.Conn) {
+	// The server pings idle connections, without them the connection is considered lost
+	conn.SetReadDeadline(time.Now().Add(configs.ClientReadTimeout))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(configs.ClientReadTimeout))
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(configs.ClientWriteTimeout))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+
 	for {
-		_, msgBytes, err := app.wsConn.ReadMessage()
+		_, msgBytes, err := conn.ReadMessage()
 		if err != nil {
+			select {
+			case <-app.closing:
+				return
+			default:
+			}
 			logger.Errorf("Error reading message: %v", err)
+			if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				app.appendNotice("Disconnected by the server for sending too many messages, reconnecting")
+			} else if websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+				app.appendNotice("The server is restarting, reconnecting. Messages to you are kept meanwhile.")
+			}
 			return
 		}
+		conn.SetReadDeadline(time.Now().Add(configs.ClientReadTimeout))
+
+		// The server replies with an error when it could not handle one of our messages
+		var reply common.ErrorReply
+		if err := json.Unmarshal(msgBytes, &reply); err == nil && reply.Code != "" {
+			app.handleErrorReply(&reply)
+			continue
+		}
 
 		var msg common.MessageBundle
 		if err := json.Unmarshal(msgBytes, &msg); err != nil {
@@ -92,29 +204,210 @@ func (app *ChatApp) listenForMessages() {
 			continue
 		}
 
-		plaintext, err := app.decryptMessage(&msg)
-		if err != nil {
-			logger.Errorf("Error decrypting message: %v", err)
-			continue
+		app.receiveMessage(&msg)
+	}
+}
+
+// handleErrorReply tells the user that a message could not be delivered
+func (app *ChatApp) handleErrorReply(reply *common.ErrorReply) {
+	addr := app.deviceName(deviceAddress{UserID: reply.To, DeviceID: reply.ToDevice})
+	switch reply.Code {
+	case common.ErrorQueueFull:
+		app.appendNotice("Message to %s not delivered: too many messages are waiting for this device", addr)
+	case common.ErrorAccountDeleted:
+		app.appendNotice("%s deleted their account, messages to them are no longer delivered", app.displayName(reply.To))
+	default:
+		app.appendNotice("Message to %s not delivered: server error (%s)", addr, reply.Code)
+	}
+}
+
+// senderDevice returns the device a message comes from, fetching the device list again if it is unknown
+func (app *ChatApp) senderDevice(msg *common.MessageBundle) (*peerDevice, error) {
+	addr := deviceAddress{UserID: msg.From, DeviceID: msg.FromDevice}
+	app.sessionLock.Lock()
+	dev, ok := app.devices[addr]
+	app.sessionLock.Unlock()
+	if ok {
+		return dev, nil
+	}
+
+	added, identityChanged, err := app.refreshDevices()
+	if err != nil {
+		return nil, err
+	}
+	if identityChanged {
+		app.warnIdentityChanged()
+	}
+	for _, dev := range added {
+		app.appendNotice("%s joined the conversation", app.deviceName(dev.Address))
+	}
+
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+	if dev, ok := app.devices[addr]; ok {
+		return dev, nil
+	}
+	return nil, fmt.Errorf("unknown device %s", addr)
+}
+
+// receiveMessage decrypts an incoming message and acts on its content
+func (app *ChatApp) receiveMessage(msg *common.MessageBundle) {
+	dev, err := app.senderDevice(msg)
+	if err != nil {
+		logger.Errorf("Error receiving message: %v", err)
+		return
+	}
+
+	app.sessionLock.Lock()
+	content, replaced, err := app.decryptMessage(dev, msg)
+	if err != nil {
+		logger.Errorf("Error decrypting message from %s: %v", dev.Address, err)
+		reset := dev.countUndecryptable(err)
+		app.sessionLock.Unlock()
+
+		if reset {
+			app.recoverSession(dev)
+		}
+		return
+	}
+	dev.DecryptFailures = 0
+	if content.Type == common.ContentEndSession {
+		dev.clearSession()
+	}
+	app.sessionLock.Unlock()
+
+	// Messages from our other devices are the ones we sent from there
+	sender := app.displayName(msg.From)
+	if msg.From == app.userID {
+		sender = "You"
+	}
+
+	if msg.From == app.recipientID {
+		app.receiveActivity(dev.Address, content)
+	}
+
+	switch content.Type {
+	case common.ContentText:
+		if replaced {
+			app.appendNotice("%s started a new secure session", app.deviceName(dev.Address))
+		}
+		// A message reusing the ID of another would make references to it ambiguous
+		if isMessageID(content.ID) && app.messageExists(content.ID) {
+			logger.Warnf("Ignoring message from %s with the ID of another message %s", dev.Address, content.ID)
+			return
+		}
+		// The timer a message was sent with becomes the one of the conversation, like in Signal
+		timer := time.Duration(content.ExpireTimer) * time.Second
+		if app.applyExpireTimer(timer) {
+			app.appendNotice("%s set disappearing messages to %s", sender, formatExpireTimer(timer))
+		}
+		// Messages of clients that do not send IDs cannot be referred to
+		if !isMessageID(content.ID) {
+			app.appendEntry(messageEntry{Text: fmt.Sprintf("[%s] %s", sender, content.Body)}, timer)
+		} else {
+			app.appendEntry(messageEntry{ID: content.ID, Author: msg.From, Text: content.Body}, timer)
+		}
+	case common.ContentEndSession:
+		app.appendNotice("%s reset the secure session", app.deviceName(dev.Address))
+	case common.ContentSessionReset:
+		app.appendNotice("%s started a new secure session", app.deviceName(dev.Address))
+	case common.ContentExpireTimerUpdate:
+		timer := time.Duration(content.ExpireTimer) * time.Second
+		app.applyExpireTimer(timer)
+		app.appendNotice("%s set disappearing messages to %s", sender, formatExpireTimer(timer))
+	case common.ContentTyping, common.ContentPresence:
+		// Shown in the title by receiveActivity
+	case common.ContentEdit, common.ContentDelete, common.ContentReaction:
+		if err := app.applyUpdate(msg.From, content); err != nil {
+			logger.Warnf("Ignoring change of message %s from %s: %v", content.Target, dev.Address, err)
+		}
+	default:
+		logger.Warnf("Ignoring content of unknown type %d from %s", content.Type, dev.Address)
+	}
+}
+
+// recoverSession starts a fresh session with dev after the current one turned out to be unusable,
+// so that the peer can adopt it and the conversation can continue
+func (app *ChatApp) recoverSession(dev *peerDevice) {
+	app.appendNotice("Could not decrypt messages from %s, starting a new secure session", app.deviceName(dev.Address))
+	if err := app.sendContentTo(dev, &common.Content{Type: common.ContentSessionReset}); err != nil {
+		logger.Errorf("Error sending session reset to %s: %v", dev.Address, err)
+	}
+}
+
+// endSession tells every device that the current sessions are over and discards them,
+// so that the next message starts fresh X3DH handshakes
+func (app *ChatApp) endSession() error {
+	for _, dev := range app.deviceList() {
+		app.sessionLock.Lock()
+		hasSession := dev.activeSession() != nil
+		app.sessionLock.Unlock()
+
+		if hasSession {
+			if err := app.sendContentTo(dev, &common.Content{Type: common.ContentEndSession}); err != nil {
+				return fmt.Errorf("failed to send end of session to %s: %w", dev.Address, err)
+			}
 		}
 
-		app.messageLock.Lock()
-		app.messages = append(app.messages, fmt.Sprintf("[%s] %s", msg.From, plaintext))
-		app.messageLock.Unlock()
+		app.sessionLock.Lock()
+		dev.clearSession()
+		app.sessionLock.Unlock()
+	}
+
+	app.appendNotice("You reset the secure session")
+	return nil
+}
+
+// deviceList returns the devices content is sent to
+func (app *ChatApp) deviceList() []*peerDevice {
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+
+	devices := make([]*peerDevice, 0, len(app.devices))
+	for _, dev := range app.devices {
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+// sendMessage sends a text message to the recipient, disappearing after the timer of the conversation.
+// It returns the ID of the message, also when it was not sent to every device.
+func (app *ChatApp) sendMessage(message string) (string, error) {
+	id := newMessageID()
+	return id, app.sendContent(&common.Content{
+		Type:        common.ContentText,
+		ID:          id,
+		Body:        message,
+		ExpireTimer: expireTimerSeconds(app.currentExpireTimer()),
+	})
+}
+
+// sendContent sends content to every device of the recipient and to our other devices.
+// Nothing is sent while the recipient's identity key changed and the user did not verify it.
+func (app *ChatApp) sendContent(content *common.Content) error {
+	if app.identityChanged() {
+		return ErrIdentityChanged
+	}
 
-		app.Gui.Update(func(g *gocui.Gui) error {
-			return app.UpdateMessages(g)
-		})
+	var errs []error
+	for _, dev := range app.deviceList() {
+		if err := app.sendContentTo(dev, content); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dev.Address, err))
+		}
 	}
+	return errors.Join(errs...)
 }
 
-// sendMessage sends a message to the WebSocket server in JSON format
-func (app *ChatApp) sendMessage(message string) error {
-	if app.wsConn == nil {
-		return fmt.Errorf("WebSocket connection not established")
+// sendContentTo encrypts content for dev and sends it to the WebSocket server in JSON format.
+// While disconnected, the message waits in the outbox, unless it is full.
+func (app *ChatApp) sendContentTo(dev *peerDevice, content *common.Content) error {
+	if app.pendingMessages() >= configs.MaxOutbox {
+		return ErrOutboxFull
 	}
 
-	msg, err := app.encryptMessage(message)
+	app.sessionLock.Lock()
+	msg, err := app.encryptMessage(dev, content)
+	app.sessionLock.Unlock()
 	if err != nil {
 		logger.Errorf("Error encrypting message: %v", err)
 		return fmt.Errorf("failed to encrypt message: %w", err)
@@ -125,43 +418,66 @@ func (app *ChatApp) sendMessage(message string) error {
 		return fmt.Errorf("failed to marshal message to JSON: %w", err)
 	}
 
-	err = app.wsConn.WriteMessage(websocket.TextMessage, msgJSON)
-	if err != nil {
-		return fmt.Errorf("failed to send message: %w", err)
-	}
+	app.send(dev, msgJSON)
 	return nil
 }
 
+// appendMessage adds a line to the chat history and refreshes the message view
+func (app *ChatApp) appendMessage(line string) {
+	app.appendEntry(messageEntry{Text: line}, 0)
+}
+
+// appendNotice adds a system notice to the chat history
+func (app *ChatApp) appendNotice(format string, args ...any) {
+	app.appendMessage("[!] " + fmt.Sprintf(format, args...))
+}
+
 // quit handles quitting the application
 func (app *ChatApp) quit(_ *gocui.Gui, _ *gocui.View) error {
 	logger.Info("Shutting down gracefully...")
+	app.sendPresence(false)
+	// The writer may be waiting, the presence must be written before the connection is closed
+	app.flushOutbox()
+	close(app.closing)
+	app.connLock.Lock()
 	if app.wsConn != nil {
 		app.wsConn.Close()
 	}
+	app.connLock.Unlock()
 	app.wg.Wait()
 
 	if err := app.save(); err != nil {
 		logger.Errorf("Error saving data: %v", err)
 	}
+	app.closeStore()
 
 	return gocui.ErrQuit
 }
 
-// PostKeys publishes Bob's keys to the server
+// PostKeys publishes the keys of this device to the server
 func (app *ChatApp) PostKeys() error {
-	serverURL := fmt.Sprintf("http://%s%s/%s", configs.ServerAddress, configs.PublishKeysPath, app.userID)
+	serverURL := app.transport.httpURL(fmt.Sprintf("%s/%s/%d", configs.PublishKeysPath, app.userID, app.deviceID))
 
 	payload, err := app.userPrivKeyBundle.ToPublicBundle()
 	if err != nil {
 		return fmt.Errorf("failed to convert keys to public bundle: %v", err)
 	}
 
-	payloadBytes, err := json.Marshal(payload)
+	bundle, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %v", err)
+	}
+	// The bundle is signed for this device, so that it cannot be published for another one
+	request, err := common.SignPublishKeysRequest(app.userPrivKeyBundle.IdentityKey, app.userID, app.deviceID, bundle)
+	if err != nil {
+		return err
+	}
+	payloadBytes, err := json.Marshal(request)
 	if err != nil {
 		return fmt.Errorf("failed to marshal payload: %v", err)
 	}
 
-	resp, err := http.Post(serverURL, "application/json", bytes.NewBuffer(payloadBytes))
+	resp, err := app.transport.httpClient.Post(serverURL, "application/json", bytes.NewBuffer(payloadBytes))
 	if err != nil {
 		return fmt.Errorf("failed to send request: %v", err)
 	}
@@ -174,120 +490,37 @@ func (app *ChatApp) PostKeys() error {
 	return nil
 }
 
-func (app *ChatApp) GetKeys(recipientID string) (*alice.BobPublicPrekeyBundle, error) {
-	serverURL := fmt.Sprintf("http://%s%s/%s", configs.ServerAddress, configs.PublishKeysPath, recipientID)
+// GetKeys fetches the public prekey bundles of every device of a user
+func (app *ChatApp) GetKeys(recipientID string) ([]common.DevicePrekeyBundle, error) {
+	serverURL := app.transport.httpURL(fmt.Sprintf("%s/%s", configs.PublishKeysPath, recipientID))
 
-	resp, err := http.Get(serverURL)
+	resp, err := app.transport.httpClient.Get(serverURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %v", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrUnknownUser
+	} else if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("server returned non-OK status: %v", resp.Status)
 	}
 
-	var publicPrekeyBundle alice.BobPublicPrekeyBundle
-	if err := json.NewDecoder(resp.Body).Decode(&publicPrekeyBundle); err != nil {
+	var bundles []common.DevicePrekeyBundle
+	if err := json.NewDecoder(resp.Body).Decode(&bundles); err != nil {
 		return nil, fmt.Errorf("failed to decode response: %v", err)
 	}
 
-	return &publicPrekeyBundle, nil
+	return bundles, nil
 }
 
-func (app *ChatApp) getADBytes() ([64]byte, error) {
+func (app *ChatApp) getADBytes(dev *peerDevice) ([64]byte, error) {
 	var adBytes [64]byte
 	userIDPub, err := app.userPrivKeyBundle.IdentityKey.Public()
 	if err != nil {
 		return adBytes, fmt.Errorf("failed to get public key: %v", err)
 	}
 	copy(adBytes[:32], userIDPub[:])
-	copy(adBytes[32:], app.otherIDKeyBundle.IdentityKey[:])
+	copy(adBytes[32:], dev.Bundle.IdentityKey[:])
 	return adBytes, nil
 }
-
-func (app *ChatApp) save() error {
-	// Initialize Redis client
-	rdb := redis.NewClient(&redis.Options{Addr: configs.RedisAddress})
-
-	if app.ratchet != nil {
-		// Save ratchet
-		var ratchetBuffer bytes.Buffer
-		ratchetEncoder := gob.NewEncoder(&ratchetBuffer)
-		if err := ratchetEncoder.Encode(app.ratchet); err != nil {
-			return err
-		}
-		if err := rdb.Set(context.Background(), fmt.Sprintf(configs.ClientRatchetKey, app.userID, app.recipientID), ratchetBuffer.Bytes(), 0).Err(); err != nil {
-			return err
-		}
-	}
-
-	// Save messages
-	var messagesBuffer bytes.Buffer
-	messagesEncoder := gob.NewEncoder(&messagesBuffer)
-	if err := messagesEncoder.Encode(app.messages); err != nil {
-		return err
-	}
-	if err := rdb.Set(context.Background(), fmt.Sprintf(configs.ClientMessagesKey, app.userID, app.recipientID), messagesBuffer.Bytes(), 0).Err(); err != nil {
-		return err
-	}
-
-	if app.initHandshake != nil {
-		// Save initHandshake
-		var initHandshakeBuffer bytes.Buffer
-		initHandshakeEncoder := gob.NewEncoder(&initHandshakeBuffer)
-		if err := initHandshakeEncoder.Encode(app.initHandshake); err != nil {
-			return err
-		}
-		if err := rdb.Set(context.Background(), fmt.Sprintf(configs.ClientInitHandshakeKey, app.userID, app.recipientID), initHandshakeBuffer.Bytes(), 0).Err(); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (app *ChatApp) load() error {
-	// Initialize Redis client
-	rdb := redis.NewClient(&redis.Options{Addr: configs.RedisAddress})
-
-	// Load ratchet
-	ratchetData, err := rdb.Get(context.Background(), fmt.Sprintf(configs.ClientRatchetKey, app.userID, app.recipientID)).Bytes()
-	if err == nil {
-		ratchetBuffer := bytes.NewBuffer(ratchetData)
-		ratchetDecoder := gob.NewDecoder(ratchetBuffer)
-		app.ratchet = &doubleratchet.DoubleRatchet{}
-		if err := ratchetDecoder.Decode(app.ratchet); err != nil {
-			return err
-		}
-	} else if !errors.Is(err, redis.Nil) {
-		return err
-	}
-
-	// Load messages
-	messagesData, err := rdb.Get(context.Background(), fmt.Sprintf(configs.ClientMessagesKey, app.userID, app.recipientID)).Bytes()
-	if err == nil {
-		messagesBuffer := bytes.NewBuffer(messagesData)
-		messagesDecoder := gob.NewDecoder(messagesBuffer)
-		if err := messagesDecoder.Decode(&app.messages); err != nil {
-			return err
-		}
-	} else if !errors.Is(err, redis.Nil) {
-		return err
-	}
-
-	// Load initHandshake
-	initHandshakeData, err := rdb.Get(context.Background(), fmt.Sprintf(configs.ClientInitHandshakeKey, app.userID, app.recipientID)).Bytes()
-	if err == nil {
-		initHandshakeBuffer := bytes.NewBuffer(initHandshakeData)
-		initHandshakeDecoder := gob.NewDecoder(initHandshakeBuffer)
-		app.initHandshake = &common.X3DHHandshakeBundle{}
-		if err := initHandshakeDecoder.Decode(app.initHandshake); err != nil {
-			return err
-		}
-	} else if !errors.Is(err, redis.Nil) {
-		return err
-	}
-
-	return nil
-}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"fmt"
+	"minimal-signal/common"
+	"strings"
+	"time"
+)
+
+// commandPrefix marks input that is a command for the client rather than a message for the recipient
+const commandPrefix = "/"
+
+// handleCommand runs a command typed into the input view
+func (app *ChatApp) handleCommand(input string) error {
+	fields := strings.Fields(input)
+	switch fields[0] {
+	case "/reset":
+		return app.endSession()
+	case "/verify":
+		// The safety number was compared by reading it, or with the payload of the recipient's QR code
+		if len(fields) > 2 {
+			return fmt.Errorf("usage: /verify [payload of the recipient's QR code]")
+		}
+		return app.verifyIdentity(strings.Join(fields[1:], ""))
+	case "/timer":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: /timer <duration, e.g. 30s or 1h> or /timer off")
+		}
+		if fields[1] == "off" {
+			return app.setExpireTimer(0)
+		}
+		timer, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return fmt.Errorf("invalid disappearing message timer: %w", err)
+		}
+		return app.setExpireTimer(timer)
+	case "/edit":
+		ref, text := commandArgs(input)
+		if ref == "" || text == "" {
+			return fmt.Errorf("usage: /edit <message reference, e.g. #1a2b3c> <new text>")
+		}
+		return app.editMessage(ref, text)
+	case "/delete":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: /delete <message reference, e.g. #1a2b3c>")
+		}
+		return app.deleteMessage(fields[1])
+	case "/react":
+		// Without an emoji, our reaction is removed
+		if len(fields) != 2 && len(fields) != 3 {
+			return fmt.Errorf("usage: /react <message reference, e.g. #1a2b3c> [emoji]")
+		}
+		return app.reactToMessage(fields[1], strings.Join(fields[2:], ""))
+	case "/qr":
+		return app.showScannableFingerprint()
+	case "/link":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: /link <code shown by the new device>")
+		}
+		return app.linkDevice(fields[1])
+	case "/revoke":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: /revoke <device ID>")
+		}
+		deviceID, err := common.ParseDeviceID(fields[1])
+		if err != nil {
+			return fmt.Errorf("invalid device ID: %w", err)
+		}
+		return app.RevokeDevice(deviceID)
+	case "/username":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: /username <new username>")
+		}
+		return app.changeUsername(fields[1])
+	case "/presence":
+		if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+			return fmt.Errorf("usage: /presence on or /presence off")
+		}
+		app.setSharePresence(fields[1] == "on")
+		return nil
+	case "/unregister":
+		// Deleting the account cannot be undone, the username is typed again to confirm
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: /unregister <your username>")
+		}
+		return app.unregister(fields[1])
+	default:
+		return fmt.Errorf("unknown command %s", fields[0])
+	}
+}
+
+// commandArgs splits the arguments of a command into the first one and the rest of the input, whose spaces
+// are kept
+func commandArgs(input string) (first, rest string) {
+	_, args, _ := strings.Cut(strings.TrimSpace(input), " ")
+	first, rest, _ = strings.Cut(strings.TrimSpace(args), " ")
+	return first, strings.TrimSpace(rest)
+}
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jroimartin/gocui"
+)
+
+// connState is the state of the WebSocket connection to the server
+type connState int
+
+const (
+	stateConnecting connState = iota
+	stateConnected
+	// stateDisconnected waits before connecting again
+	stateDisconnected
+)
+
+// backoff computes the delays between connection attempts, doubling from min up to max
+type backoff struct {
+	min      time.Duration
+	max      time.Duration
+	attempts int
+}
+
+// next returns the delay before the next attempt, shortened by up to a fifth at random so that
+// clients disconnected together do not all come back at once
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.attempts < 32 && b.min<<b.attempts < b.max {
+		delay = b.min << b.attempts
+		b.attempts++
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// reset makes the next delay min again, once connected
+func (b *backoff) reset() {
+	b.attempts = 0
+}
+
+// dial opens a WebSocket connection to the server, for the conversation with the recipient. The connection is
+// signed with the identity key, each time, since the server refuses a signature it already got.
+func (app *ChatApp) dial() (*websocket.Conn, error) {
+	request, err := common.SignConnectRequest(app.userPrivKeyBundle.IdentityKey, app.userID, app.deviceID, app.recipientID)
+	if err != nil {
+		return nil, err
+	}
+	serverUrl := app.transport.wsURL(fmt.Sprintf("%s?from=%s&device=%d&to=%s&%s", configs.WebSocketPath, app.userID, app.deviceID, app.recipientID, request.ConnectQuery().Encode()))
+	conn, _, err := app.transport.dialer.Dial(serverUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to WebSocket server: %w", err)
+	}
+	return conn, nil
+}
+
+// runConnection receives messages on conn and connects again whenever the connection is lost, until the app quits
+func (app *ChatApp) runConnection(conn *websocket.Conn) {
+	for app.setConnected(conn) {
+		app.listenForMessages(conn)
+		if conn = app.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+// reconnect dials the server until it succeeds, waiting longer after each failure.
+// It returns nil if the app quits first.
+func (app *ChatApp) reconnect() *websocket.Conn {
+	for {
+		delay := app.reconnectBackoff.next()
+		app.setConnState(stateDisconnected, time.Now().Add(delay))
+		select {
+		case <-app.closing:
+			return nil
+		case <-time.After(delay):
+		}
+
+		app.setConnState(stateConnecting, time.Time{})
+		conn, err := app.dial()
+		if err == nil {
+			return conn
+		}
+		logger.Errorf("Error reconnecting: %v", err)
+	}
+}
+
+// setConnected makes conn the connection messages are sent on and sends the outbox.
+// It returns false, closing conn, if the app is quitting.
+func (app *ChatApp) setConnected(conn *websocket.Conn) bool {
+	app.connLock.Lock()
+	select {
+	case <-app.closing:
+		app.connLock.Unlock()
+		conn.Close()
+		return false
+	default:
+	}
+	app.wsConn = conn
+	app.connState = stateConnected
+	app.reconnectBackoff.reset()
+	app.connLock.Unlock()
+
+	app.wakeWriter()
+	app.updateGui(app.updateStatus)
+	app.announcePresence()
+	return true
+}
+
+// setConnState records that the client is not connected, and when it connects again if it is disconnected.
+// Activity not sent yet is dropped.
+func (app *ChatApp) setConnState(state connState, retryAt time.Time) {
+	app.connLock.Lock()
+	app.connState = state
+	app.retryAt = retryAt
+	app.ephemerals = nil
+	app.connLock.Unlock()
+
+	app.updateGui(app.updateStatus)
+}
+
+// send adds a message encrypted for dev to the outbox, which the writer sends to the server once the client
+// is connected. Messages are sent in the order they are given, which is the order they were encrypted in.
+func (app *ChatApp) send(dev *peerDevice, msgJSON []byte) {
+	app.connLock.Lock()
+	app.outbox = append(app.outbox, msgJSON)
+	app.connLock.Unlock()
+
+	if err := app.saveSent(dev); err != nil {
+		logger.Errorf("Error saving outbox: %v", err)
+	}
+	app.wakeWriter()
+	app.updateGui(app.updateStatus)
+}
+
+// wakeWriter tells the writer there is something to send
+func (app *ChatApp) wakeWriter() {
+	select {
+	case app.writerWake <- struct{}{}:
+	default:
+	}
+}
+
+// runWriter sends the outbox and the activity whenever there is something to send, until the app quits
+func (app *ChatApp) runWriter() {
+	for {
+		select {
+		case <-app.closing:
+			return
+		case <-app.writerWake:
+			app.flushOutbox()
+		}
+	}
+}
+
+// flushOutbox sends the outbox, then the activity, until there is nothing left or the connection fails.
+// connLock is not held while writing, so that the UI never waits for the server.
+func (app *ChatApp) flushOutbox() {
+	app.writeLock.Lock()
+	defer app.writeLock.Unlock()
+
+	sent := false
+	for {
+		conn, msgJSON, queued := app.nextWrite()
+		if conn == nil {
+			break
+		} else if msgJSON == nil {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(configs.ClientWriteTimeout))
+		if err := conn.WriteMessage(websocket.TextMessage, msgJSON); err != nil {
+			logger.Errorf("Error sending message, keeping the outbox until reconnected: %v", err)
+			// The listener sees the connection is closed and reconnects
+			conn.Close()
+			app.connLock.Lock()
+			if app.wsConn == conn {
+				app.connState = stateConnecting
+				app.ephemerals = nil
+			}
+			app.connLock.Unlock()
+			break
+		}
+		if queued {
+			// Only the writer removes messages from the outbox
+			app.connLock.Lock()
+			app.outbox = app.outbox[1:]
+			app.connLock.Unlock()
+			sent = true
+		}
+	}
+	if !sent {
+		return
+	}
+
+	rdb := app.store()
+	if err := app.saveOutbox(rdb); err != nil {
+		logger.Errorf("Error saving outbox: %v", err)
+	}
+	app.updateGui(app.updateStatus)
+}
+
+// nextWrite returns the connection and the next message to write on it: the first of the outbox, which is
+// queued until written, or the next activity, encrypted now and nil if it cannot be. conn is nil if the
+// client is not connected or there is nothing to send.
+func (app *ChatApp) nextWrite() (conn *websocket.Conn, msgJSON []byte, queued bool) {
+	app.connLock.Lock()
+	if app.connState != stateConnected {
+		app.connLock.Unlock()
+		return nil, nil, false
+	}
+	conn = app.wsConn
+	if len(app.outbox) > 0 {
+		msgJSON = app.outbox[0]
+		app.connLock.Unlock()
+		return conn, msgJSON, true
+	}
+	if len(app.ephemerals) == 0 {
+		app.connLock.Unlock()
+		return nil, nil, false
+	}
+	e := app.ephemerals[0]
+	app.ephemerals = app.ephemerals[1:]
+	app.connLock.Unlock()
+
+	return conn, app.encryptEphemeral(e), false
+}
+
+// pendingMessages returns the number of messages in the outbox
+func (app *ChatApp) pendingMessages() int {
+	app.connLock.Lock()
+	defer app.connLock.Unlock()
+	return len(app.outbox)
+}
+
+// statusTitle returns the title of the message view: the recipient and what it shares of its activity,
+// the state of the connection and the number of messages waiting for it
+func (app *ChatApp) statusTitle() string {
+	title := "Chat with " + app.recipientName
+	if status := app.peerStatus(time.Now()); status != "" {
+		title += ", " + status
+	}
+
+	app.connLock.Lock()
+	defer app.connLock.Unlock()
+	switch app.connState {
+	case stateConnecting:
+		title += " (connecting...)"
+	case stateConnected:
+		title += " (connected)"
+	case stateDisconnected:
+		title += fmt.Sprintf(" (disconnected, retrying in %s)", time.Until(app.retryAt).Round(time.Second))
+	}
+	if len(app.outbox) > 0 {
+		title += fmt.Sprintf(" - %d message(s) waiting to be sent", len(app.outbox))
+	}
+	return title
+}
+
+// updateStatus shows the state of the connection in the message view
+func (app *ChatApp) updateStatus(g *gocui.Gui) error {
+	v, err := g.View("messages")
+	if errors.Is(err, gocui.ErrUnknownView) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	v.Title = app.statusTitle()
+	return nil
+}
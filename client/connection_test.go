@@ -0,0 +1,161 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	b := backoff{min: time.Second, max: 10 * time.Second}
+	for _, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		delay := b.next()
+		assert.LessOrEqual(t, delay, want*time.Second)
+		assert.GreaterOrEqual(t, delay, want*time.Second*4/5)
+	}
+
+	b.reset()
+	assert.LessOrEqual(t, b.next(), time.Second)
+}
+
+// testRelay is a WebSocket server that can go down, passing the messages it receives to the test
+type testRelay struct {
+	*httptest.Server
+	up       atomic.Bool
+	conns    chan *websocket.Conn
+	messages chan []byte
+}
+
+func newTestRelay(t *testing.T) *testRelay {
+	relay := &testRelay{conns: make(chan *websocket.Conn, 10), messages: make(chan []byte, 10)}
+	relay.up.Store(true)
+	upgrader := websocket.Upgrader{}
+	relay.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !relay.up.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		relay.conns <- conn
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			relay.messages <- data
+		}
+	}))
+	t.Cleanup(relay.Close)
+	return relay
+}
+
+// receive returns the next message the relay received, decrypted by to
+func (relay *testRelay) receive(t *testing.T, to, from *ChatApp) string {
+	select {
+	case data := <-relay.messages:
+		var msg common.MessageBundle
+		require.NoError(t, json.Unmarshal(data, &msg))
+		content, _, err := to.decryptMessage(to.devices[from.address()], &msg)
+		require.NoError(t, err)
+		return content.Body
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return ""
+	}
+}
+
+// connectTestRelay connects app to relay in the background, like connectToWebSocket
+func connectTestRelay(t *testing.T, app *ChatApp, relay *testRelay) *websocket.Conn {
+	config := *app.config
+	config.ServerAddress = relay.Listener.Addr().String()
+	config.DisableTLS = true
+	app.transport = newTestTransport(t, &config)
+	app.reconnectBackoff = backoff{min: 10 * time.Millisecond, max: 50 * time.Millisecond}
+
+	conn, err := app.dial()
+	require.NoError(t, err)
+	app.wg.Add(2)
+	go func() {
+		defer app.wg.Done()
+		app.runConnection(conn)
+	}()
+	go func() {
+		defer app.wg.Done()
+		app.runWriter()
+	}()
+	t.Cleanup(func() {
+		close(app.closing)
+		app.connLock.Lock()
+		app.wsConn.Close()
+		app.connLock.Unlock()
+		app.wg.Wait()
+	})
+	return <-relay.conns
+}
+
+func waitConnState(t *testing.T, app *ChatApp, state connState) {
+	require.Eventually(t, func() bool {
+		app.connLock.Lock()
+		defer app.connLock.Unlock()
+		return app.connState == state
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestOutboxSentAfterReconnect(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	relay := newTestRelay(t)
+	serverConn := connectTestRelay(t, alice, relay)
+	waitConnState(t, alice, stateConnected)
+
+	require.NoError(t, alice.sendContentTo(alice.devices[bob.address()], textContent("one")))
+	assert.Equal(t, "one", relay.receive(t, bob, alice))
+
+	// The server goes away, messages wait in the outbox
+	relay.up.Store(false)
+	serverConn.Close()
+	waitConnState(t, alice, stateDisconnected)
+	require.NoError(t, alice.sendContentTo(alice.devices[bob.address()], textContent("two")))
+	require.NoError(t, alice.sendContentTo(alice.devices[bob.address()], textContent("three")))
+	assert.Equal(t, 2, alice.pendingMessages())
+	assert.Contains(t, alice.statusTitle(), "2 message(s) waiting")
+
+	// Once it is back, they are sent in order
+	relay.up.Store(true)
+	<-relay.conns
+	assert.Equal(t, "two", relay.receive(t, bob, alice))
+	assert.Equal(t, "three", relay.receive(t, bob, alice))
+	waitConnState(t, alice, stateConnected)
+	assert.Zero(t, alice.pendingMessages())
+}
+
+func TestOutboxSavedAndBounded(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	bobDev := alice.devices[bob.address()]
+
+	// A message waiting to be sent survives a restart, with the sessions it was encrypted with
+	require.NoError(t, alice.sendContentTo(bobDev, textContent("hi bob")))
+	restarted := newTestDevice(t, "alice", common.PrimaryDeviceID, &alice.userPrivKeyBundle.IdentityKey)
+	restarted.config.RedisAddress = alice.config.RedisAddress
+	restarted.recipientID = bob.userID
+	restarted.devices[bob.address()] = &peerDevice{Address: bob.address(), Bundle: bobDev.Bundle}
+	require.NoError(t, restarted.load())
+	assert.Equal(t, alice.outbox, restarted.outbox)
+	assert.Equal(t, bobDev.activeSession().Ratchet.CurrentState.Ns, restarted.devices[bob.address()].activeSession().Ratchet.CurrentState.Ns)
+
+	alice.outbox = make([][]byte, configs.MaxOutbox)
+	assert.ErrorIs(t, alice.sendContentTo(bobDev, textContent("too many")), ErrOutboxFull)
+	assert.Len(t, alice.outbox, configs.MaxOutbox)
+}
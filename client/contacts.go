@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"net/http"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// contact is a user this device chatted with, by account ID, with the username it had then
+type contact struct {
+	UserID     string
+	Username   string
+	Registered bool
+}
+
+// LookupUsers returns which of userIDs are registered. The server only sees their directory hashes.
+func (app *ChatApp) LookupUsers(userIDs []string) (map[string]bool, error) {
+	registered := make(map[string]bool, len(userIDs))
+	for start := 0; start < len(userIDs); start += configs.MaxDirectoryHashes {
+		batch := userIDs[start:min(start+configs.MaxDirectoryHashes, len(userIDs))]
+		byHash := make(map[string]string, len(batch))
+		request := common.DirectoryRequest{Hashes: make([]string, len(batch))}
+		for i, userID := range batch {
+			request.Hashes[i] = common.DirectoryHash(userID)
+			byHash[request.Hashes[i]] = userID
+		}
+
+		payload, err := json.Marshal(&request)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal directory request: %w", err)
+		}
+		resp, err := app.transport.httpClient.Post(app.transport.httpURL(configs.DirectoryPath), "application/json", bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("failed to send request: %w", err)
+		}
+		var response common.DirectoryResponse
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("server returned non-OK status: %v", resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&response)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, hash := range response.Registered {
+			if userID, ok := byHash[hash]; ok {
+				registered[userID] = true
+			}
+		}
+	}
+	return registered, nil
+}
+
+// loadContacts loads the contacts of this device, sorted by username, and checks which of them are still registered
+func (app *ChatApp) loadContacts() error {
+	rdb := app.store()
+
+	userIDs, err := rdb.SMembers(context.Background(), fmt.Sprintf(configs.ClientContactsKey, app.userID, app.deviceID)).Result()
+	if err != nil {
+		return err
+	}
+	usernames, err := rdb.HGetAll(context.Background(), fmt.Sprintf(configs.ClientUsernamesKey, app.userID, app.deviceID)).Result()
+	if err != nil {
+		return err
+	}
+	registered, err := app.LookupUsers(userIDs)
+	if err != nil {
+		return fmt.Errorf("failed to look up contacts: %w", err)
+	}
+
+	app.contacts = make([]contact, len(userIDs))
+	for i, userID := range userIDs {
+		app.contacts[i] = contact{UserID: userID, Username: usernames[userID], Registered: registered[userID]}
+	}
+	sort.Slice(app.contacts, func(i, j int) bool { return app.contacts[i].Username < app.contacts[j].Username })
+	return nil
+}
+
+// addContact adds an account to the contacts of this device, or updates its username
+func (app *ChatApp) addContact(account *common.Account) error {
+	rdb := app.store()
+	_, err := rdb.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.SAdd(context.Background(), fmt.Sprintf(configs.ClientContactsKey, app.userID, app.deviceID), account.ID)
+		pipe.HSet(context.Background(), fmt.Sprintf(configs.ClientUsernamesKey, app.userID, app.deviceID), account.ID, account.Username)
+		return nil
+	})
+	return err
+}
+
+// findRecipient returns the account to chat with, and the contact known by that username if there is one.
+// A contact stays the same account even if it was renamed since. Other usernames are resolved by the server,
+// also the one of a contact whose account is gone: it may now belong to another account than the contact's.
+func (app *ChatApp) findRecipient(username string) (account *common.Account, previous *contact, err error) {
+	username = common.NormalizeUsername(username)
+	for i := range app.contacts {
+		c := &app.contacts[i]
+		if c.Username != username {
+			continue
+		}
+		previous = c
+		if !c.Registered {
+			break
+		}
+		account, err := app.GetAccount(c.UserID)
+		if errors.Is(err, ErrUnknownUser) {
+			break
+		}
+		return account, c, err
+	}
+
+	account, err = app.ResolveUsername(username)
+	return account, previous, err
+}
+
+// setRecipient opens the chat with account, found as the contact previous if not nil. If the username of the
+// contact now belongs to another account, the identity key pinned for the contact stays pinned: the key of
+// the new account is a changed safety number, which the user must verify before messages are sent.
+func (app *ChatApp) setRecipient(account *common.Account, previous *contact) error {
+	if err := app.addContact(account); err != nil {
+		logger.Errorf("Error saving contact %s: %v", account.Username, err)
+	}
+	app.recipientID = account.ID
+	app.recipientName = account.Username
+	if previous == nil || previous.UserID == account.ID {
+		return nil
+	}
+
+	rdb := app.store()
+	identity := &contactIdentity{}
+	if _, err := loadGob(rdb, fmt.Sprintf(configs.ClientIdentityKey, app.userID, app.deviceID, previous.UserID), identity); err != nil {
+		return fmt.Errorf("failed to load identity of %s: %w", previous.Username, err)
+	}
+	// Without a pinned key, the zero key still makes any key of the new account a changed one
+	app.sessionLock.Lock()
+	app.recipientIdentity = &contactIdentity{IdentityKey: identity.IdentityKey}
+	app.sessionLock.Unlock()
+	return nil
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDirectory starts a server where the given accounts are registered, and points app at it
+func newTestDirectory(t *testing.T, app *ChatApp, accounts ...common.Account) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(configs.DirectoryPath, func(w http.ResponseWriter, r *http.Request) {
+		var request common.DirectoryRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		response := common.DirectoryResponse{Registered: []string{}}
+		for _, hash := range request.Hashes {
+			for _, account := range accounts {
+				if hash == common.DirectoryHash(account.ID) {
+					response.Registered = append(response.Registered, hash)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(&response)
+	})
+	serveAccount := func(prefix string, match func(common.Account, string) bool) {
+		mux.HandleFunc(prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+			for _, account := range accounts {
+				if match(account, strings.TrimPrefix(r.URL.Path, prefix+"/")) {
+					json.NewEncoder(w).Encode(&account)
+					return
+				}
+			}
+			http.NotFound(w, r)
+		})
+	}
+	serveAccount(configs.AccountsPath, func(account common.Account, id string) bool { return account.ID == id })
+	serveAccount(configs.UsernamesPath, func(account common.Account, username string) bool { return account.Username == username })
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	app.config.ServerAddress = server.Listener.Addr().String()
+	app.config.DisableTLS = true
+	app.transport = newTestTransport(t, app.config)
+}
+
+func TestContacts(t *testing.T) {
+	alice := newTestDevice(t, "alice", common.PrimaryDeviceID, nil)
+	alice.config.RedisAddress = miniredis.RunT(t).Addr()
+	bob := common.Account{ID: "b0b", Username: "bob"}
+	newTestDirectory(t, alice, bob, common.Account{ID: "ca401", Username: "carol"})
+
+	registered, err := alice.LookupUsers([]string{"b0b", "da4e"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"b0b": true}, registered)
+
+	require.NoError(t, alice.addContact(&common.Account{ID: "da4e", Username: "dave"}))
+	require.NoError(t, alice.addContact(&bob))
+	require.NoError(t, alice.loadContacts())
+	assert.Equal(t, []contact{{UserID: "b0b", Username: "bob", Registered: true}, {UserID: "da4e", Username: "dave"}}, alice.contacts)
+}
+
+func TestFindRenamedContact(t *testing.T) {
+	alice := newTestDevice(t, "alice", common.PrimaryDeviceID, nil)
+	alice.config.RedisAddress = miniredis.RunT(t).Addr()
+	require.NoError(t, alice.addContact(&common.Account{ID: "b0b", Username: "bob"}))
+
+	// Bob changed username to robert, and someone else took bob
+	robert := common.Account{ID: "b0b", Username: "robert"}
+	impostor := common.Account{ID: "1e7", Username: "bob"}
+	newTestDirectory(t, alice, robert, impostor)
+	require.NoError(t, alice.loadContacts())
+
+	account, previous, err := alice.findRecipient("bob")
+	require.NoError(t, err)
+	assert.Equal(t, &robert, account, "contacts keep their account")
+	assert.Equal(t, &contact{UserID: "b0b", Username: "bob", Registered: true}, previous)
+
+	account, previous, err = alice.findRecipient("robert")
+	require.NoError(t, err)
+	assert.Equal(t, &robert, account)
+	assert.Nil(t, previous)
+	_, _, err = alice.findRecipient("carol")
+	assert.ErrorIs(t, err, ErrUnknownUser)
+}
+
+func TestContactReplacedByAnotherAccount(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	bobKey := alice.devices[bob.address()].Bundle.IdentityKey
+	require.NoError(t, alice.setRecipient(&common.Account{ID: bob.userID, Username: "bob"}, nil))
+	alice.pinIdentity(&bobKey)
+	require.NoError(t, alice.saveIdentity())
+
+	// Bob's account is gone and someone else registered bob
+	malloryKey := newTestIdentityKey(t)
+	mallory := common.Account{ID: common.AccountID(*malloryKey), Username: "bob"}
+	newTestDirectory(t, alice, mallory)
+	require.NoError(t, alice.loadContacts())
+	account, previous, err := alice.findRecipient("bob")
+	require.NoError(t, err)
+	assert.Equal(t, &mallory, account)
+	require.NotNil(t, previous)
+	assert.Equal(t, bob.userID, previous.UserID)
+
+	// The new account's key is a changed safety number, not a first contact
+	alice.recipientIdentity = nil
+	require.NoError(t, alice.setRecipient(account, previous))
+	require.NoError(t, alice.loadIdentity())
+	assert.True(t, alice.pinIdentity(malloryKey))
+	assert.True(t, alice.identityChanged())
+	assert.Equal(t, bobKey, alice.recipientIdentity.IdentityKey)
+
+	// Also without a key pinned for the contact
+	require.NoError(t, alice.setRecipient(account, &contact{UserID: "da4e", Username: "bob"}))
+	assert.True(t, alice.pinIdentity(malloryKey))
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"fmt"
+	"minimal-signal/common"
+	"minimal-signal/crypto/key_ed25519"
+	"minimal-signal/protocol/x3dh/alice"
+	"slices"
+)
+
+// deviceAddress identifies one device of a user
+type deviceAddress struct {
+	UserID   string
+	DeviceID common.DeviceID
+}
+
+func (addr deviceAddress) String() string {
+	return fmt.Sprintf("%s (device %d)", addr.UserID, addr.DeviceID)
+}
+
+// displayName returns the username shown for an account, the account ID if it is not one of the conversation
+func (app *ChatApp) displayName(userID string) string {
+	switch userID {
+	case app.userID:
+		return app.username
+	case app.recipientID:
+		return app.recipientName
+	}
+	return userID
+}
+
+// deviceName returns how a device is shown to the user
+func (app *ChatApp) deviceName(addr deviceAddress) string {
+	return fmt.Sprintf("%s (device %d)", app.displayName(addr.UserID), addr.DeviceID)
+}
+
+// peerDevice is a device we exchange messages with: a device of the recipient,
+// or another device of ours that is kept in sync with the conversation
+type peerDevice struct {
+	Address deviceAddress
+	Bundle  alice.BobPublicPrekeyBundle
+	// Sessions holds the sessions with the device, the active one first
+	Sessions []*session
+	// SeenHandshakes holds the ephemeral keys of recent handshakes of the device sessions were built from
+	SeenHandshakes  []key_ed25519.PublicKey
+	DecryptFailures int
+}
+
+// refreshDevices fetches the devices of the recipient and our other devices from the server,
+// adding the new ones to app.devices. It returns the devices that were added, and whether the server
+// returned a new identity key for the recipient. Devices of the recipient are only added if their identity
+// key is the one the account ID is derived from, and the pinned one.
+func (app *ChatApp) refreshDevices() (added []*peerDevice, identityChanged bool, err error) {
+	userIDPub, err := app.userPrivKeyBundle.IdentityKey.Public()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get public key: %w", err)
+	}
+
+	theirBundles, err := app.GetKeys(app.recipientID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get keys of %s: %w", app.recipientName, err)
+	}
+	ourBundles, err := app.GetKeys(app.userID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get keys of %s: %w", app.username, err)
+	}
+
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+
+	addDevices := func(userID string, identityKey *key_ed25519.PublicKey, bundles []common.DevicePrekeyBundle) {
+		for _, bundle := range bundles {
+			addr := deviceAddress{UserID: userID, DeviceID: bundle.DeviceID}
+			if addr == app.address() {
+				continue
+			}
+			if !bundle.Bundle.IdentityKey.Equals(identityKey) {
+				// All devices of a user share the identity key, anything else cannot be trusted
+				logger.Warnf("Ignoring %s, its identity key differs from the user's", addr)
+				continue
+			}
+			if dev, ok := app.devices[addr]; ok {
+				dev.Bundle = bundle.Bundle
+				continue
+			}
+			dev := &peerDevice{Address: addr, Bundle: bundle.Bundle}
+			app.devices[addr] = dev
+			added = append(added, dev)
+		}
+	}
+
+	// The account ID is derived from the identity key, a key that does not match it belongs to another account
+	theirBundles = slices.DeleteFunc(theirBundles, func(bundle common.DevicePrekeyBundle) bool {
+		if common.AccountID(bundle.Bundle.IdentityKey) != app.recipientID {
+			logger.Warnf("Ignoring device %d of %s, its identity key is not the one of the account", bundle.DeviceID, app.recipientName)
+			return true
+		}
+		return false
+	})
+
+	// The recipient's identity is the one of their primary device, or their first one if it is gone
+	if len(theirBundles) == 0 {
+		return nil, false, fmt.Errorf("%s has no device", app.recipientName)
+	}
+	identityChanged = app.pinIdentity(&theirBundles[0].Bundle.IdentityKey)
+	addDevices(app.recipientID, &app.recipientIdentity.IdentityKey, theirBundles)
+	if app.recipientID != app.userID {
+		addDevices(app.userID, userIDPub, ourBundles)
+	}
+	return added, identityChanged, nil
+}
+
+// address returns the address of this device
+func (app *ChatApp) address() deviceAddress {
+	return deviceAddress{UserID: app.userID, DeviceID: app.deviceID}
+}
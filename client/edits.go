@@ -0,0 +1,153 @@
+package client
+
+import (
+	"fmt"
+	"minimal-signal/common"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jroimartin/gocui"
+)
+
+// maxReactionLength is the maximum number of code points of a reaction, enough for emoji made of several,
+// like flags or skin tones
+const maxReactionLength = 8
+
+// validReaction reports whether reaction can be shown next to a message: a single emoji, or empty to
+// remove a reaction. Only its length and characters are checked.
+func validReaction(reaction string) bool {
+	if !utf8.ValidString(reaction) || utf8.RuneCountInString(reaction) > maxReactionLength {
+		return false
+	}
+	for _, r := range reaction {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// remainingExpireTimer returns the seconds left before expiresAt, sent with the changes of a disappearing
+// message so that the server does not keep them longer than the message. It is 0 if the message is kept.
+func remainingExpireTimer(expiresAt, now time.Time) uint32 {
+	if expiresAt.IsZero() {
+		return 0
+	}
+	return max(expireTimerSeconds(expiresAt.Sub(now)+time.Second-1), 1)
+}
+
+// targetMessage returns a copy of the message ref refers to, checking it can be changed by us
+func (app *ChatApp) targetMessage(ref string, ownOnly bool) (messageEntry, error) {
+	app.messageLock.Lock()
+	defer app.messageLock.Unlock()
+
+	entry, err := app.messages.lookup(ref)
+	if err != nil {
+		return messageEntry{}, fmt.Errorf("%s: %w", ref, err)
+	}
+	if entry.Deleted {
+		return messageEntry{}, fmt.Errorf("%s: %w", ref, ErrMessageDeleted)
+	}
+	if ownOnly && entry.Author != app.userID {
+		return messageEntry{}, fmt.Errorf("%s: %w", ref, ErrNotAuthor)
+	}
+	return *entry, nil
+}
+
+// sendUpdate sends a change of one of the messages to every device of both users, and applies it
+func (app *ChatApp) sendUpdate(target messageEntry, content *common.Content) error {
+	content.Target = target.ID
+	content.TargetAuthor = target.Author
+	content.ExpireTimer = remainingExpireTimer(target.ExpiresAt, time.Now())
+	if err := app.sendContent(content); err != nil {
+		return err
+	}
+	return app.applyUpdate(app.userID, content)
+}
+
+// editMessage replaces the text of one of our messages
+func (app *ChatApp) editMessage(ref, text string) error {
+	target, err := app.targetMessage(ref, true)
+	if err != nil {
+		return err
+	}
+	if err := app.sendUpdate(target, &common.Content{Type: common.ContentEdit, Body: text}); err != nil {
+		return fmt.Errorf("failed to send edit: %w", err)
+	}
+	return nil
+}
+
+// deleteMessage deletes one of our messages for everyone
+func (app *ChatApp) deleteMessage(ref string) error {
+	target, err := app.targetMessage(ref, true)
+	if err != nil {
+		return err
+	}
+	if err := app.sendUpdate(target, &common.Content{Type: common.ContentDelete}); err != nil {
+		return fmt.Errorf("failed to send delete: %w", err)
+	}
+	return nil
+}
+
+// reactToMessage reacts to a message with an emoji, or removes our reaction if reaction is empty
+func (app *ChatApp) reactToMessage(ref, reaction string) error {
+	if !validReaction(reaction) {
+		return ErrInvalidReaction
+	}
+	target, err := app.targetMessage(ref, false)
+	if err != nil {
+		return err
+	}
+	if err := app.sendUpdate(target, &common.Content{Type: common.ContentReaction, Reaction: reaction}); err != nil {
+		return fmt.Errorf("failed to send reaction: %w", err)
+	}
+	return nil
+}
+
+// applyUpdate applies an edit, delete or reaction sent by the user from to the message content.Target.
+// Only the author of a message can edit or delete it.
+func (app *ChatApp) applyUpdate(from string, content *common.Content) error {
+	app.messageLock.Lock()
+	entry := app.messages.find(content.TargetAuthor, content.Target)
+	var err error
+	switch {
+	case entry == nil:
+		err = ErrUnknownMessage
+	case entry.Deleted:
+		err = ErrMessageDeleted
+	case content.Type != common.ContentReaction && entry.Author != from:
+		err = ErrNotAuthor
+	case content.Type == common.ContentReaction && !validReaction(content.Reaction):
+		err = ErrInvalidReaction
+	}
+	if err != nil {
+		app.messageLock.Unlock()
+		return err
+	}
+
+	switch content.Type {
+	case common.ContentEdit:
+		entry.Text = content.Body
+		entry.Edited = true
+	case common.ContentDelete:
+		entry.Text = ""
+		entry.Reactions = nil
+		entry.Deleted = true
+	case common.ContentReaction:
+		if content.Reaction == "" {
+			delete(entry.Reactions, from)
+		} else {
+			if entry.Reactions == nil {
+				entry.Reactions = make(map[string]string)
+			}
+			entry.Reactions[from] = content.Reaction
+		}
+	}
+	app.messageLock.Unlock()
+
+	app.updateGui(func(g *gocui.Gui) error {
+		return app.UpdateMessages(g)
+	})
+	return nil
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	"minimal-signal/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deliverOutbox decrypts the messages from queued for to as to, and empties the outbox of from
+func deliverOutbox(t *testing.T, from, to *ChatApp) {
+	for _, msgJSON := range from.outbox {
+		var msg common.MessageBundle
+		require.NoError(t, json.Unmarshal(msgJSON, &msg))
+		if msg.To == to.userID && msg.ToDevice == to.deviceID {
+			to.receiveMessage(&msg)
+		}
+	}
+	from.outbox = nil
+}
+
+func TestLookupMessage(t *testing.T) {
+	history := chatHistory{
+		{Text: "[!] notice"},
+		{ID: "abc1" + newMessageID()[4:]},
+		{ID: "abc2" + newMessageID()[4:]},
+	}
+	_, err := history.lookup("#abc")
+	assert.ErrorIs(t, err, ErrAmbiguousMessage)
+	entry, err := history.lookup("#abc2")
+	require.NoError(t, err)
+	assert.Equal(t, history[2].ID, entry.ID)
+	_, err = history.lookup("#def")
+	assert.ErrorIs(t, err, ErrUnknownMessage)
+	_, err = history.lookup("")
+	assert.ErrorIs(t, err, ErrUnknownMessage)
+}
+
+func TestEditDeleteAndReact(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	alice.recipientName, bob.recipientName = "bob", "alice"
+
+	id, err := alice.sendMessage("helo")
+	require.NoError(t, err)
+	alice.appendEntry(messageEntry{ID: id, Author: alice.userID, Text: "helo"}, 0)
+	deliverOutbox(t, alice, bob)
+	require.NotNil(t, bob.messages.find(alice.userID, id))
+	assert.Equal(t, alice.userID, bob.messages.find(alice.userID, id).Author)
+	ref := messageRef(id)
+
+	// Only the author edits and deletes a message, a forged change from another user is ignored
+	assert.ErrorIs(t, bob.editMessage(ref, "hacked"), ErrNotAuthor)
+	forged := &common.Content{Type: common.ContentDelete, Target: id, TargetAuthor: alice.userID}
+	assert.ErrorIs(t, alice.applyUpdate(bob.userID, forged), ErrNotAuthor)
+
+	require.NoError(t, alice.editMessage(ref, "hello world"))
+	deliverOutbox(t, alice, bob)
+	assert.Equal(t, "hello world", bob.messages.find(alice.userID, id).Text)
+	assert.True(t, bob.messages.find(alice.userID, id).Edited)
+
+	require.NoError(t, bob.reactToMessage(ref, "👍"))
+	deliverOutbox(t, bob, alice)
+	assert.Equal(t, ref+" [You] hello world (edited) [👍 bob]", alice.formatEntry(alice.messages.find(alice.userID, id)))
+	assert.Equal(t, ref+" [alice] hello world (edited) [👍 You]", bob.formatEntry(bob.messages.find(alice.userID, id)))
+	assert.ErrorIs(t, bob.reactToMessage(ref, "not an emoji"), ErrInvalidReaction)
+
+	require.NoError(t, bob.reactToMessage(ref, ""))
+	deliverOutbox(t, bob, alice)
+	assert.Empty(t, alice.messages.find(alice.userID, id).Reactions)
+
+	// Deleted messages keep a marker, without their text
+	require.NoError(t, alice.deleteMessage(ref))
+	deliverOutbox(t, alice, bob)
+	assert.True(t, bob.messages.find(alice.userID, id).Deleted)
+	assert.Empty(t, bob.messages.find(alice.userID, id).Text)
+	assert.Equal(t, ref+" [alice] (message deleted)", bob.formatEntry(bob.messages.find(alice.userID, id)))
+	assert.ErrorIs(t, bob.reactToMessage(ref, "👍"), ErrMessageDeleted)
+}
+
+func TestMessageIDCollision(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	alice.recipientName, bob.recipientName = "bob", "alice"
+
+	id, err := alice.sendMessage("mine")
+	require.NoError(t, err)
+	alice.appendEntry(messageEntry{ID: id, Author: alice.userID, Text: "mine"}, 0)
+	deliverOutbox(t, alice, bob)
+
+	// Bob cannot take over the ID of alice's message, nor change it through his own
+	require.NoError(t, bob.sendContent(&common.Content{Type: common.ContentText, ID: id, Body: "impostor"}))
+	deliverOutbox(t, bob, alice)
+	require.Len(t, alice.messages, 1)
+	assert.Equal(t, "mine", alice.messages[0].Text)
+	assert.Nil(t, alice.messages.find(bob.userID, id))
+
+	assert.ErrorIs(t, alice.applyUpdate(bob.userID, &common.Content{Type: common.ContentEdit, Target: id, TargetAuthor: bob.userID, Body: "hacked"}), ErrUnknownMessage)
+	assert.Equal(t, "mine", alice.messages.find(alice.userID, id).Text)
+	_, err = alice.messages.lookup(messageRef(id))
+	assert.NoError(t, err, "the reference stays unambiguous")
+}
@@ -0,0 +1,17 @@
+package client
+
+import "errors"
+
+var (
+	ErrNoSession            = errors.New("no session with peer and no handshake to start one")
+	ErrIdentityChanged      = errors.New("identity key of recipient changed, verify the new safety number with /verify")
+	ErrCertificateNotPinned = errors.New("server certificate key is not pinned")
+	ErrUnknownUser          = errors.New("user is not registered")
+	ErrUsernameTaken        = errors.New("username is taken by another account")
+	ErrUnknownMessage       = errors.New("no such message")
+	ErrAmbiguousMessage     = errors.New("several messages match, type more of the reference")
+	ErrNotAuthor            = errors.New("only the author of a message can change it")
+	ErrMessageDeleted       = errors.New("message was deleted")
+	ErrInvalidReaction      = errors.New("a reaction is a single emoji")
+	ErrOutboxFull           = errors.New("too many messages waiting to be sent, wait until the client is connected")
+)
@@ -0,0 +1,254 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/gocui"
+)
+
+// messageIDLength is the number of random bytes of a message ID
+const messageIDLength = 16
+
+// messageRefLength is the number of hex digits of a message ID shown to refer to it in commands
+const messageRefLength = 6
+
+// messageEntry is an entry of the chat history: a message, or a line shown as is
+type messageEntry struct {
+	// ID identifies a message, it is empty for notices and for messages stored or received without one.
+	// Those are shown as Text and cannot be edited, deleted or reacted to.
+	ID string
+	// Author is the account ID of the sender of the message
+	Author string
+	Text   string
+	// ExpiresAt is when a disappearing message is deleted, zero if it is kept
+	ExpiresAt time.Time
+	Edited    bool
+	// Deleted messages are kept without their text, to show they were deleted
+	Deleted bool
+	// Reactions holds the emoji each user reacted with, by account ID
+	Reactions map[string]string
+}
+
+// expired reports whether the entry must be deleted at now
+func (e *messageEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// chatHistory is the chat history of a conversation, oldest entry first
+type chatHistory []messageEntry
+
+// find returns the message of author with the given ID, nil if there is none
+func (h chatHistory) find(author, id string) *messageEntry {
+	if id == "" {
+		return nil
+	}
+	for i := range h {
+		if h[i].ID == id && h[i].Author == author {
+			return &h[i]
+		}
+	}
+	return nil
+}
+
+// has reports whether a message of any author has the given ID
+func (h chatHistory) has(id string) bool {
+	for i := range h {
+		if h[i].ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the message a reference typed by the user refers to: the beginning of its ID, as shown by
+// messageRef
+func (h chatHistory) lookup(ref string) (*messageEntry, error) {
+	ref = strings.ToLower(strings.TrimPrefix(ref, "#"))
+	if ref == "" {
+		return nil, ErrUnknownMessage
+	}
+	var found *messageEntry
+	for i := range h {
+		if h[i].ID == "" || !strings.HasPrefix(h[i].ID, ref) {
+			continue
+		}
+		if found != nil {
+			return nil, ErrAmbiguousMessage
+		}
+		found = &h[i]
+	}
+	if found == nil {
+		return nil, ErrUnknownMessage
+	}
+	return found, nil
+}
+
+// dropExpired returns the entries that did not expire at now
+func (h chatHistory) dropExpired(now time.Time) chatHistory {
+	kept := make(chatHistory, 0, len(h))
+	for _, entry := range h {
+		if !entry.expired(now) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// newMessageID returns a random message ID
+func newMessageID() string {
+	id := make([]byte, messageIDLength)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("failed to generate message ID: %v", err))
+	}
+	return hex.EncodeToString(id)
+}
+
+// isMessageID reports whether id is a message ID as generated by newMessageID
+func isMessageID(id string) bool {
+	decoded, err := hex.DecodeString(id)
+	return err == nil && len(decoded) == messageIDLength && id == strings.ToLower(id)
+}
+
+// messageRef returns the reference shown for a message, typed by the user to refer to it
+func messageRef(id string) string {
+	return "#" + id[:messageRefLength]
+}
+
+// formatEntry returns the entry as shown in the message view
+func (app *ChatApp) formatEntry(e *messageEntry) string {
+	if e.ID == "" {
+		return e.Text
+	}
+	if e.Deleted {
+		return fmt.Sprintf("%s [%s] (message deleted)", messageRef(e.ID), app.senderName(e.Author))
+	}
+
+	line := fmt.Sprintf("%s [%s] %s", messageRef(e.ID), app.senderName(e.Author), e.Text)
+	if e.Edited {
+		line += " (edited)"
+	}
+	if len(e.Reactions) > 0 {
+		reactions := make([]string, 0, len(e.Reactions))
+		for userID, reaction := range e.Reactions {
+			reactions = append(reactions, reaction+" "+app.senderName(userID))
+		}
+		sort.Strings(reactions)
+		line += " [" + strings.Join(reactions, ", ") + "]"
+	}
+	return line
+}
+
+// senderName returns how the author of a message is shown, "You" for the messages sent by our devices
+func (app *ChatApp) senderName(userID string) string {
+	if userID == app.userID {
+		return "You"
+	}
+	return app.displayName(userID)
+}
+
+// expireTimerSeconds converts a disappearing message timer to the seconds sent in Content.ExpireTimer
+func expireTimerSeconds(timer time.Duration) uint32 {
+	return uint32(timer / time.Second)
+}
+
+// formatExpireTimer returns a disappearing message timer as shown to the user
+func formatExpireTimer(timer time.Duration) string {
+	if timer == 0 {
+		return "off"
+	}
+	return timer.String()
+}
+
+// currentExpireTimer returns the disappearing message timer of the conversation, 0 if messages do not expire
+func (app *ChatApp) currentExpireTimer() time.Duration {
+	app.messageLock.Lock()
+	defer app.messageLock.Unlock()
+	return app.expireTimer
+}
+
+// applyExpireTimer sets the disappearing message timer of the conversation and reports whether it changed
+func (app *ChatApp) applyExpireTimer(timer time.Duration) bool {
+	app.messageLock.Lock()
+	defer app.messageLock.Unlock()
+	if app.expireTimer == timer {
+		return false
+	}
+	app.expireTimer = timer
+	return true
+}
+
+// setExpireTimer sets the disappearing message timer of the conversation for every device of both users
+func (app *ChatApp) setExpireTimer(timer time.Duration) error {
+	if timer != 0 && timer < time.Second {
+		return fmt.Errorf("disappearing message timer must be at least 1s")
+	}
+	if err := app.sendContent(&common.Content{Type: common.ContentExpireTimerUpdate, ExpireTimer: expireTimerSeconds(timer)}); err != nil {
+		return fmt.Errorf("failed to send disappearing message timer: %w", err)
+	}
+	app.applyExpireTimer(timer)
+	app.appendNotice("You set disappearing messages to %s", formatExpireTimer(timer))
+	return nil
+}
+
+// messageExists reports whether the chat history has a message with the given ID
+func (app *ChatApp) messageExists(id string) bool {
+	app.messageLock.Lock()
+	defer app.messageLock.Unlock()
+	return app.messages.has(id)
+}
+
+// appendEntry adds an entry to the chat history that is deleted once timer elapsed, or kept if timer is 0
+func (app *ChatApp) appendEntry(entry messageEntry, timer time.Duration) {
+	if timer > 0 {
+		entry.ExpiresAt = time.Now().Add(timer)
+	}
+
+	app.messageLock.Lock()
+	app.messages = append(app.messages, entry)
+	app.messageLock.Unlock()
+
+	app.updateGui(func(g *gocui.Gui) error {
+		return app.UpdateMessages(g)
+	})
+}
+
+// expireMessages removes the disappearing messages that expired at now and reports whether there were any
+func (app *ChatApp) expireMessages(now time.Time) bool {
+	app.messageLock.Lock()
+	defer app.messageLock.Unlock()
+
+	kept := app.messages.dropExpired(now)
+	removed := len(kept) != len(app.messages)
+	app.messages = kept
+	return removed
+}
+
+// runExpiry deletes disappearing messages once they expire, from the view and from storage, until the app quits
+func (app *ChatApp) runExpiry() {
+	ticker := time.NewTicker(configs.ExpireCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.closing:
+			return
+		case now := <-ticker.C:
+			if !app.expireMessages(now) {
+				continue
+			}
+			app.updateGui(func(g *gocui.Gui) error {
+				return app.UpdateMessages(g)
+			})
+			if err := app.saveHistory(); err != nil {
+				logger.Errorf("Error saving history: %v", err)
+			}
+		}
+	}
+}
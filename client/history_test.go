@@ -0,0 +1,47 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"minimal-signal/common"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpireMessages(t *testing.T) {
+	alice := newTestDevice(t, "alice", common.PrimaryDeviceID, nil)
+	now := time.Now()
+	alice.messages = chatHistory{
+		{Text: "kept"},
+		{Text: "expired", ExpiresAt: now.Add(-time.Second)},
+		{Text: "expiring", ExpiresAt: now.Add(time.Minute)},
+	}
+
+	assert.True(t, alice.expireMessages(now))
+	require.Len(t, alice.messages, 2)
+	assert.Equal(t, "kept", alice.messages[0].Text)
+	assert.Equal(t, "expiring", alice.messages[1].Text)
+	assert.False(t, alice.expireMessages(now))
+
+	assert.True(t, alice.expireMessages(now.Add(time.Minute)))
+	require.Len(t, alice.messages, 1)
+	assert.Equal(t, "kept", alice.messages[0].Text)
+}
+
+func TestExpireTimerSentWithMessage(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	alice.applyExpireTimer(30 * time.Second)
+
+	content := textContent("hello")
+	content.ExpireTimer = expireTimerSeconds(alice.currentExpireTimer())
+	msg, err := alice.encryptMessage(alice.devices[bob.address()], content)
+	require.NoError(t, err)
+
+	// The server sees the timer to drop the message if it is not delivered in time
+	assert.Equal(t, uint32(30), msg.ExpireTimer)
+	received, _, err := bob.decryptMessage(bob.devices[alice.address()], msg)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(30), received.ExpireTimer)
+}
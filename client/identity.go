@@ -0,0 +1,172 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"minimal-signal/crypto/key_ed25519"
+	"minimal-signal/protocol/fingerprint"
+
+	"github.com/jroimartin/gocui"
+)
+
+// contactIdentity is the identity key pinned for the recipient on first contact.
+// The server cannot replace it: a different key is only used once the user verified it.
+type contactIdentity struct {
+	IdentityKey key_ed25519.PublicKey
+	// Verified is set once the user compared the safety numbers
+	Verified bool
+	// ChangedKey is a different identity key the server returned for the recipient, waiting for the user to verify it
+	ChangedKey *key_ed25519.PublicKey
+}
+
+// pinIdentity checks the identity key the server returned for the recipient against the pinned one,
+// pinning it on first contact. It reports whether the key differs from the pinned one and was not seen before.
+// Must hold sessionLock.
+func (app *ChatApp) pinIdentity(identityKey *key_ed25519.PublicKey) (changed bool) {
+	id := app.recipientIdentity
+	switch {
+	case id == nil:
+		app.recipientIdentity = &contactIdentity{IdentityKey: *identityKey}
+		return false
+	case id.IdentityKey.Equals(identityKey):
+		// The server went back to the pinned key
+		id.ChangedKey = nil
+		return false
+	case id.ChangedKey != nil && id.ChangedKey.Equals(identityKey):
+		return false
+	default:
+		changedKey := *identityKey
+		id.ChangedKey = &changedKey
+		return true
+	}
+}
+
+// identityChanged reports whether the recipient's identity key changed and the user did not verify it yet
+func (app *ChatApp) identityChanged() bool {
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+	return app.recipientIdentity != nil && app.recipientIdentity.ChangedKey != nil
+}
+
+// displayedIdentity returns the identity key of the recipient the user should verify, and a short status
+func (app *ChatApp) displayedIdentity() (key_ed25519.PublicKey, string) {
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+
+	id := app.recipientIdentity
+	switch {
+	case id == nil:
+		return key_ed25519.PublicKey{}, "unknown"
+	case id.ChangedKey != nil:
+		return *id.ChangedKey, "SAFETY NUMBER CHANGED, verify it with /verify"
+	case id.Verified:
+		return id.IdentityKey, "verified"
+	default:
+		return id.IdentityKey, "not verified, mark it verified with /verify"
+	}
+}
+
+// acceptIdentity marks identityKey, the one displayed to the user, as verified. If it is a changed key,
+// it is pinned and the sessions built with the old one are discarded.
+// Must hold sessionLock.
+func (app *ChatApp) acceptIdentity(identityKey *key_ed25519.PublicKey) error {
+	id := app.recipientIdentity
+	if id == nil {
+		return fmt.Errorf("no identity key known for %s", app.recipientName)
+	}
+	displayed := &id.IdentityKey
+	if id.ChangedKey != nil {
+		displayed = id.ChangedKey
+	}
+	if !displayed.Equals(identityKey) {
+		// The key changed again while the user was comparing safety numbers
+		return fmt.Errorf("the safety number of %s changed again, compare it again", app.recipientName)
+	}
+
+	if id.ChangedKey != nil {
+		id.IdentityKey = *id.ChangedKey
+		id.ChangedKey = nil
+		for addr, dev := range app.devices {
+			if addr.UserID == app.recipientID {
+				dev.clearSession()
+				dev.SeenHandshakes = nil
+			}
+		}
+	}
+	id.Verified = true
+	return nil
+}
+
+// verifyIdentity runs when the user compared the safety numbers: the displayed identity key becomes the trusted one.
+// If payload is not empty, it is the scannable fingerprint of the recipient, which must match ours.
+func (app *ChatApp) verifyIdentity(payload string) error {
+	identityKey, _ := app.displayedIdentity()
+	if payload != "" {
+		if err := app.compareScannable(identityKey, payload); err != nil {
+			return err
+		}
+	}
+
+	app.sessionLock.Lock()
+	err := app.acceptIdentity(&identityKey)
+	app.sessionLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The devices using the new key were ignored until now
+	if _, _, err := app.refreshDevices(); err != nil {
+		return fmt.Errorf("failed to refresh devices of %s: %w", app.recipientName, err)
+	}
+	if err := app.saveIdentity(); err != nil {
+		return fmt.Errorf("failed to save identity of %s: %w", app.recipientName, err)
+	}
+
+	app.appendNotice("You marked the safety number of %s as verified", app.recipientName)
+	app.updateGui(app.updateFingerprint)
+	return nil
+}
+
+// compareScannable checks the scannable fingerprint shown by the recipient against ours for their identityKey
+func (app *ChatApp) compareScannable(identityKey key_ed25519.PublicKey, payload string) error {
+	theirs, err := fingerprint.ParseScannable(payload)
+	if err != nil {
+		return fmt.Errorf("failed to read safety number of %s: %w", app.recipientName, err)
+	}
+	ours, err := app.scannableFingerprint(theirs.Version, identityKey)
+	if err != nil {
+		return err
+	}
+	if err := ours.Compare(theirs); err != nil {
+		return fmt.Errorf("safety number of %s NOT verified: %w", app.recipientName, err)
+	}
+	return nil
+}
+
+// warnIdentityChanged tells the user that the server returned a different identity key for the recipient
+func (app *ChatApp) warnIdentityChanged() {
+	app.appendNotice("WARNING: the safety number of %s changed. They may have reinstalled, or someone may be intercepting the conversation.", app.recipientName)
+	app.appendNotice("Messages cannot be sent until you compare the new safety number with %s and run /verify", app.recipientName)
+	app.updateGui(app.updateFingerprint)
+}
+
+// updateFingerprint shows the safety number of the recipient and its verification status
+func (app *ChatApp) updateFingerprint(g *gocui.Gui) error {
+	v, err := g.View("fingerprint")
+	if errors.Is(err, gocui.ErrUnknownView) {
+		// Shown once the layout creates the view
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	identityKey, status := app.displayedIdentity()
+	safetyNumber, err := app.fingerprint(identityKey)
+	if err != nil {
+		return err
+	}
+	v.Clear()
+	v.Title = fmt.Sprintf("Safety number with %s (%s)", app.recipientName, status)
+	fmt.Fprintln(v, safetyNumber)
+	return nil
+}
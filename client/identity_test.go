@@ -0,0 +1,122 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/crypto/key_ed25519"
+	"minimal-signal/protocol/fingerprint"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestIdentityKey(t *testing.T) *key_ed25519.PublicKey {
+	priv, err := key_ed25519.New()
+	require.NoError(t, err)
+	pub, err := priv.Public()
+	require.NoError(t, err)
+	return pub
+}
+
+func TestIdentityPinnedOnFirstContact(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	bobKey := alice.devices[bob.address()].Bundle.IdentityKey
+
+	assert.False(t, alice.pinIdentity(&bobKey))
+	assert.False(t, alice.pinIdentity(&bobKey))
+	assert.Equal(t, bobKey, alice.recipientIdentity.IdentityKey)
+	assert.False(t, alice.recipientIdentity.Verified)
+	assert.False(t, alice.identityChanged())
+}
+
+func TestIdentityChangeRequiresVerification(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	bobKey := alice.devices[bob.address()].Bundle.IdentityKey
+	alice.pinIdentity(&bobKey)
+	exchange(t, alice, bob, "hello")
+
+	// The server returns another key: it is reported once and nothing can be sent until the user verifies it
+	newKey := newTestIdentityKey(t)
+	assert.True(t, alice.pinIdentity(newKey))
+	assert.False(t, alice.pinIdentity(newKey))
+	assert.True(t, alice.identityChanged())
+	assert.Equal(t, bobKey, alice.recipientIdentity.IdentityKey)
+	_, err := alice.sendMessage("hello again")
+	assert.ErrorIs(t, err, ErrIdentityChanged)
+
+	shown, _ := alice.displayedIdentity()
+	assert.Equal(t, *newKey, shown)
+	assert.Error(t, alice.acceptIdentity(&bobKey))
+
+	// Verifying pins the new key and drops the sessions built with the old one
+	require.NoError(t, alice.acceptIdentity(newKey))
+	assert.False(t, alice.identityChanged())
+	assert.Equal(t, *newKey, alice.recipientIdentity.IdentityKey)
+	assert.True(t, alice.recipientIdentity.Verified)
+	assert.Nil(t, alice.devices[bob.address()].activeSession())
+}
+
+func TestIdentityChangeReverted(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	bobKey := alice.devices[bob.address()].Bundle.IdentityKey
+	alice.pinIdentity(&bobKey)
+
+	assert.True(t, alice.pinIdentity(newTestIdentityKey(t)))
+	assert.False(t, alice.pinIdentity(&bobKey))
+	assert.False(t, alice.identityChanged())
+}
+
+func TestVerifyScannedFingerprint(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	aliceKey := bob.devices[alice.address()].Bundle.IdentityKey
+	bobKey := alice.devices[bob.address()].Bundle.IdentityKey
+
+	bobScannable, err := bob.scannableFingerprint(fingerprint.CurrentVersion, aliceKey)
+	require.NoError(t, err)
+	assert.NoError(t, alice.compareScannable(bobKey, bobScannable.Payload()))
+
+	// Bob's code does not match if the server gave Alice another key for Bob
+	assert.ErrorIs(t, alice.compareScannable(*newTestIdentityKey(t), bobScannable.Payload()), fingerprint.ErrFingerprintMismatch)
+}
+
+// newTestKeyServer starts a server answering key fetches with the given bundles per account ID, and points app at it
+func newTestKeyServer(t *testing.T, app *ChatApp, bundles map[string][]common.DevicePrekeyBundle) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(bundles[strings.TrimPrefix(r.URL.Path, configs.PublishKeysPath+"/")])
+	}))
+	t.Cleanup(server.Close)
+	app.config.ServerAddress = server.Listener.Addr().String()
+	app.config.DisableTLS = true
+	app.transport = newTestTransport(t, app.config)
+}
+
+func TestIdentityKeyOfAnotherAccountIgnored(t *testing.T) {
+	alice := newTestDevice(t, "alice", common.PrimaryDeviceID, nil)
+	bob := newTestDevice(t, "bob", common.PrimaryDeviceID, nil)
+	mallory := newTestDevice(t, "mallory", common.PrimaryDeviceID, nil)
+	bundle := func(app *ChatApp, deviceID common.DeviceID) common.DevicePrekeyBundle {
+		public, err := app.userPrivKeyBundle.ToPublicBundle()
+		require.NoError(t, err)
+		return common.DevicePrekeyBundle{DeviceID: deviceID, Bundle: public}
+	}
+	alice.recipientID = bob.userID
+
+	// The server answers for Bob with Mallory's key first: it is neither pinned nor used
+	newTestKeyServer(t, alice, map[string][]common.DevicePrekeyBundle{bob.userID: {bundle(mallory, 1), bundle(bob, 2)}})
+	added, changed, err := alice.refreshDevices()
+	require.NoError(t, err)
+	assert.False(t, changed)
+	require.Len(t, added, 1)
+	assert.Equal(t, deviceAddress{UserID: bob.userID, DeviceID: 2}, added[0].Address)
+	assert.Equal(t, added[0].Bundle.IdentityKey, alice.recipientIdentity.IdentityKey)
+
+	newTestKeyServer(t, alice, map[string][]common.DevicePrekeyBundle{bob.userID: {bundle(mallory, 1)}})
+	_, _, err = alice.refreshDevices()
+	assert.Error(t, err)
+}
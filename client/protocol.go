@@ -2,6 +2,7 @@ package client
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"minimal-signal/common"
@@ -13,29 +14,32 @@ import (
 	"minimal-signal/protocol/x3dh/bob"
 )
 
-// signalAliceHandshake performs the key agreement protocol and init ratchet.
-// Must already have recipientID set.
-// Postcondition: ratchets are established
-func (app *ChatApp) signalAliceHandshake() error {
-	sharedKey, pubEphKey, err := alice.PerformKeyAgreement(&app.otherIDKeyBundle, app.userPrivKeyBundle.IdentityKey)
+// signalAliceHandshake performs the key agreement protocol with dev and init ratchet.
+// Postcondition: a new session started by us is returned, not yet acknowledged by the peer
+func (app *ChatApp) signalAliceHandshake(dev *peerDevice) (*session, error) {
+	sharedKey, pubEphKey, err := alice.PerformKeyAgreement(&dev.Bundle, app.userPrivKeyBundle.IdentityKey)
 	if err != nil {
-		return fmt.Errorf("failed to perform key agreement: %w", err)
+		return nil, fmt.Errorf("failed to perform key agreement: %w", err)
 	}
 	var ratchetKey [32]byte
 	copy(ratchetKey[:], sharedKey)
-	app.ratchet, err = doubleratchet.InitAlice(ratchetKey, app.otherIDKeyBundle.Prekey)
+	ratchet, err := doubleratchet.InitAlice(ratchetKey, dev.Bundle.Prekey)
 	if err != nil {
-		return fmt.Errorf("failed to init ratchet: %w", err)
+		return nil, fmt.Errorf("failed to init ratchet: %w", err)
 	}
 
-	app.initHandshake = &common.X3DHHandshakeBundle{
-		EphPubKey:     *pubEphKey,
-		OneTimePubKey: app.otherIDKeyBundle.OneTimePrekey,
-	}
-	return nil
+	return &session{
+		Ratchet: ratchet,
+		InitHandshake: &common.X3DHHandshakeBundle{
+			EphPubKey:     *pubEphKey,
+			OneTimePubKey: dev.Bundle.OneTimePrekey,
+		},
+	}, nil
 }
 
-func (app *ChatApp) signalBobHandshake(aliceDHKeys *common.X3DHHandshakeBundle, aliceIDKey *key_ed25519.PublicKey) error {
+// signalBobHandshake performs the receiver side of the key agreement and returns the resulting session.
+// The caller decides whether the new session replaces the active one.
+func (app *ChatApp) signalBobHandshake(aliceDHKeys *common.X3DHHandshakeBundle, aliceIDKey *key_ed25519.PublicKey) (*session, error) {
 	// X3DH
 	// Assume we don't use one-time key
 	sharedKey, err := bob.PerformKeyAgreement(&app.userPrivKeyBundle, &bob.ReceivedAliceKeyBundle{
@@ -43,34 +47,46 @@ func (app *ChatApp) signalBobHandshake(aliceDHKeys *common.X3DHHandshakeBundle,
 		EphemeralKey: aliceDHKeys.EphPubKey,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to perform key agreement: %w", err)
+		return nil, fmt.Errorf("failed to perform key agreement: %w", err)
 	}
 	var ratchetKey [32]byte
 	copy(ratchetKey[:], sharedKey)
 
 	bobPrekeyPub, err := app.userPrivKeyBundle.Prekey.Public()
 	if err != nil {
-		return fmt.Errorf("failed to get prekey public key: %w", err)
-	}
-	app.ratchet = doubleratchet.InitBob(ratchetKey, key_ed25519.Pair{
-		Pub:  *bobPrekeyPub,
-		Priv: app.userPrivKeyBundle.Prekey,
-	})
-	return nil
+		return nil, fmt.Errorf("failed to get prekey public key: %w", err)
+	}
+	return &session{
+		Ratchet: doubleratchet.InitBob(ratchetKey, key_ed25519.Pair{
+			Pub:  *bobPrekeyPub,
+			Priv: app.userPrivKeyBundle.Prekey,
+		}),
+		PeerHandshake: aliceDHKeys,
+	}, nil
 }
 
-func (app *ChatApp) encryptMessage(msg string) (*common.MessageBundle, error) {
+// encryptMessage encrypts content for dev with its active session, starting a new session first if there is none.
+// Must hold sessionLock.
+func (app *ChatApp) encryptMessage(dev *peerDevice, content *common.Content) (*common.MessageBundle, error) {
 	// handshake
 	firstTime := false
-	if app.ratchet == nil {
+	sess := dev.activeSession()
+	if sess == nil {
 		firstTime = true
-		if err := app.signalAliceHandshake(); err != nil {
+		var err error
+		if sess, err = app.signalAliceHandshake(dev); err != nil {
 			return nil, fmt.Errorf("failed to perform handshake: %w", err)
 		}
+		dev.setActive(sess)
+	}
+
+	plaintext, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal content: %w", err)
 	}
 
 	// Encrypt message
-	ad, err := app.getADBytes()
+	ad, err := app.getADBytes(dev)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get AD bytes: %w", err)
 	}
@@ -82,65 +98,105 @@ func (app *ChatApp) encryptMessage(msg string) (*common.MessageBundle, error) {
 	} else {
 		forwardDH = r.Int64() == 0
 	}
-	header, encryptedMessage, err := app.ratchet.Encrypt([]byte(msg), ad[:], forwardDH && (!firstTime))
+	header, encryptedMessage, err := sess.Ratchet.Encrypt(plaintext, ad[:], forwardDH && (!firstTime))
 	if err != nil {
 		return nil, fmt.Errorf("error encrypting message: %w", err)
 	}
 
 	return &common.MessageBundle{
-		From:      app.userID,
-		To:        app.recipientID,
-		Message:   encryptedMessage,
-		Header:    *header,
-		AD:        ad,
-		Handshake: app.initHandshake,
+		From:       app.userID,
+		FromDevice: app.deviceID,
+		To:         dev.Address.UserID,
+		ToDevice:   dev.Address.DeviceID,
+		Message:    encryptedMessage,
+		Header:     *header,
+		AD:         ad,
+		// Only set until the peer replies on the session
+		Handshake:   sess.InitHandshake,
+		ExpireTimer: content.ExpireTimer,
 	}, nil
 }
 
-func (app *ChatApp) decryptMessage(msg *common.MessageBundle) ([]byte, error) {
-	if app.ratchet == nil {
-		if err := app.signalBobHandshake(msg.Handshake, &app.otherIDKeyBundle.IdentityKey); err != nil {
-			return nil, fmt.Errorf("error performing handshake: %w", err)
+// decryptMessage tries every known session with dev, active first. If none of them can decrypt msg and
+// it carries a handshake no session was built from yet, the peer has started a new session which is built
+// and then ranked against ours by acceptSession; replaced reports whether it replaced an established session.
+// Must hold sessionLock.
+func (app *ChatApp) decryptMessage(dev *peerDevice, msg *common.MessageBundle) (content *common.Content, replaced bool, err error) {
+	var (
+		plaintext []byte
+		decrypted bool
+	)
+	for _, sess := range dev.Sessions {
+		if plaintext, err = sess.Ratchet.Decrypt(msg.Header, msg.Message, msg.AD[:]); err == nil {
+			decrypted = true
+			replaced = app.acceptSession(dev, sess, false)
+			break
 		}
 	}
-	// Decrypt message
-	plaintext, err := app.ratchet.Decrypt(msg.Header, msg.Message, msg.AD[:])
+
+	if !decrypted {
+		if msg.Handshake == nil || dev.isStaleHandshake(msg.Handshake) {
+			if len(dev.Sessions) == 0 {
+				return nil, false, ErrNoSession
+			}
+			return nil, false, fmt.Errorf("error decrypting message: %w", err)
+		}
+
+		sess, err := app.signalBobHandshake(msg.Handshake, &dev.Bundle.IdentityKey)
+		if err != nil {
+			return nil, false, fmt.Errorf("error performing handshake: %w", err)
+		}
+		if plaintext, err = sess.Ratchet.Decrypt(msg.Header, msg.Message, msg.AD[:]); err != nil {
+			return nil, false, fmt.Errorf("error decrypting message: %w", err)
+		}
+		dev.markHandshakeSeen(msg.Handshake)
+		replaced = app.acceptSession(dev, sess, true)
+	}
+
+	return parseContent(plaintext), replaced, nil
+}
+
+// parseContent returns the content of a decrypted message. Baseline clients, and the sessions migrated from them,
+// send the text itself instead of a JSON Content, it is taken as a text message.
+func parseContent(plaintext []byte) *common.Content {
+	content := &common.Content{}
+	if len(plaintext) == 0 || plaintext[0] != '{' || json.Unmarshal(plaintext, content) != nil {
+		return &common.Content{Type: common.ContentText, Body: string(plaintext)}
+	}
+	return content
+}
+
+// scannableFingerprint returns the safety number of the conversation in the form shown as a QR code,
+// combining our identity key and the given one of the recipient
+func (app *ChatApp) scannableFingerprint(version fingerprint.Version, recipientIdentityKey key_ed25519.PublicKey) (*fingerprint.Scannable, error) {
+	userIDPub, err := app.userPrivKeyBundle.IdentityKey.Public()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key: %w", err)
+	}
+	g, err := fingerprint.NewGenerator(version)
 	if err != nil {
-		return nil, fmt.Errorf("error decrypting message: %vw", err)
+		return nil, fmt.Errorf("failed to get fingerprint generator: %w", err)
 	}
-	return plaintext, nil
+	scannable, err := g.Scannable(*userIDPub, []byte(app.userID), recipientIdentityKey, []byte(app.recipientID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scannable fingerprint: %w", err)
+	}
+	return scannable, nil
 }
 
-func (app *ChatApp) fingerprint() (string, error) {
+// fingerprint returns the safety number of the conversation, combining our identity key and the given one of the recipient
+func (app *ChatApp) fingerprint(recipientIdentityKey key_ed25519.PublicKey) (string, error) {
 	userIDPub, err := app.userPrivKeyBundle.IdentityKey.Public()
 	if err != nil {
 		return "", fmt.Errorf("failed to get public key: %w", err)
 	}
-	fingerprint1, err := fingerprint.Fingerprint(*userIDPub, []byte(app.userID))
+	g, err := fingerprint.NewGenerator(fingerprint.CurrentVersion)
 	if err != nil {
-		return "", fmt.Errorf("failed to get fingerprint: %w", err)
+		return "", fmt.Errorf("failed to get fingerprint generator: %w", err)
 	}
-	fingerprint2, err := fingerprint.Fingerprint(app.otherIDKeyBundle.IdentityKey, []byte(app.recipientID))
+	combined, err := g.Combined(*userIDPub, []byte(app.userID), recipientIdentityKey, []byte(app.recipientID))
 	if err != nil {
 		return "", fmt.Errorf("failed to get fingerprint: %w", err)
 	}
-	if app.userID > app.recipientID {
-		// swap
-		fingerprint1, fingerprint2 = fingerprint2, fingerprint1
-	}
-
-	// Concatenate the two fingerprints
-	var combined [60]int
-	copy(combined[:30], fingerprint1[:])
-	copy(combined[30:], fingerprint2[:])
-
-	// Convert to string with spaces every 5 digits
-	var result string
-	for i, num := range combined {
-		result += fmt.Sprintf("%d", num)
-		if (i+1)%5 == 0 && i != len(combined)-1 {
-			result += " "
-		}
-	}
-	return result, nil
+	return combined, nil
 }
@@ -0,0 +1,252 @@
+package client
+
+import (
+	"testing"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/crypto/key_ed25519"
+	"minimal-signal/protocol/x3dh/bob"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDevice returns a ChatApp for a device of userID, with a fresh identity key if identityKey is nil
+func newTestDevice(t *testing.T, userID string, deviceID common.DeviceID, identityKey *key_ed25519.PrivateKey) *ChatApp {
+	var err error
+	if identityKey == nil {
+		identityKey, err = key_ed25519.New()
+		require.NoError(t, err)
+	}
+	prekey, err := key_ed25519.New()
+	require.NoError(t, err)
+	config := configs.DefaultClientConfig()
+	config.RedisAddress = miniredis.RunT(t).Addr()
+	app, err := NewChatApp(config, userID, deviceID, &bob.BobPrekeyBundle{IdentityKey: *identityKey, Prekey: *prekey})
+	require.NoError(t, err)
+	return app
+}
+
+// connectDevices makes every device know the public keys of all the others, without any session
+func connectDevices(t *testing.T, apps ...*ChatApp) {
+	for _, app := range apps {
+		for _, other := range apps {
+			if other == app {
+				continue
+			}
+			if other.userID != app.userID {
+				app.recipientID = other.userID
+			}
+			bundle, err := other.userPrivKeyBundle.ToPublicBundle()
+			require.NoError(t, err)
+			app.devices[other.address()] = &peerDevice{Address: other.address(), Bundle: bundle}
+		}
+	}
+}
+
+// newTestPeers returns two single-device users that know each other's public keys, without any session
+func newTestPeers(t *testing.T) (*ChatApp, *ChatApp) {
+	alice := newTestDevice(t, "alice", common.PrimaryDeviceID, nil)
+	bob := newTestDevice(t, "bob", common.PrimaryDeviceID, nil)
+	connectDevices(t, alice, bob)
+	return alice, bob
+}
+
+func textContent(body string) *common.Content {
+	return &common.Content{Type: common.ContentText, Body: body}
+}
+
+// exchange encrypts body as from and decrypts it as to
+func exchange(t *testing.T, from, to *ChatApp, body string) (msg *common.MessageBundle, replaced bool) {
+	msg, err := from.encryptMessage(from.devices[to.address()], textContent(body))
+	require.NoError(t, err)
+	content, replaced, err := to.decryptMessage(to.devices[from.address()], msg)
+	require.NoError(t, err)
+	assert.Equal(t, body, content.Body)
+	return msg, replaced
+}
+
+func TestHandshakeStopsOnceAcknowledged(t *testing.T) {
+	alice, bob := newTestPeers(t)
+
+	msg, _ := exchange(t, alice, bob, "hi bob")
+	assert.NotNil(t, msg.Handshake)
+	msg, _ = exchange(t, alice, bob, "still there?")
+	assert.NotNil(t, msg.Handshake, "handshake must be resent until bob replies")
+
+	msg, _ = exchange(t, bob, alice, "hi alice")
+	assert.Nil(t, msg.Handshake, "bob did not start the session")
+
+	msg, _ = exchange(t, alice, bob, "good")
+	assert.Nil(t, msg.Handshake, "handshake must not be resent once bob replied")
+}
+
+func TestSimultaneousInitiationConverges(t *testing.T) {
+	alice, bob := newTestPeers(t)
+
+	// Both send a first message before receiving the other's
+	assertSimultaneousInitiationConverges(t, alice, bob)
+
+}
+
+func TestSimultaneousInitiationBetweenOwnDevices(t *testing.T) {
+	identityKey, err := key_ed25519.New()
+	require.NoError(t, err)
+	laptop := newTestDevice(t, "alice", common.PrimaryDeviceID, identityKey)
+	phone := newTestDevice(t, "alice", 2, identityKey)
+	connectDevices(t, laptop, phone)
+
+	assertSimultaneousInitiationConverges(t, laptop, phone)
+}
+
+// assertSimultaneousInitiationConverges has both sides send a first message before receiving the other's,
+// and checks that they end up using a single session
+func assertSimultaneousInitiationConverges(t *testing.T, alice, bob *ChatApp) {
+	aliceDev, bobDev := bob.devices[alice.address()], alice.devices[bob.address()]
+
+	aliceFirst, err := alice.encryptMessage(bobDev, textContent("hi bob"))
+	require.NoError(t, err)
+	bobFirst, err := bob.encryptMessage(aliceDev, textContent("hi alice"))
+	require.NoError(t, err)
+	require.NotNil(t, aliceFirst.Handshake)
+	require.NotNil(t, bobFirst.Handshake)
+
+	content, replaced, err := bob.decryptMessage(aliceDev, aliceFirst)
+	require.NoError(t, err)
+	assert.False(t, replaced)
+	assert.Equal(t, "hi bob", content.Body)
+
+	content, replaced, err = alice.decryptMessage(bobDev, bobFirst)
+	require.NoError(t, err)
+	assert.False(t, replaced)
+	assert.Equal(t, "hi alice", content.Body)
+
+	// Both must have picked the same session
+	aliceActive, bobActive := bobDev.activeSession(), aliceDev.activeSession()
+	if aliceActive.InitHandshake != nil {
+		assert.True(t, aliceActive.InitHandshake.Equals(bobActive.PeerHandshake))
+	} else {
+		assert.True(t, bobActive.InitHandshake.Equals(aliceActive.PeerHandshake))
+	}
+
+	// Messages keep flowing both ways and the winner's handshake stops being attached
+	for i := 0; i < 3; i++ {
+		exchange(t, alice, bob, "ping")
+		exchange(t, bob, alice, "pong")
+	}
+	msg, _ := exchange(t, alice, bob, "done")
+	assert.Nil(t, msg.Handshake)
+	msg, _ = exchange(t, bob, alice, "done")
+	assert.Nil(t, msg.Handshake)
+}
+
+func TestMessagesReachEveryDevice(t *testing.T) {
+	identityKey, err := key_ed25519.New()
+	require.NoError(t, err)
+	laptop := newTestDevice(t, "alice", common.PrimaryDeviceID, identityKey)
+	phone := newTestDevice(t, "alice", 2, identityKey)
+	bob := newTestDevice(t, "bob", common.PrimaryDeviceID, nil)
+	connectDevices(t, laptop, phone, bob)
+
+	assert.Len(t, laptop.deviceList(), 2, "bob and the phone")
+	assert.Equal(t, bob.userID, phone.recipientID)
+
+	// Whatever one device sends reaches the recipient and the sender's other device
+	for _, to := range []*ChatApp{bob, phone} {
+		msg, _ := exchange(t, laptop, to, "hi bob")
+		assert.Equal(t, to.userID, msg.To)
+		assert.Equal(t, to.deviceID, msg.ToDevice)
+	}
+	for _, to := range []*ChatApp{laptop, phone} {
+		exchange(t, bob, to, "hi alice")
+	}
+	for _, to := range []*ChatApp{bob, laptop} {
+		exchange(t, phone, to, "sent from my phone")
+	}
+}
+
+func TestSessionResetAfterLostState(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	exchange(t, alice, bob, "hi bob")
+	exchange(t, bob, alice, "hi alice")
+
+	// Bob loses his state and starts over
+	bob.devices[alice.address()].clearSession()
+	msg, err := bob.encryptMessage(bob.devices[alice.address()], &common.Content{Type: common.ContentSessionReset})
+	require.NoError(t, err)
+	require.NotNil(t, msg.Handshake)
+
+	content, replaced, err := alice.decryptMessage(alice.devices[bob.address()], msg)
+	require.NoError(t, err)
+	assert.True(t, replaced)
+	assert.Equal(t, common.ContentSessionReset, content.Type)
+
+	exchange(t, alice, bob, "welcome back")
+	exchange(t, bob, alice, "thanks")
+}
+
+func TestUndecryptableWithoutSession(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	exchange(t, alice, bob, "hi bob")
+	msg, _ := exchange(t, bob, alice, "hi alice")
+
+	// Alice lost her state, a message without handshake cannot start a session
+	bobDev := alice.devices[bob.address()]
+	bobDev.clearSession()
+	_, _, err := alice.decryptMessage(bobDev, msg)
+	assert.ErrorIs(t, err, ErrNoSession)
+	assert.True(t, bobDev.countUndecryptable(err))
+}
+
+func TestStaleHandshakeIgnored(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	first, _ := exchange(t, alice, bob, "hi bob")
+	exchange(t, bob, alice, "hi alice")
+	bobDev, aliceDev := alice.devices[bob.address()], bob.devices[alice.address()]
+	assert.Nil(t, bobDev.activeSession().InitHandshake, "acknowledged handshake must be cleared")
+
+	// Alice resets the session, bob adopts the new one
+	bobDev.clearSession()
+	msg, err := alice.encryptMessage(bobDev, &common.Content{Type: common.ContentSessionReset})
+	require.NoError(t, err)
+	_, replaced, err := bob.decryptMessage(aliceDev, msg)
+	require.NoError(t, err)
+	require.True(t, replaced)
+	active := aliceDev.activeSession()
+
+	// Replaying the first message must not bring the old session back
+	_, _, err = bob.decryptMessage(aliceDev, first)
+	assert.Error(t, err)
+	assert.Same(t, active, aliceDev.activeSession())
+
+	// Not even once the old session has been dropped
+	aliceDev.Sessions = aliceDev.Sessions[:1]
+	_, _, err = bob.decryptMessage(aliceDev, first)
+	assert.Error(t, err)
+	assert.Same(t, active, aliceDev.activeSession())
+	assert.Len(t, aliceDev.Sessions, 1)
+
+	exchange(t, alice, bob, "still works")
+}
+
+func TestBaselineTextMessage(t *testing.T) {
+	alice, bob := newTestPeers(t)
+	exchange(t, alice, bob, "hi bob")
+
+	// Baseline clients encrypt the text itself
+	dev := alice.devices[bob.address()]
+	ad, err := alice.getADBytes(dev)
+	require.NoError(t, err)
+	for _, body := range []string{"plain text", "42", "{not json"} {
+		header, ciphertext, err := dev.activeSession().Ratchet.Encrypt([]byte(body), ad[:], false)
+		require.NoError(t, err)
+		msg := &common.MessageBundle{From: "alice", To: "bob", Message: ciphertext, Header: *header, AD: ad}
+
+		content, _, err := bob.decryptMessage(bob.devices[alice.address()], msg)
+		require.NoError(t, err)
+		assert.Equal(t, common.ContentText, content.Type)
+		assert.Equal(t, body, content.Body)
+	}
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/crypto/key_ed25519"
+	"minimal-signal/protocol/provisioning"
+	"net/http"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// LinkDevice runs on a new device. It shows a one-time code, as text and QR code, to enter on a device
+// already registered to the account, then waits for that device to send the account keys through the server.
+func LinkDevice(config *configs.ClientConfig, out io.Writer) (*provisioning.Message, error) {
+	ephKey, err := key_ed25519.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	ephPubKey, err := ephKey.Public()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ephemeral public key: %w", err)
+	}
+	code := provisioning.Code(*ephPubKey)
+
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up connections to the server: %w", err)
+	}
+	// Wait on the server before showing the code so that the other device cannot be faster
+	serverUrl := transport.wsURL(fmt.Sprintf("%s?id=%s", configs.ProvisioningPath, code))
+	conn, _, err := transport.dialer.Dial(serverUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to provisioning server: %w", err)
+	}
+	defer conn.Close()
+
+	qr, err := qrcode.New(code, qrcode.Medium)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render QR code: %w", err)
+	}
+	fmt.Fprintf(out, "To link this device, open a chat on a device of your account and enter:\n\n    /link %s\n\n", code)
+	fmt.Fprintf(out, "or scan this code:\n\n%s\n", qr.ToSmallString(false))
+	fmt.Fprintf(out, "Waiting for the other device...\n")
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive provisioning envelope: %w", err)
+	}
+	var envelope provisioning.Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to decode provisioning envelope: %w", err)
+	}
+	msg, err := provisioning.Decrypt(&envelope, *ephKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt provisioning envelope: %w", err)
+	}
+
+	fmt.Fprintf(out, "Linked as device %d of %s\n", msg.DeviceID, msg.Username)
+	return msg, nil
+}
+
+// linkDevice runs on a device already registered to the account. It sends the account keys to the new device
+// showing the given code, encrypted so that only that device can read them, with a device ID reserved on the
+// server so that two devices linked at once do not get the same one.
+func (app *ChatApp) linkDevice(code string) error {
+	newDevicePubKey, err := provisioning.ParseCode(code)
+	if err != nil {
+		return err
+	}
+
+	deviceID, err := app.reserveDevice()
+	if err != nil {
+		return fmt.Errorf("failed to reserve a device ID: %w", err)
+	}
+
+	envelope, err := provisioning.Encrypt(&provisioning.Message{
+		Username:    app.username,
+		DeviceID:    deviceID,
+		IdentityKey: app.userPrivKeyBundle.IdentityKey,
+	}, newDevicePubKey)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt provisioning envelope: %w", err)
+	}
+	payloadBytes, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	serverURL := app.transport.httpURL(fmt.Sprintf("%s/%s", configs.ProvisioningPath, code))
+	resp, err := app.transport.httpClient.Post(serverURL, "application/json", bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned non-OK status: %v", resp.Status)
+	}
+
+	app.appendNotice("Linked device %d, it joins the conversation once it sends a message", deviceID)
+	return nil
+}
+
+// reserveDevice asks the server for a device ID no other device of the account got
+func (app *ChatApp) reserveDevice() (common.DeviceID, error) {
+	resp, err := app.sendAccountRequest(http.MethodPost, fmt.Sprintf("%s/%s/devices", configs.AccountsPath, app.userID), common.AccountReserveDevice, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("server returned non-OK status: %v", resp.Status)
+	}
+	var reservation common.DeviceReservation
+	if err := json.NewDecoder(resp.Body).Decode(&reservation); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return reservation.DeviceID, nil
+}
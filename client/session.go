@@ -0,0 +1,163 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/protocol/doubleratchet"
+)
+
+// session is one Double Ratchet session with a peer device.
+// Both sides may start a session at the same time, so several can exist until they converge on one.
+type session struct {
+	Ratchet *doubleratchet.DoubleRatchet
+	// InitHandshake is the handshake we sent to start this session. It is attached to our messages
+	// until the peer replies on the session, then cleared. Always nil if the peer started the session.
+	InitHandshake *common.X3DHHandshakeBundle
+	// PeerHandshake is the handshake the peer sent to start this session, nil if we started it
+	PeerHandshake *common.X3DHHandshakeBundle
+}
+
+// activeSession returns the session used for sending, nil if there is none.
+// Must hold sessionLock.
+func (dev *peerDevice) activeSession() *session {
+	if len(dev.Sessions) == 0 {
+		return nil
+	}
+	return dev.Sessions[0]
+}
+
+// isStaleHandshake reports whether a session was already built from the given peer handshake.
+// Such a handshake is either resent by the peer or replayed, and must not start a new session.
+// Must hold sessionLock.
+func (dev *peerDevice) isStaleHandshake(peerHandshake *common.X3DHHandshakeBundle) bool {
+	for _, sess := range dev.Sessions {
+		if sess.PeerHandshake.Equals(peerHandshake) {
+			return true
+		}
+	}
+	for _, ephPubKey := range dev.SeenHandshakes {
+		if ephPubKey.Equals(&peerHandshake.EphPubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// markHandshakeSeen remembers a peer handshake a session was built from, even after that session is dropped.
+// Must hold sessionLock.
+func (dev *peerDevice) markHandshakeSeen(peerHandshake *common.X3DHHandshakeBundle) {
+	dev.SeenHandshakes = append(dev.SeenHandshakes, peerHandshake.EphPubKey)
+	if len(dev.SeenHandshakes) > configs.MaxSeenHandshakes {
+		dev.SeenHandshakes = dev.SeenHandshakes[len(dev.SeenHandshakes)-configs.MaxSeenHandshakes:]
+	}
+}
+
+// setActive makes sess the session used for sending, keeping the others as candidates
+// so that messages the peer sent on them can still be decrypted.
+// Must hold sessionLock.
+func (dev *peerDevice) setActive(sess *session) {
+	sessions := []*session{sess}
+	for _, s := range dev.Sessions {
+		if s != sess {
+			sessions = append(sessions, s)
+		}
+	}
+	dev.Sessions = sessions
+	dev.pruneSessions()
+}
+
+// addCandidate keeps sess for decryption only, right after the active session.
+// Must hold sessionLock.
+func (dev *peerDevice) addCandidate(sess *session) {
+	if len(dev.Sessions) == 0 {
+		dev.Sessions = []*session{sess}
+		return
+	}
+	sessions := []*session{dev.Sessions[0], sess}
+	dev.Sessions = append(sessions, dev.Sessions[1:]...)
+	dev.pruneSessions()
+}
+
+// pruneSessions drops the oldest candidates beyond configs.MaxSessionsPerPeer.
+// Must hold sessionLock.
+func (dev *peerDevice) pruneSessions() {
+	if len(dev.Sessions) > configs.MaxSessionsPerPeer {
+		dev.Sessions = dev.Sessions[:configs.MaxSessionsPerPeer]
+	}
+}
+
+// clearSession discards all sessions with the device so that the next message starts a fresh X3DH handshake.
+// Must hold sessionLock.
+func (dev *peerDevice) clearSession() {
+	dev.Sessions = nil
+	dev.DecryptFailures = 0
+}
+
+// countUndecryptable records a message from the device that could not be decrypted and reports whether
+// the session should be reset: immediately if there is no usable session at all, otherwise after
+// configs.SessionResetThreshold consecutive failures.
+// Must hold sessionLock.
+func (dev *peerDevice) countUndecryptable(err error) bool {
+	dev.DecryptFailures++
+	if errors.Is(err, ErrNoSession) || len(dev.Sessions) == 0 || dev.DecryptFailures >= configs.SessionResetThreshold {
+		dev.clearSession()
+		return true
+	}
+	return false
+}
+
+// acceptSession is called after sess decrypted a message from dev and decides which session stays active.
+// isNew is set if sess was just built from the handshake carried by that message.
+// It reports whether an established session was replaced, i.e. the peer reset the conversation.
+// Must hold sessionLock.
+func (app *ChatApp) acceptSession(dev *peerDevice, sess *session, isNew bool) (replaced bool) {
+	active := dev.activeSession()
+
+	if sess.PeerHandshake == nil {
+		// The peer replied on a session we started, so they have built it and use it too
+		sess.InitHandshake = nil
+		if sess != active {
+			dev.setActive(sess)
+		}
+		return false
+	}
+
+	if !isNew {
+		// A message the peer sent on an older session, e.g. before both sides converged
+		return false
+	}
+
+	switch {
+	case active == nil:
+		dev.setActive(sess)
+	case active.InitHandshake != nil:
+		// Both sides started a session before receiving the other's first message
+		if app.winsConflict(dev, active, sess) {
+			dev.addCandidate(sess)
+		} else {
+			dev.setActive(sess)
+		}
+	default:
+		// The peer started over, e.g. because it lost its state
+		dev.setActive(sess)
+		replaced = true
+	}
+	return replaced
+}
+
+// winsConflict reports whether our session should be kept over the one dev started at the same time.
+// Both sides evaluate the same rule, so they converge on a single session: the one started by the side
+// with the lower identity key, or with the lower ephemeral key if both use the same identity,
+// which is the case for two devices of the same user.
+// Must hold sessionLock.
+func (app *ChatApp) winsConflict(dev *peerDevice, ours, theirs *session) bool {
+	userIDPub, err := app.userPrivKeyBundle.IdentityKey.Public()
+	if err == nil {
+		if c := bytes.Compare(userIDPub[:], dev.Bundle.IdentityKey[:]); c != 0 {
+			return c < 0
+		}
+	}
+	return bytes.Compare(ours.InitHandshake.EphPubKey[:], theirs.PeerHandshake.EphPubKey[:]) < 0
+}
@@ -0,0 +1,249 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/protocol/doubleratchet"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// storeGob gob-encodes v and stores it under key
+func storeGob(rdb *redis.Client, key string, v any) error {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return err
+	}
+	return rdb.Set(context.Background(), key, buffer.Bytes(), 0).Err()
+}
+
+// loadGob decodes the value stored under key into v. It reports false if there is no such key.
+func loadGob(rdb *redis.Client, key string, v any) (bool, error) {
+	data, err := rdb.Get(context.Background(), key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, gob.NewDecoder(bytes.NewBuffer(data)).Decode(v)
+}
+
+// store returns the client of the Redis the state of this device is stored in, connected on first use and
+// closed when the app quits
+func (app *ChatApp) store() *redis.Client {
+	app.rdbLock.Lock()
+	defer app.rdbLock.Unlock()
+	if app.rdb == nil {
+		app.rdb = redis.NewClient(&redis.Options{Addr: app.config.RedisAddress})
+	}
+	return app.rdb
+}
+
+// closeStore closes the client returned by store
+func (app *ChatApp) closeStore() {
+	app.rdbLock.Lock()
+	defer app.rdbLock.Unlock()
+	if app.rdb != nil {
+		app.rdb.Close()
+		app.rdb = nil
+	}
+}
+
+func (app *ChatApp) save() error {
+	rdb := app.store()
+
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+
+	for _, dev := range app.devices {
+		if err := app.saveDevice(rdb, dev); err != nil {
+			return err
+		}
+	}
+
+	// State stored by the baseline is migrated by load
+	if app.deviceID == common.PrimaryDeviceID {
+		if err := rdb.Del(context.Background(),
+			fmt.Sprintf(configs.LegacyClientRatchetKey, app.username, app.recipientName),
+			fmt.Sprintf(configs.LegacyClientInitHandshakeKey, app.username, app.recipientName),
+			fmt.Sprintf(configs.LegacyClientMessagesKey, app.username, app.recipientName),
+		).Err(); err != nil {
+			return err
+		}
+	}
+
+	if err := app.saveOutbox(rdb); err != nil {
+		return err
+	}
+
+	return app.saveHistory()
+}
+
+// saveDevice stores the sessions with dev. Must hold sessionLock.
+func (app *ChatApp) saveDevice(rdb *redis.Client, dev *peerDevice) error {
+	addr := dev.Address
+	sessionsKey := fmt.Sprintf(configs.ClientSessionsKey, app.userID, app.deviceID, addr.UserID, addr.DeviceID)
+	if len(dev.Sessions) > 0 {
+		// Save sessions
+		if err := storeGob(rdb, sessionsKey, dev.Sessions); err != nil {
+			return err
+		}
+	} else if err := rdb.Del(context.Background(), sessionsKey).Err(); err != nil {
+		// The session was reset, don't bring the old one back on next start
+		return err
+	}
+
+	// Save seenHandshakes
+	return storeGob(rdb, fmt.Sprintf(configs.ClientSeenHandshakesKey, app.userID, app.deviceID, addr.UserID, addr.DeviceID), dev.SeenHandshakes)
+}
+
+// saveSent stores the outbox once a message encrypted for dev was added to it, with the sessions with dev:
+// loading sessions older than the outbox would encrypt the next messages with the same keys again
+func (app *ChatApp) saveSent(dev *peerDevice) error {
+	rdb := app.store()
+
+	app.sessionLock.Lock()
+	err := app.saveDevice(rdb, dev)
+	app.sessionLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return app.saveOutbox(rdb)
+}
+
+// saveOutbox stores the messages that were encrypted but not sent yet, the sessions already moved past them
+func (app *ChatApp) saveOutbox(rdb *redis.Client) error {
+	app.connLock.Lock()
+	defer app.connLock.Unlock()
+
+	outboxKey := fmt.Sprintf(configs.ClientOutboxKey, app.userID, app.deviceID, app.recipientID)
+	if len(app.outbox) == 0 {
+		return rdb.Del(context.Background(), outboxKey).Err()
+	}
+	return storeGob(rdb, outboxKey, app.outbox)
+}
+
+// saveHistory stores the chat history, without the expired disappearing messages, and the timer of the conversation
+func (app *ChatApp) saveHistory() error {
+	rdb := app.store()
+
+	app.messageLock.Lock()
+	defer app.messageLock.Unlock()
+
+	if err := storeGob(rdb, fmt.Sprintf(configs.ClientExpireTimerKey, app.userID, app.deviceID, app.recipientID), app.expireTimer); err != nil {
+		return err
+	}
+	return storeGob(rdb, fmt.Sprintf(configs.ClientHistoryKey, app.userID, app.deviceID, app.recipientID), app.messages.dropExpired(time.Now()))
+}
+
+// saveIdentity stores the identity key pinned for the recipient and its verification status
+func (app *ChatApp) saveIdentity() error {
+	rdb := app.store()
+
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+	if app.recipientIdentity == nil {
+		return nil
+	}
+	return storeGob(rdb, fmt.Sprintf(configs.ClientIdentityKey, app.userID, app.deviceID, app.recipientID), app.recipientIdentity)
+}
+
+// loadIdentity restores the identity key pinned for the recipient, if we talked to them before
+func (app *ChatApp) loadIdentity() error {
+	rdb := app.store()
+
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+	identity := &contactIdentity{}
+	found, err := loadGob(rdb, fmt.Sprintf(configs.ClientIdentityKey, app.userID, app.deviceID, app.recipientID), identity)
+	if err != nil || !found {
+		return err
+	}
+	app.recipientIdentity = identity
+	return nil
+}
+
+// load restores the state of the conversation. The devices must already be known.
+func (app *ChatApp) load() error {
+	rdb := app.store()
+
+	app.sessionLock.Lock()
+	defer app.sessionLock.Unlock()
+
+	for addr, dev := range app.devices {
+		// Load sessions
+		if _, err := loadGob(rdb, fmt.Sprintf(configs.ClientSessionsKey, app.userID, app.deviceID, addr.UserID, addr.DeviceID), &dev.Sessions); err != nil {
+			return err
+		}
+
+		// Load seenHandshakes
+		if _, err := loadGob(rdb, fmt.Sprintf(configs.ClientSeenHandshakesKey, app.userID, app.deviceID, addr.UserID, addr.DeviceID), &dev.SeenHandshakes); err != nil {
+			return err
+		}
+	}
+
+	// Load the messages to send once connected
+	app.connLock.Lock()
+	_, err := loadGob(rdb, fmt.Sprintf(configs.ClientOutboxKey, app.userID, app.deviceID, app.recipientID), &app.outbox)
+	app.connLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Load messages
+	app.messageLock.Lock()
+	defer app.messageLock.Unlock()
+	if _, err := loadGob(rdb, fmt.Sprintf(configs.ClientExpireTimerKey, app.userID, app.deviceID, app.recipientID), &app.expireTimer); err != nil {
+		return err
+	}
+	found, err := loadGob(rdb, fmt.Sprintf(configs.ClientHistoryKey, app.userID, app.deviceID, app.recipientID), &app.messages)
+	if err != nil {
+		return err
+	} else if found {
+		// Messages may have expired while the client was not running
+		app.messages = app.messages.dropExpired(time.Now())
+		return nil
+	}
+
+	// The baseline stored the history as plain lines
+	var lines []string
+	if app.deviceID == common.PrimaryDeviceID {
+		if err := app.loadLegacy(rdb, &lines); err != nil {
+			return err
+		}
+	}
+	for _, line := range lines {
+		app.messages = append(app.messages, messageEntry{Text: line})
+	}
+	return nil
+}
+
+// loadLegacy loads the state stored by the baseline, before multi-device support, when every user had a single
+// device and was identified by its username. It becomes the state of the conversation between both primary
+// devices. The history is loaded into lines. Must hold sessionLock.
+func (app *ChatApp) loadLegacy(rdb *redis.Client, lines *[]string) error {
+	dev, ok := app.devices[deviceAddress{UserID: app.recipientID, DeviceID: common.PrimaryDeviceID}]
+	if !ok {
+		return nil
+	}
+
+	if _, err := loadGob(rdb, fmt.Sprintf(configs.LegacyClientMessagesKey, app.username, app.recipientName), lines); err != nil {
+		return err
+	}
+	sess := &session{Ratchet: &doubleratchet.DoubleRatchet{}}
+	found, err := loadGob(rdb, fmt.Sprintf(configs.LegacyClientRatchetKey, app.username, app.recipientName), sess.Ratchet)
+	if err != nil || !found {
+		return err
+	}
+	if _, err := loadGob(rdb, fmt.Sprintf(configs.LegacyClientInitHandshakeKey, app.username, app.recipientName), &sess.InitHandshake); err != nil {
+		return err
+	}
+	dev.Sessions = []*session{sess}
+	return nil
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"minimal-signal/configs"
+	"minimal-signal/crypto/tlscert"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/gorilla/websocket"
+)
+
+// transport makes the HTTP requests and WebSocket connections to the server, over TLS unless it is disabled
+type transport struct {
+	httpScheme string
+	wsScheme   string
+	address    string
+	httpClient *http.Client
+	dialer     *websocket.Dialer
+}
+
+func newTransport(config *configs.ClientConfig) (*transport, error) {
+	if config.DisableTLS {
+		return &transport{
+			httpScheme: "http",
+			wsScheme:   "ws",
+			address:    config.ServerAddress,
+			httpClient: &http.Client{},
+			dialer:     &websocket.Dialer{},
+		}, nil
+	}
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &transport{
+		httpScheme: "https",
+		wsScheme:   "wss",
+		address:    config.ServerAddress,
+		httpClient: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		dialer:     &websocket.Dialer{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// newTLSConfig returns the TLS settings of the connections to the server: the trusted certificates and the
+// pinned keys of config. With pinned keys but no CA certificate, the server certificate is trusted by its pin
+// alone, so that it can be self-signed.
+func newTLSConfig(config *configs.ClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.CACertFile != "" {
+		caPEM, err := os.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificate found in %s", config.CACertFile)
+		}
+	}
+
+	if len(config.PinnedKeys) == 0 {
+		return tlsConfig, nil
+	}
+	pins := slices.Clone(config.PinnedKeys)
+	if config.CACertFile == "" {
+		// The chain is not verified, only the key of the certificate
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrCertificateNotPinned
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return fmt.Errorf("invalid server certificate: %w", err)
+			}
+			if !slices.Contains(pins, tlscert.Pin(cert)) {
+				return ErrCertificateNotPinned
+			}
+			return nil
+		}
+		return tlsConfig, nil
+	}
+	// Called after the certificate chain is verified
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 || !slices.Contains(pins, tlscert.Pin(state.PeerCertificates[0])) {
+			return ErrCertificateNotPinned
+		}
+		return nil
+	}
+	return tlsConfig, nil
+}
+
+// httpURL and wsURL return the URL of a path on the server, which may end with a query
+func (t *transport) httpURL(path string) string {
+	return fmt.Sprintf("%s://%s%s", t.httpScheme, t.address, path)
+}
+
+func (t *transport) wsURL(path string) string {
+	return fmt.Sprintf("%s://%s%s", t.wsScheme, t.address, path)
+}
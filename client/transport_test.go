@@ -0,0 +1,119 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/crypto/tlscert"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTLSServer starts a TLS server answering key fetches with no device and accepting WebSocket connections.
+// It returns a client config trusting its certificate.
+func newTestTLSServer(t *testing.T) (*httptest.Server, *configs.ClientConfig) {
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(configs.PublishKeysPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]common.DevicePrekeyBundle{})
+	})
+	mux.HandleFunc(configs.WebSocketPath, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			conn.Close()
+		}
+	})
+	server := httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, caPEM, 0o600))
+
+	config := configs.DefaultClientConfig()
+	config.ServerAddress = server.Listener.Addr().String()
+	config.CACertFile = caFile
+	return server, config
+}
+
+func newTestTransport(t *testing.T, config *configs.ClientConfig) *transport {
+	transport, err := newTransport(config)
+	require.NoError(t, err)
+	return transport
+}
+
+func TestTransportTLS(t *testing.T) {
+	_, config := newTestTLSServer(t)
+	app := newTestDevice(t, "alice", common.PrimaryDeviceID, nil)
+	app.transport = newTestTransport(t, config)
+
+	bundles, err := app.GetKeys("bob")
+	require.NoError(t, err)
+	assert.Empty(t, bundles)
+
+	conn, _, err := app.transport.dialer.Dial(app.transport.wsURL(configs.WebSocketPath), nil)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestTransportUntrustedCertificate(t *testing.T) {
+	_, config := newTestTLSServer(t)
+	config.CACertFile = ""
+
+	// The test certificate is not trusted by the system
+	_, err := newTestTransport(t, config).httpClient.Get(fmt.Sprintf("https://%s%s/bob", config.ServerAddress, configs.PublishKeysPath))
+	assert.Error(t, err)
+}
+
+func TestTransportPinning(t *testing.T) {
+	server, config := newTestTLSServer(t)
+	url := fmt.Sprintf("https://%s%s/bob", config.ServerAddress, configs.PublishKeysPath)
+
+	config.PinnedKeys = []string{tlscert.Pin(server.Certificate())}
+	resp, err := newTestTransport(t, config).httpClient.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// The trusted certificate is refused if its key is not pinned, over HTTPS and WSS
+	config.PinnedKeys = []string{base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))}
+	transport := newTestTransport(t, config)
+	_, err = transport.httpClient.Get(url)
+	assert.ErrorIs(t, err, ErrCertificateNotPinned)
+	_, _, err = transport.dialer.Dial(transport.wsURL(configs.WebSocketPath), nil)
+	assert.ErrorIs(t, err, ErrCertificateNotPinned)
+}
+
+func TestTransportPinOnly(t *testing.T) {
+	server, config := newTestTLSServer(t)
+	url := fmt.Sprintf("https://%s%s/bob", config.ServerAddress, configs.PublishKeysPath)
+
+	// The test certificate is not trusted by the system, its pin is enough
+	config.CACertFile = ""
+	config.PinnedKeys = []string{tlscert.Pin(server.Certificate())}
+	transport := newTestTransport(t, config)
+	resp, err := transport.httpClient.Get(url)
+	require.NoError(t, err)
+	resp.Body.Close()
+	conn, _, err := transport.dialer.Dial(transport.wsURL(configs.WebSocketPath), nil)
+	require.NoError(t, err)
+	conn.Close()
+
+	config.PinnedKeys = []string{base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))}
+	transport = newTestTransport(t, config)
+	_, err = transport.httpClient.Get(url)
+	assert.ErrorIs(t, err, ErrCertificateNotPinned)
+	_, _, err = transport.dialer.Dial(transport.wsURL(configs.WebSocketPath), nil)
+	assert.ErrorIs(t, err, ErrCertificateNotPinned)
+}
@@ -3,9 +3,11 @@ package client
 import (
 	"errors"
 	"fmt"
+	"minimal-signal/protocol/fingerprint"
 	"strings"
 
 	"github.com/jroimartin/gocui"
+	"github.com/skip2/go-qrcode"
 )
 
 // InitGui initializes the gocui screen
@@ -20,14 +22,34 @@ func (app *ChatApp) InitGui() error {
 	return nil
 }
 
-// PromptRecipientID prompts for recipient ID and sets the chat layout
+// PromptRecipientID prompts for the username of the recipient, offering the contacts, and sets the chat layout
+// once a registered user is entered
 func (app *ChatApp) PromptRecipientID() error {
+	if err := app.loadContacts(); err != nil {
+		logger.Errorf("Error loading contacts: %v", err)
+	}
+
 	if err := app.Gui.SetKeybinding("prompt", gocui.KeyEnter, gocui.ModNone, func(g *gocui.Gui, v *gocui.View) error {
-		app.recipientID = strings.TrimSpace(v.Buffer())
-		if app.recipientID == "" {
+		username := strings.TrimSpace(v.Buffer())
+		if username == "" {
+			return nil
+		}
+		account, previous, err := app.findRecipient(username)
+		if errors.Is(err, ErrUnknownUser) {
+			v.Title = fmt.Sprintf("%s is not registered, enter recipient username", username)
+			v.Clear()
+			v.SetCursor(0, 0)
+			return nil
+		} else if err != nil {
+			v.Title = fmt.Sprintf("Error looking up %s: %v", username, err)
+			return nil
+		}
+		if err := app.setRecipient(account, previous); err != nil {
+			v.Title = fmt.Sprintf("Error opening the chat with %s: %v", username, err)
 			return nil
 		}
 		g.DeleteView("prompt")
+		g.DeleteView("contacts")
 		g.SetManagerFunc(app.layout)
 		g.SetCurrentView("input")
 
@@ -38,6 +60,11 @@ func (app *ChatApp) PromptRecipientID() error {
 		if err := app.connectToWebSocket(); err != nil {
 			logger.Fatalf("Error connecting to WebSocket server: %v", err)
 		}
+		if previous != nil && previous.UserID != account.ID {
+			app.appendNotice("The username %s now belongs to another account than the contact you knew by it", account.Username)
+		} else if previous != nil && previous.Username != account.Username {
+			app.appendNotice("%s is now known as %s", previous.Username, account.Username)
+		}
 
 		return nil
 	}); err != nil {
@@ -46,6 +73,13 @@ func (app *ChatApp) PromptRecipientID() error {
 	return nil
 }
 
+// updateGui runs f on the UI goroutine to refresh views. It does nothing before InitGui, e.g. in tests.
+func (app *ChatApp) updateGui(f func(*gocui.Gui) error) {
+	if app.Gui != nil {
+		app.Gui.Update(f)
+	}
+}
+
 // UpdateMessages updates the message view
 func (app *ChatApp) UpdateMessages(g *gocui.Gui) error {
 	v, err := g.View("messages")
@@ -53,8 +87,10 @@ func (app *ChatApp) UpdateMessages(g *gocui.Gui) error {
 		return err
 	}
 	v.Clear()
-	for _, msg := range app.messages {
-		fmt.Fprintln(v, msg)
+	app.messageLock.Lock()
+	defer app.messageLock.Unlock()
+	for i := range app.messages {
+		fmt.Fprintln(v, app.formatEntry(&app.messages[i]))
 	}
 	return nil
 }
@@ -66,17 +102,77 @@ func (app *ChatApp) SendMessageHandler(g *gocui.Gui, v *gocui.View) error {
 		return nil
 	}
 
-	if err := app.sendMessage(message); err != nil {
+	v.Clear()
+	v.SetCursor(0, 0)
+
+	if strings.HasPrefix(message, commandPrefix) {
+		app.inputChanged(true)
+		if err := app.handleCommand(message); err != nil {
+			app.appendNotice("%v", err)
+		}
+		return nil
+	}
+
+	timer := app.currentExpireTimer()
+	app.messageSent()
+	id, err := app.sendMessage(message)
+	if errors.Is(err, ErrIdentityChanged) || errors.Is(err, ErrOutboxFull) {
+		app.appendNotice("Message not sent: %v", err)
+		return nil
+	} else if err != nil {
 		logger.Errorf("Error sending message: %v", err)
 	}
 
-	app.messages = append(app.messages, "[You] "+message)
-	v.Clear()
-	v.SetCursor(0, 0)
-	app.UpdateMessages(g)
+	app.appendEntry(messageEntry{ID: id, Author: app.userID, Text: message}, timer)
 	return nil
 }
 
+// showScannableFingerprint shows the safety number as a QR code and its payload, for the recipient to
+// scan or paste into /verify. Enter or Esc closes it.
+func (app *ChatApp) showScannableFingerprint() error {
+	identityKey, _ := app.displayedIdentity()
+	scannable, err := app.scannableFingerprint(fingerprint.CurrentVersion, identityKey)
+	if err != nil {
+		return err
+	}
+	payload := scannable.Payload()
+	qr, err := qrcode.New(payload, qrcode.Medium)
+	if err != nil {
+		return fmt.Errorf("failed to render QR code: %w", err)
+	}
+	lines := strings.Split(strings.TrimRight(qr.ToSmallString(false), "\n"), "\n")
+
+	g := app.Gui
+	maxX, maxY := g.Size()
+	width, height := max(len([]rune(lines[0])), len(payload))+1, len(lines)+3
+	x0, y0 := max((maxX-width)/2, 0), max((maxY-height)/2, 0)
+	v, err := g.SetView("qr", x0, y0, x0+width, y0+height)
+	if err != nil && !errors.Is(err, gocui.ErrUnknownView) {
+		return err
+	}
+	v.Clear()
+	v.Title = "Scan this, or send the line below (Enter to close)"
+	fmt.Fprintln(v, strings.Join(lines, "\n"))
+	fmt.Fprintln(v)
+	fmt.Fprintln(v, payload)
+
+	closeView := func(g *gocui.Gui, _ *gocui.View) error {
+		g.DeleteKeybindings("qr")
+		if err := g.DeleteView("qr"); err != nil {
+			return err
+		}
+		_, err := g.SetCurrentView("input")
+		return err
+	}
+	for _, key := range []gocui.Key{gocui.KeyEnter, gocui.KeyEsc} {
+		if err := g.SetKeybinding("qr", key, gocui.ModNone, closeView); err != nil {
+			return err
+		}
+	}
+	_, err = g.SetCurrentView("qr")
+	return err
+}
+
 // Layout function for the UI
 func (app *ChatApp) layout(g *gocui.Gui) error {
 	maxX, maxY := g.Size()
@@ -86,11 +182,26 @@ func (app *ChatApp) layout(g *gocui.Gui) error {
 			if !errors.Is(err, gocui.ErrUnknownView) {
 				return err
 			}
-			v.Title = "Enter recipient ID"
+			v.Title = "Enter recipient username"
 			v.Editable = true
 			v.Wrap = true
 			g.SetCurrentView("prompt")
 		}
+		if len(app.contacts) > 0 {
+			if v, err := g.SetView("contacts", maxX/4, maxY/2+1, 3*maxX/4, maxY/2+2+len(app.contacts)); err != nil {
+				if !errors.Is(err, gocui.ErrUnknownView) {
+					return err
+				}
+				v.Title = "Contacts"
+				for _, c := range app.contacts {
+					if c.Registered {
+						fmt.Fprintln(v, c.Username)
+					} else {
+						fmt.Fprintf(v, "%s (no longer registered)\n", c.Username)
+					}
+				}
+			}
+		}
 		return nil
 	}
 
@@ -98,20 +209,17 @@ func (app *ChatApp) layout(g *gocui.Gui) error {
 		if !errors.Is(err, gocui.ErrUnknownView) {
 			return err
 		}
-		fingerprint, err := app.fingerprint()
-		if err != nil {
+		v.Wrap = true
+		if err := app.updateFingerprint(g); err != nil {
 			return err
 		}
-		v.Title = fmt.Sprintf("Fingerprint - Compare this with %s's to make sure he/she is %s", app.recipientID, app.recipientID)
-		v.Wrap = true
-		fmt.Fprintln(v, fingerprint)
 	}
 
 	if v, err := g.SetView("messages", 0, 3, maxX-1, maxY-5); err != nil {
 		if !errors.Is(err, gocui.ErrUnknownView) {
 			return err
 		}
-		v.Title = "Chat with " + app.recipientID
+		v.Title = app.statusTitle()
 		v.Autoscroll = true
 		v.Wrap = true
 		app.UpdateMessages(g)
@@ -121,8 +229,9 @@ func (app *ChatApp) layout(g *gocui.Gui) error {
 		if !errors.Is(err, gocui.ErrUnknownView) {
 			return err
 		}
-		v.Title = "Type a message"
+		v.Title = "Type a message (/reset to start a new secure session, /qr to show the safety number, /verify once you compared it)"
 		v.Editable = true
+		v.Editor = app.inputEditor()
 		v.Wrap = true
 		g.SetCurrentView("input")
 	}
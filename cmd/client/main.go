@@ -3,12 +3,16 @@ package main
 import (
 	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"minimal-signal/client"
+	"minimal-signal/common"
 	"minimal-signal/configs"
 	"minimal-signal/crypto/key_ed25519"
 	"minimal-signal/protocol/x3dh/bob"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/jroimartin/gocui"
 
@@ -19,17 +23,63 @@ import (
 var logger = logrus.New()
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run main.go <userID>")
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	link := fs.Bool("link", false, "link this device to an account registered on another device")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: go run main.go [flags] <username> [deviceID]")
+		fmt.Fprintln(fs.Output(), "       go run main.go [flags] --link")
+		fs.PrintDefaults()
+	}
+	config, err := configs.LoadClientConfig(fs, os.Args[1:])
+	if err != nil {
+		logger.Fatalf("Error loading config: %v", err)
+	}
+	if !*link && fs.NArg() < 1 {
+		fs.Usage()
 		return
 	}
-	userID := os.Args[1]
 
-	if err := createKeysIfNotExists(userID); err != nil {
-		logger.Fatalf("Error creating keys: %v", err)
-		return
+	var (
+		username  string
+		accountID string
+		deviceID  = common.PrimaryDeviceID
+	)
+	if *link {
+		// Get the account keys from a device already registered to the account
+		msg, err := client.LinkDevice(config, os.Stdout)
+		if err != nil {
+			logger.Fatalf("Error linking device: %v", err)
+			return
+		}
+		publicKey, err := msg.IdentityKey.Public()
+		if err != nil {
+			logger.Fatalf("Error creating keys: %v", err)
+			return
+		}
+		username, accountID, deviceID = common.NormalizeUsername(msg.Username), common.AccountID(*publicKey), msg.DeviceID
+		if err := writeKeys(envFileName(config.SecretDir, accountID, deviceID), &msg.IdentityKey); err != nil {
+			logger.Fatalf("Error creating keys: %v", err)
+			return
+		}
+		if err := client.SaveLocalAccount(config.SecretDir, username, accountID); err != nil {
+			logger.Fatalf("Error saving account: %v", err)
+			return
+		}
+	} else {
+		username = common.NormalizeUsername(fs.Arg(0))
+		if fs.NArg() > 1 {
+			if deviceID, err = common.ParseDeviceID(fs.Arg(1)); err != nil {
+				logger.Fatalf("Error parsing device ID: %v", err)
+				return
+			}
+		}
+
+		if accountID, err = accountKeys(config.SecretDir, fs.Arg(0), deviceID); err != nil {
+			logger.Fatalf("Error creating keys: %v", err)
+			return
+		}
 	}
-	if err := godotenv.Load(fmt.Sprintf("%s/.env.%s", configs.DebugSecretDir, userID)); err != nil {
+	if err := godotenv.Load(envFileName(config.SecretDir, accountID, deviceID)); err != nil {
 		logger.Fatalf("Error loading .env file: %v", err)
 		return
 	}
@@ -52,15 +102,26 @@ func main() {
 	// 	return
 	// }
 
-	chatApp := client.NewChatApp(userID, &bob.BobPrekeyBundle{
+	chatApp, err := client.NewChatApp(config, username, deviceID, &bob.BobPrekeyBundle{
 		IdentityKey: identityKey,
 		Prekey:      prekey,
 	})
+	if err != nil {
+		logger.Fatalf("Error creating chat app: %v", err)
+	}
 
 	if err := chatApp.InitGui(); err != nil {
 		logger.Fatalf("Error initializing gocui interface: %v", err)
 	}
 
+	// Registering an account that already exists does nothing, the keys of earlier versions are registered this way
+	if err := chatApp.Register(); err != nil {
+		logger.Fatalf("Error registering account: %v", err)
+	}
+	if err := chatApp.ClaimUsername(); err != nil {
+		logger.Fatalf("Error setting username: %v", err)
+	}
+
 	if err := chatApp.PostKeys(); err != nil {
 		logger.Fatalf("Error publishing keys: %v", err)
 	}
@@ -92,24 +153,122 @@ func decodeHexTo32BytesArray(hexStr string) ([32]byte, error) {
 	return byteArray, nil
 }
 
-func createKeysIfNotExists(userId string) error {
-	// Check if the .env.<userId> file already exists
-	envFileName := fmt.Sprintf("%s/.env.%s", configs.DebugSecretDir, userId)
-	if _, err := os.Stat(envFileName); err == nil {
+// envFileName returns the file in secretDir holding the keys of a device: .env.<accountID> for the primary device,
+// .env.<accountID>.<deviceID> for the others
+func envFileName(secretDir string, accountID string, deviceID common.DeviceID) string {
+	if deviceID == common.PrimaryDeviceID {
+		return fmt.Sprintf("%s/.env.%s", secretDir, accountID)
+	}
+	return fmt.Sprintf("%s/.env.%s.%d", secretDir, accountID, deviceID)
+}
+
+// accountKeys returns the ID of the account a username belongs to on this machine, and creates the keys of the
+// device if it has none. An unknown username gets a new account, only on its primary device.
+func accountKeys(secretDir string, username string, deviceID common.DeviceID) (string, error) {
+	accountID, err := client.LocalAccountID(secretDir, username)
+	if err != nil {
+		return "", err
+	}
+	if accountID == "" {
+		if accountID, err = migrateKeyFiles(secretDir, username); err != nil {
+			return "", err
+		}
+	}
+	if accountID == "" {
+		if deviceID != common.PrimaryDeviceID {
+			return "", fmt.Errorf("no account %s on this machine, link this device with --link instead", username)
+		}
+		idkey, err := key_ed25519.New()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate private key: %v", err)
+		}
+		publicKey, err := idkey.Public()
+		if err != nil {
+			return "", err
+		}
+		accountID = common.AccountID(*publicKey)
+		if err := writeKeys(envFileName(secretDir, accountID, deviceID), idkey); err != nil {
+			return "", err
+		}
+	}
+	if err := client.SaveLocalAccount(secretDir, username, accountID); err != nil {
+		return "", err
+	}
+	return accountID, createKeysIfNotExists(secretDir, accountID, deviceID)
+}
+
+// migrateKeyFiles renames the key files of the devices of username to the account ID. Earlier versions named
+// them after the username, which then changed with the username. Returns an empty account ID if there are none.
+func migrateKeyFiles(secretDir string, username string) (string, error) {
+	prefix := fmt.Sprintf("%s/.env.%s", secretDir, username)
+	fileNames, err := filepath.Glob(prefix + ".*")
+	if err != nil {
+		return "", err
+	}
+
+	var accountID string
+	for _, fileName := range append(fileNames, prefix) {
+		deviceID := common.PrimaryDeviceID
+		if fileName != prefix {
+			// Files of other usernames starting with this one and a dot are skipped
+			if deviceID, err = common.ParseDeviceID(strings.TrimPrefix(fileName, prefix+".")); err != nil {
+				continue
+			}
+		}
+		env, err := godotenv.Read(fileName)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", fileName, err)
+		}
+		identityKey, err := decodeHexTo32BytesArray(env["IDENTITY_KEY"])
+		if err != nil {
+			return "", fmt.Errorf("failed to decode IDENTITY_KEY of %s: %v", fileName, err)
+		}
+		publicKey, err := (*key_ed25519.PrivateKey)(&identityKey).Public()
+		if err != nil {
+			return "", err
+		}
+		accountID = common.AccountID(*publicKey)
+		if err := os.Rename(fileName, envFileName(secretDir, accountID, deviceID)); err != nil {
+			return "", fmt.Errorf("failed to rename %s: %v", fileName, err)
+		}
+	}
+	return accountID, nil
+}
+
+// createKeysIfNotExists creates the key file of a device that is not the primary one, with the identity key
+// of the primary device
+func createKeysIfNotExists(secretDir string, accountID string, deviceID common.DeviceID) error {
+	// Check if the env file of the device already exists
+	fileName := envFileName(secretDir, accountID, deviceID)
+	if _, err := os.Stat(fileName); err == nil {
 		return nil
+	} else if deviceID == common.PrimaryDeviceID {
+		return fmt.Errorf("keys of the primary device are missing: %v", err)
 	}
 
-	// Generate a new private key
-	idkey, err := key_ed25519.New()
+	// Other devices share the identity key of the primary device, copy it if it is on this machine.
+	// Otherwise the device must be linked with --link.
+	primaryEnv, err := godotenv.Read(envFileName(secretDir, accountID, common.PrimaryDeviceID))
 	if err != nil {
-		return fmt.Errorf("failed to generate private key: %v", err)
+		return fmt.Errorf("failed to read keys of the primary device, link this device with --link instead: %v", err)
 	}
+	identityKey, err := decodeHexTo32BytesArray(primaryEnv["IDENTITY_KEY"])
+	if err != nil {
+		return fmt.Errorf("failed to decode IDENTITY_KEY of the primary device: %v", err)
+	}
+	return writeKeys(fileName, (*key_ed25519.PrivateKey)(&identityKey))
+}
+
+// writeKeys creates the env file of a device with the given identity key and a new prekey
+func writeKeys(fileName string, idkey *key_ed25519.PrivateKey) error {
 	prekey, err := key_ed25519.New()
 	if err != nil {
 		return fmt.Errorf("failed to generate private key: %v", err)
 	}
 
-	file, err := os.Create(envFileName)
+	file, err := os.Create(fileName)
 	if err != nil {
 		return fmt.Errorf("failed to create env file: %v", err)
 	}
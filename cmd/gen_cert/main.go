@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"minimal-signal/crypto/tlscert"
+)
+
+// Generates a self-signed certificate for running the server with TLS during development
+func main() {
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "comma-separated host names and IP addresses of the server")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "validity of the certificate")
+	certFile := flag.String("cert", "secrets/server.crt", "file to write the certificate to")
+	keyFile := flag.String("key", "secrets/server.key", "file to write the private key to")
+	flag.Parse()
+
+	certPEM, keyPEM, err := tlscert.Generate(strings.Split(*hosts, ","), *validFor)
+	if err != nil {
+		log.Fatalf("Failed to generate certificate: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*certFile), 0o700); err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(*certFile, certPEM, 0o644); err != nil {
+		log.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(*keyFile), 0o700); err != nil {
+		log.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(*keyFile, keyPEM, 0o600); err != nil {
+		log.Fatalf("Failed to write private key: %v", err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Fatalf("Failed to parse certificate: %v", err)
+	}
+	fmt.Printf("CERTIFICATE: %s\n", *certFile)
+	fmt.Printf("KEY: %s\n", *keyFile)
+	fmt.Printf("PIN: %s\n", tlscert.Pin(cert))
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"minimal-signal/configs"
 	"minimal-signal/server"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gorilla/mux"
 	"github.com/redis/go-redis/v9"
@@ -18,22 +24,74 @@ var (
 
 // Main function to start the server
 func main() {
+	config, err := configs.LoadServerConfig(flag.NewFlagSet(os.Args[0], flag.ExitOnError), os.Args[1:])
+	if err != nil {
+		logger.Fatalf("Error loading config: %v", err)
+	}
+	if err := server.ConfigureLogger(logger, config); err != nil {
+		logger.Fatalf("Error configuring logger: %v", err)
+	}
+
 	s := server.NewServer(
 		context.Background(),
-		redis.NewClient(&redis.Options{Addr: configs.RedisAddress}),
+		config,
+		redis.NewClient(&redis.Options{Addr: config.RedisAddress}),
 		logger,
 	)
 	defer s.Close()
 
 	r := mux.NewRouter()
 	r.HandleFunc(configs.WebSocketPath, s.HandleConnections)
-	r.HandleFunc(fmt.Sprintf("%s/{userID}", configs.PublishKeysPath), s.HandlePostKeys).Methods(http.MethodPost)
+	r.HandleFunc(fmt.Sprintf("%s/{userID}/{deviceID}", configs.PublishKeysPath), s.HandlePostKeys).Methods(http.MethodPost)
 	r.HandleFunc(fmt.Sprintf("%s/{userID}", configs.PublishKeysPath), s.HandleGetKeys).Methods(http.MethodGet)
+	r.HandleFunc(fmt.Sprintf("%s/{userID}/{deviceID}", configs.PublishKeysPath), s.HandleRevokeDevice).Methods(http.MethodDelete)
+	r.HandleFunc(fmt.Sprintf("%s/{userID}", configs.AccountsPath), s.HandleRegister).Methods(http.MethodPost)
+	r.HandleFunc(fmt.Sprintf("%s/{userID}", configs.AccountsPath), s.HandleUnregister).Methods(http.MethodDelete)
+	r.HandleFunc(fmt.Sprintf("%s/{userID}", configs.AccountsPath), s.HandleGetAccount).Methods(http.MethodGet)
+	r.HandleFunc(fmt.Sprintf("%s/{userID}/username", configs.AccountsPath), s.HandleSetUsername).Methods(http.MethodPut)
+	r.HandleFunc(fmt.Sprintf("%s/{userID}/devices", configs.AccountsPath), s.HandleReserveDevice).Methods(http.MethodPost)
+	r.HandleFunc(fmt.Sprintf("%s/{username}", configs.UsernamesPath), s.HandleResolveUsername).Methods(http.MethodGet)
+	r.HandleFunc(configs.DirectoryPath, s.HandleDirectory).Methods(http.MethodPost)
+	r.HandleFunc(configs.ProvisioningPath, s.HandleProvisioning)
+	r.HandleFunc(configs.MetricsPath, s.HandleMetrics).Methods(http.MethodGet)
+	r.HandleFunc(configs.HealthPath, s.HandleHealth).Methods(http.MethodGet)
+	r.HandleFunc(configs.ReadyPath, s.HandleReady).Methods(http.MethodGet)
+	r.HandleFunc(fmt.Sprintf("%s/{code}", configs.ProvisioningPath), s.HandlePostProvisioning).Methods(http.MethodPost)
 
-	logger.Infof("WebSocket server running on %s", configs.ServerAddress)
-	if err := http.ListenAndServe(configs.ServerAddress, r); err != nil {
-		logger.Fatalf("Error starting server: %v", err)
+	httpServer := &http.Server{
+		Addr:      config.ListenAddress,
+		Handler:   r,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
 	}
+	go func() {
+		var err error
+		if config.DisableTLS {
+			logger.Warnf("TLS is disabled, keys and message metadata are sent in the clear")
+			logger.Infof("WebSocket server running on ws://%s", config.ListenAddress)
+			err = httpServer.ListenAndServe()
+		} else {
+			logger.Infof("WebSocket server running on wss://%s", config.ListenAddress)
+			err = httpServer.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	// Run until SIGINT or SIGTERM, a second signal kills the server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
 
 	logger.Info("Closing server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	// Stop accepting connections and finish the HTTP requests, then drain the WebSocket connections
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("Error shutting down HTTP server: %v", err)
+	}
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("Error draining WebSocket connections: %v", err)
+	}
+	logger.Info("Server closed")
 }
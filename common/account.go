@@ -0,0 +1,193 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"minimal-signal/crypto/key_ed25519"
+	"minimal-signal/crypto/signer_schnorr"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions on an account, each signed with its identity key in an AccountRequest
+const (
+	AccountRegister   = "register"
+	AccountUnregister = "unregister"
+	// AccountRevokeDevice removes the keys of one device, e.g. a lost one
+	AccountRevokeDevice = "revoke"
+	// AccountSetUsername sets or changes the username of the account to AccountRequest.Username
+	AccountSetUsername = "username"
+	// AccountPublishKeys publishes the prekey bundle of a device, see PublishKeysRequest
+	AccountPublishKeys = "keys"
+	// AccountReserveDevice reserves the ID of a device being linked, replied in a DeviceReservation
+	AccountReserveDevice = "device"
+	// AccountConnect opens the WebSocket connection of a device to talk to a peer, see SignConnectRequest
+	AccountConnect = "connect"
+)
+
+var (
+	// ErrAccountRequestExpired is returned by AccountRequest.Verify for requests signed too long ago, or in the future
+	ErrAccountRequestExpired = errors.New("account request expired")
+	ErrInvalidUsername       = errors.New("usernames are 1 to 32 letters, digits, '.', '_' or '-'")
+	// ErrInvalidConnectQuery is returned by ParseConnectQuery for a query without a valid timestamp or signature
+	ErrInvalidConnectQuery = errors.New("invalid timestamp or signature in the connection query")
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9._-]{1,32}$`)
+
+// An account is identified by an ID derived from its identity key, which routes its messages and is shown in
+// safety numbers. Its username is an alias resolved by the server, which may change.
+
+// Account is what the server knows of an account
+type Account struct {
+	ID       string `json:"account_id"`
+	Username string `json:"username,omitempty"`
+}
+
+// AccountID returns the ID of the account with this identity key: the first 16 bytes of a SHA-256 hash, in hex
+func AccountID(identityKey key_ed25519.PublicKey) string {
+	hash := sha256.Sum256(append([]byte("minimal-signal-account-id:"), identityKey[:]...))
+	return hex.EncodeToString(hash[:16])
+}
+
+// NormalizeUsername returns the form usernames are stored and compared in: lower case, so that Alice and alice
+// are the same user
+func NormalizeUsername(username string) string {
+	return strings.ToLower(username)
+}
+
+// ValidateUsername returns the normalized username, or ErrInvalidUsername if it has characters that are not
+// allowed or is too long
+func ValidateUsername(username string) (string, error) {
+	username = NormalizeUsername(username)
+	if !usernamePattern.MatchString(username) {
+		return "", ErrInvalidUsername
+	}
+	return username, nil
+}
+
+// DeviceReservation is the device ID the server reserved for a device being linked, never given out again
+type DeviceReservation struct {
+	DeviceID DeviceID `json:"device_id"`
+}
+
+// AccountRequest authenticates an action on an account: its signature over the action, the user,
+// the device and the time proves that the sender holds the identity key of the account
+type AccountRequest struct {
+	// IdentityKey is the public identity key of the account, only read when registering it
+	IdentityKey key_ed25519.PublicKey `json:"identity_key"`
+	// Timestamp is the Unix time of the request, old requests are refused so that they cannot be replayed later
+	Timestamp int64 `json:"timestamp" validate:"required"`
+	// Username is the new username of an AccountSetUsername request
+	Username  string `json:"username,omitempty"`
+	Signature []byte `json:"signature" validate:"required"`
+}
+
+// PublishKeysRequest publishes the prekey bundle of a device. The signature covers a hash of the bundle, so that
+// a bundle fetched from the server cannot be published again for another device, or later to roll a device back.
+type PublishKeysRequest struct {
+	AccountRequest
+	// Bundle is the JSON encoded alice.BobPublicPrekeyBundle, hashed as is
+	Bundle json.RawMessage `json:"bundle" validate:"required"`
+}
+
+// accountChallenge returns the data signed in an AccountRequest. subject is the username of AccountSetUsername
+// requests, the hash of the bundle of AccountPublishKeys requests and the peer of AccountConnect requests.
+func accountChallenge(action string, userID string, deviceID DeviceID, timestamp int64, subject string) []byte {
+	return []byte(fmt.Sprintf("minimal-signal-account:%s:%s:%d:%d:%s", action, userID, deviceID, timestamp, subject))
+}
+
+// bundleHash returns the subject of the signature of a PublishKeysRequest
+func bundleHash(bundle []byte) string {
+	hash := sha256.Sum256(bundle)
+	return hex.EncodeToString(hash[:])
+}
+
+// SignAccountRequest returns a request for an action on an account, deviceID is 0 for actions on every device
+func SignAccountRequest(identityKey key_ed25519.PrivateKey, action string, userID string, deviceID DeviceID) (*AccountRequest, error) {
+	return signAccountRequest(identityKey, action, userID, deviceID, "", "")
+}
+
+// SignUsernameRequest returns a request setting the username of an account
+func SignUsernameRequest(identityKey key_ed25519.PrivateKey, userID string, username string) (*AccountRequest, error) {
+	return signAccountRequest(identityKey, AccountSetUsername, userID, 0, username, username)
+}
+
+// SignPublishKeysRequest returns a request publishing bundle, the JSON encoded prekey bundle of a device
+func SignPublishKeysRequest(identityKey key_ed25519.PrivateKey, userID string, deviceID DeviceID, bundle []byte) (*PublishKeysRequest, error) {
+	request, err := signAccountRequest(identityKey, AccountPublishKeys, userID, deviceID, "", bundleHash(bundle))
+	if err != nil {
+		return nil, err
+	}
+	return &PublishKeysRequest{AccountRequest: *request, Bundle: bundle}, nil
+}
+
+// SignConnectRequest returns a request opening the WebSocket connection of a device to talk to peer, sent in
+// the query of the connection, see ConnectQuery
+func SignConnectRequest(identityKey key_ed25519.PrivateKey, userID string, deviceID DeviceID, peer string) (*AccountRequest, error) {
+	return signAccountRequest(identityKey, AccountConnect, userID, deviceID, "", peer)
+}
+
+func signAccountRequest(identityKey key_ed25519.PrivateKey, action string, userID string, deviceID DeviceID, username string, subject string) (*AccountRequest, error) {
+	publicKey, err := identityKey.Public()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public identity key: %w", err)
+	}
+	timestamp := time.Now().Unix()
+	signature, err := signer_schnorr.Sign(identityKey, accountChallenge(action, userID, deviceID, timestamp, subject))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign account request: %w", err)
+	}
+	return &AccountRequest{IdentityKey: *publicKey, Timestamp: timestamp, Username: username, Signature: signature}, nil
+}
+
+// Verify checks that the request was signed with identityKey for this action, less than maxAge ago
+func (r *AccountRequest) Verify(identityKey key_ed25519.PublicKey, action string, userID string, deviceID DeviceID, maxAge time.Duration) error {
+	return r.verify(identityKey, action, userID, deviceID, r.Username, maxAge)
+}
+
+// Verify checks that the request was signed with identityKey for this bundle and device, less than maxAge ago
+func (r *PublishKeysRequest) Verify(identityKey key_ed25519.PublicKey, userID string, deviceID DeviceID, maxAge time.Duration) error {
+	return r.verify(identityKey, AccountPublishKeys, userID, deviceID, bundleHash(r.Bundle), maxAge)
+}
+
+// VerifyConnect checks that the request was signed with identityKey for a connection of the device to peer,
+// less than maxAge ago
+func (r *AccountRequest) VerifyConnect(identityKey key_ed25519.PublicKey, userID string, deviceID DeviceID, peer string, maxAge time.Duration) error {
+	return r.verify(identityKey, AccountConnect, userID, deviceID, peer, maxAge)
+}
+
+// ConnectQuery returns the query parameters of a WebSocket connection authenticated by an AccountConnect request
+func (r *AccountRequest) ConnectQuery() url.Values {
+	return url.Values{
+		"timestamp": {strconv.FormatInt(r.Timestamp, 10)},
+		"signature": {base64.RawURLEncoding.EncodeToString(r.Signature)},
+	}
+}
+
+// ParseConnectQuery returns the AccountConnect request in the query of a WebSocket connection, see ConnectQuery
+func ParseConnectQuery(query url.Values) (*AccountRequest, error) {
+	timestamp, err := strconv.ParseInt(query.Get("timestamp"), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidConnectQuery
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get("signature"))
+	if err != nil || len(signature) == 0 {
+		return nil, ErrInvalidConnectQuery
+	}
+	return &AccountRequest{Timestamp: timestamp, Signature: signature}, nil
+}
+
+func (r *AccountRequest) verify(identityKey key_ed25519.PublicKey, action string, userID string, deviceID DeviceID, subject string, maxAge time.Duration) error {
+	if age := time.Since(time.Unix(r.Timestamp, 0)); age > maxAge || age < -maxAge {
+		return ErrAccountRequestExpired
+	}
+	return signer_schnorr.Verify(identityKey, accountChallenge(action, userID, deviceID, r.Timestamp, subject), r.Signature)
+}
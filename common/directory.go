@@ -0,0 +1,26 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// directoryHashSize is the number of bytes of the SHA-256 hash kept in directory queries
+const directoryHashSize = 10
+
+// DirectoryRequest asks the server which users are registered, by the DirectoryHash of their ID
+type DirectoryRequest struct {
+	Hashes []string `json:"hashes" validate:"required"`
+}
+
+// DirectoryResponse lists the hashes of a DirectoryRequest that belong to registered users
+type DirectoryResponse struct {
+	Registered []string `json:"registered"`
+}
+
+// DirectoryHash returns how a user ID is looked up in the directory. It hides nothing from the server:
+// account IDs are not secret, and the server can hash every registered one.
+func DirectoryHash(userID string) string {
+	hash := sha256.Sum256([]byte("minimal-signal-directory:" + userID))
+	return hex.EncodeToString(hash[:directoryHashSize])
+}
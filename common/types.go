@@ -1,18 +1,54 @@
 package common
 
 import (
+	"fmt"
 	"minimal-signal/crypto/key_ed25519"
 	"minimal-signal/protocol/doubleratchet"
+	"minimal-signal/protocol/x3dh/alice"
+	"strconv"
 )
 
-// MessageBundle struct for sending/receiving JSON
+// DeviceID identifies one of the devices of a user, all of them sharing the user's identity key
+type DeviceID uint32
+
+// PrimaryDeviceID is the device a user registers with
+const PrimaryDeviceID DeviceID = 1
+
+// ParseDeviceID parses a device ID from its decimal representation
+func ParseDeviceID(s string) (DeviceID, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid device ID %q: %w", s, err)
+	}
+	if id == 0 {
+		return 0, fmt.Errorf("invalid device ID %q: must be positive", s)
+	}
+	return DeviceID(id), nil
+}
+
+// DevicePrekeyBundle is the public prekey bundle published by one device
+type DevicePrekeyBundle struct {
+	DeviceID DeviceID                    `json:"device_id" validate:"required"`
+	Bundle   alice.BobPublicPrekeyBundle `json:"bundle" validate:"required"`
+}
+
+// MessageBundle struct for sending/receiving JSON.
+// Each message is encrypted for a single device, so the sender sends one per device of the recipient
+// and one per other device of its own to keep them in sync.
 type MessageBundle struct {
-	From      string               `json:"from" validate:"required"`
-	To        string               `json:"to" validate:"required"`
-	Message   []byte               `json:"message" validate:"required"`
-	Header    doubleratchet.Header `json:"header" validate:"required"`
-	AD        [64]byte             `json:"ad" validate:"required"`
-	Handshake *X3DHHandshakeBundle `json:"handshake,omitempty"`
+	From       string               `json:"from" validate:"required"`
+	FromDevice DeviceID             `json:"from_device" validate:"required"`
+	To         string               `json:"to" validate:"required"`
+	ToDevice   DeviceID             `json:"to_device" validate:"required"`
+	Message    []byte               `json:"message" validate:"required"`
+	Header     doubleratchet.Header `json:"header" validate:"required"`
+	AD         [64]byte             `json:"ad" validate:"required"`
+	Handshake  *X3DHHandshakeBundle `json:"handshake,omitempty"`
+	// ExpireTimer is the disappearing message timer of the content in seconds, 0 if it does not expire.
+	// The server drops the message if it could not be delivered in time.
+	ExpireTimer uint32 `json:"expire_timer,omitempty"`
+	// Ephemeral messages, like typing indicators, are only delivered to connected devices and never queued
+	Ephemeral bool `json:"ephemeral,omitempty"`
 }
 
 // X3DHHandshakeBundle is sent in Alice's first message
@@ -20,3 +56,88 @@ type X3DHHandshakeBundle struct {
 	EphPubKey     key_ed25519.PublicKey  `json:"eph_pub_key" validate:"required"`
 	OneTimePubKey *key_ed25519.PublicKey `json:"one_time_pub_key" validate:"required"`
 }
+
+// Equals reports whether both handshakes carry the same keys, i.e. start the same session
+func (h *X3DHHandshakeBundle) Equals(other *X3DHHandshakeBundle) bool {
+	if h == nil || other == nil {
+		return false
+	}
+	if !h.EphPubKey.Equals(&other.EphPubKey) {
+		return false
+	}
+	if h.OneTimePubKey == nil || other.OneTimePubKey == nil {
+		return h.OneTimePubKey == nil && other.OneTimePubKey == nil
+	}
+	return h.OneTimePubKey.Equals(other.OneTimePubKey)
+}
+
+// ErrorReply is sent by the server instead of a MessageBundle when it could not handle a message,
+// or to tell that the account of a peer is gone
+type ErrorReply struct {
+	Code     string   `json:"error" validate:"required"`
+	To       string   `json:"to"`
+	ToDevice DeviceID `json:"to_device"`
+	// RetryAfter is the number of seconds to wait before retrying, for ErrorRateLimited
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// Error codes of ErrorReply
+const (
+	// ErrorQueueFull means the recipient device is offline and too many messages are waiting for it
+	ErrorQueueFull = "queue_full"
+	// ErrorRateLimited means the client sent too many requests, it is also the reason of the close frame
+	// of WebSocket connections closed for sending too many messages
+	ErrorRateLimited = "rate_limited"
+	// ErrorInternal means the server failed to handle the message
+	ErrorInternal = "internal"
+	// ErrorAccountDeleted means the user To deleted their account. It is the reply to messages sent to them,
+	// and is also sent to the peers connected when the account is deleted.
+	ErrorAccountDeleted = "account_deleted"
+)
+
+// CloseReasonReconnect is the reason of the close frame, with the CloseServiceRestart code, sent to the clients
+// of a server shutting down. They may reconnect, messages to them are kept in their offline queue meanwhile.
+const CloseReasonReconnect = "reconnect"
+
+// ContentType tells the receiver how to interpret a decrypted Content
+type ContentType int
+
+const (
+	// ContentText is a regular chat message
+	ContentText ContentType = iota
+	// ContentEndSession is sent through the current session right before the sender discards it
+	ContentEndSession
+	// ContentSessionReset is the first message of a session started to replace a lost or corrupted one
+	ContentSessionReset
+	// ContentExpireTimerUpdate sets the disappearing message timer of the conversation to ExpireTimer
+	ContentExpireTimerUpdate
+	// ContentTyping tells whether the sender is Typing, sent in ephemeral messages
+	ContentTyping
+	// ContentPresence tells whether the sender is Online, or when it was LastSeen, sent in ephemeral messages.
+	// Both are unset if the sender does not share its presence.
+	ContentPresence
+	// ContentEdit replaces the Body of the message Target, sent by its author
+	ContentEdit
+	// ContentDelete deletes the message Target for everyone, sent by its author
+	ContentDelete
+	// ContentReaction sets the Reaction of the sender to the message Target, removing it if empty
+	ContentReaction
+)
+
+// Content is the plaintext carried inside MessageBundle.Message
+type Content struct {
+	Type ContentType `json:"type"`
+	// ID identifies a ContentText message, referred to as the Target of its edits, deletes and reactions,
+	// together with the account ID of its author
+	ID           string `json:"id,omitempty"`
+	Target       string `json:"target,omitempty"`
+	TargetAuthor string `json:"target_author,omitempty"`
+	Body         string `json:"body,omitempty"`
+	// ExpireTimer is the disappearing message timer of the conversation in seconds, 0 if messages do not expire
+	ExpireTimer uint32 `json:"expire_timer,omitempty"`
+	Typing      bool   `json:"typing,omitempty"`
+	Online      bool   `json:"online,omitempty"`
+	// LastSeen is the Unix time the sender went offline
+	LastSeen int64  `json:"last_seen,omitempty"`
+	Reaction string `json:"reaction,omitempty"`
+}
@@ -0,0 +1,89 @@
+package configs
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"minimal-signal/crypto/tlscert"
+	"net"
+	"os"
+)
+
+// ClientConfig holds the settings of the client
+type ClientConfig struct {
+	ServerAddress string `yaml:"server_address"`
+	// RedisAddress is the Redis server the client stores its sessions and history in
+	RedisAddress string `yaml:"redis_address"`
+	// SecretDir is the directory of the key files of the devices
+	SecretDir string `yaml:"secret_dir"`
+
+	// DisableTLS connects to the server over plain HTTP and WebSocket, for a server run with TLS disabled
+	DisableTLS bool `yaml:"disable_tls"`
+	// CACertFile is a PEM file of the certificates to trust instead of the system ones, e.g. a self-signed
+	// development certificate
+	CACertFile string `yaml:"ca_cert_file"`
+	// PinnedKeys are the pins of the public keys the server certificate may have, see tlscert.Pin.
+	// Any trusted certificate is accepted if empty. Without CACertFile, a pinned certificate is trusted as is.
+	PinnedKeys []string `yaml:"pinned_keys"`
+
+	// TypingIndicators tells the recipient when the user is typing
+	TypingIndicators bool `yaml:"typing_indicators"`
+	// SharePresence tells the recipient when the user is online, or when it was last seen.
+	// It can also be turned off while chatting with /presence off.
+	SharePresence bool `yaml:"share_presence"`
+}
+
+// DefaultClientConfig returns the settings used when nothing else is configured
+func DefaultClientConfig() *ClientConfig {
+	return &ClientConfig{
+		ServerAddress:    "localhost:8080",
+		RedisAddress:     "localhost:6379",
+		SecretDir:        "secrets",
+		TypingIndicators: true,
+		SharePresence:    true,
+	}
+}
+
+// LoadClientConfig loads the settings of the client over the defaults, see load.
+// Flags of the caller may already be defined in fs.
+func LoadClientConfig(fs *flag.FlagSet, args []string) (*ClientConfig, error) {
+	cfg := DefaultClientConfig()
+	if err := load(cfg, fs, args, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *ClientConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ServerAddress, "server-address", c.ServerAddress, "address of the server")
+	fs.StringVar(&c.RedisAddress, "redis-address", c.RedisAddress, "address of the Redis server storing the client state")
+	fs.StringVar(&c.SecretDir, "secret-dir", c.SecretDir, "directory of the key files")
+	fs.BoolVar(&c.DisableTLS, "disable-tls", c.DisableTLS, "connect to the server without TLS, for development only")
+	fs.StringVar(&c.CACertFile, "ca-cert", c.CACertFile, "PEM file of the certificates to trust instead of the system ones")
+	fs.Var((*stringList)(&c.PinnedKeys), "pinned-keys", "comma-separated pins of the public keys the server certificate may have")
+	fs.BoolVar(&c.TypingIndicators, "typing-indicators", c.TypingIndicators, "tell the recipient when you are typing")
+	fs.BoolVar(&c.SharePresence, "share-presence", c.SharePresence, "tell the recipient when you are online or were last seen")
+}
+
+// Validate checks that the settings are usable
+func (c *ClientConfig) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.ServerAddress); err != nil {
+		errs = append(errs, fmt.Errorf("invalid server address: %w", err))
+	}
+	if _, _, err := net.SplitHostPort(c.RedisAddress); err != nil {
+		errs = append(errs, fmt.Errorf("invalid Redis address: %w", err))
+	}
+	if c.SecretDir == "" {
+		errs = append(errs, errors.New("secret directory must be set"))
+	}
+	if c.DisableTLS && (c.CACertFile != "" || len(c.PinnedKeys) > 0) {
+		errs = append(errs, errors.New("CA certificate and pinned keys require TLS"))
+	}
+	for _, pin := range c.PinnedKeys {
+		if !tlscert.ValidPin(pin) {
+			errs = append(errs, fmt.Errorf("invalid pinned key %q, expected the base64 SHA-256 of a public key", pin))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -1,21 +1,98 @@
 package configs
 
+import "time"
+
+// Settings that depend on the deployment are in ServerConfig and ClientConfig.
+// The ones below are part of the protocol or of the storage format, and are the same everywhere.
+
 var (
-	HKDFInfo        = []byte("minimal-signal")
-	ServerAddress   = "localhost:8080"
-	RedisAddress    = "localhost:6379"
-	PublishKeysPath = "/keys"
-	WebSocketPath   = "/ws"
+	HKDFInfo = []byte("minimal-signal")
+)
+
+const (
+	PublishKeysPath  = "/keys"
+	WebSocketPath    = "/ws"
+	ProvisioningPath = "/provision"
+	MetricsPath      = "/metrics"
+	HealthPath       = "/healthz"
+	ReadyPath        = "/readyz"
+	DirectoryPath    = "/directory"
+	AccountsPath     = "/accounts"
+	UsernamesPath    = "/usernames"
 
 	// Redis keys
 
-	ClientRatchetKey       = "client:ratchet:%s:%s"
-	ClientMessagesKey      = "client:messages:%s:%s"
-	ClientInitHandshakeKey = "client:initHandshake:%s:%s"
-	ServerMessageQueueKey  = "server:messages:%s:%s"
-	ServerUserPubKey       = "publicKey:%s"
+	ClientSessionsKey          = "client:sessions:%s:%d:%s:%d"
+	ClientIdentityKey          = "client:identity:%s:%d:%s"
+	ClientHistoryKey           = "client:history:%s:%d:%s"
+	ClientExpireTimerKey       = "client:expireTimer:%s:%d:%s"
+	ClientSeenHandshakesKey    = "client:seenHandshakes:%s:%d:%s:%d"
+	ClientOutboxKey            = "client:outbox:%s:%d:%s"
+	ClientContactsKey          = "client:contacts:%s:%d"
+	ClientUsernamesKey         = "client:usernames:%s:%d"
+	ServerMailboxKey           = "server:mailbox:%s:%d:%s"
+	ServerMessageQueueBytesKey = "server:messageBytes:%s:%d:%s"
+	ServerQueuesKey            = "server:queues:%s:%d"
+	ServerUserPubKey           = "publicKey:%s:%d"
+	ServerUserDevicesKey       = "devices:%s"
+	ServerLastDeviceKey        = "server:lastDevice:%s"
+	ServerDirectoryKey         = "server:directory"
+	ServerAccountKey           = "server:account:%s"
+	ServerAccountUsernameKey   = "server:accountUsername:%s"
+	ServerUsernameKey          = "server:username:%s"
+	ServerAccountsChannel      = "server:accounts"
+	ServerAccountRequestKey    = "server:accountRequest:%s"
+	ServerPresenceKey          = "server:presence:%s:%d:%s"
+	ServerDeliveryChannel      = "server:deliver:%s:%d:%s"
+	ServerProvisioningKey      = "server:provisioning:%s"
+	ServerProvisioningChannel  = "server:provision:%s"
 
-	ForwardDHRatchetChanceTotal = 20
+	// Keys of the baseline, before multi-device support and account IDs, only read to migrate them. They are
+	// named after usernames.
+
+	LegacyClientRatchetKey       = "client:ratchet:%s:%s"
+	LegacyClientInitHandshakeKey = "client:initHandshake:%s:%s"
+	LegacyClientMessagesKey      = "client:messages:%s:%s"
+	// Offline queue of the server before mailboxes, a list per sender and recipient username
+	LegacyServerMessageQueueKey = "server:messages:%s:%s"
 
-	DebugSecretDir = "secrets"
+	ForwardDHRatchetChanceTotal = 20
+	// SessionResetThreshold is the number of consecutive undecryptable messages after which
+	// the client gives up on the current session and starts a new one
+	SessionResetThreshold = 3
+	// MaxSessionsPerPeer is the number of sessions kept per peer, the active one and candidates
+	// that messages sent before both sides converged on a session may still be encrypted with
+	MaxSessionsPerPeer = 4
+	// MaxSeenHandshakes is the number of peer handshakes remembered to reject them if they are sent again
+	MaxSeenHandshakes = 32
+	// MinLogHashKeySize is the minimum size in bytes of the key user IDs and IP addresses are hashed with in logs
+	MinLogHashKeySize = 16
+	// MaxOutbox is the number of messages the client keeps while it cannot send them, it refuses more
+	MaxOutbox = 1000
+	// MaxDirectoryHashes is the number of users a directory request may look up
+	MaxDirectoryHashes = 100
+	// AccountRequestMaxAge is how long a signed account request is accepted, the server refuses it a second time
+	AccountRequestMaxAge = 5 * time.Minute
+	// ExpireCheckInterval is how often disappearing messages are checked for expiry
+	ExpireCheckInterval = time.Second
+	// ReconnectMinDelay and ReconnectMaxDelay bound the delay before the client connects again to the server,
+	// which doubles after each failed attempt
+	ReconnectMinDelay = time.Second
+	ReconnectMaxDelay = time.Minute
+	// ClientReadTimeout is how long the client waits for a message or a ping from the server before it reconnects,
+	// longer than the ping interval of the server
+	ClientReadTimeout = 2 * time.Minute
+	// ClientWriteTimeout is how long sending a message may take before the client reconnects
+	ClientWriteTimeout = 10 * time.Second
+	// TypingInterval is how often a typing indicator is sent again while the user types, and how long after
+	// the last keystroke the client tells that the user stopped
+	TypingInterval = 5 * time.Second
+	// TypingTimeout is how long a typing indicator is shown without being sent again
+	TypingTimeout = 3 * TypingInterval
+	// PresenceInterval is how often an online user tells it again, while its peer is online too
+	PresenceInterval = time.Minute
+	// PresenceTimeout is how long a peer is shown online without telling it again, it was last seen then
+	PresenceTimeout = 3 * PresenceInterval
+	// ActivityCheckInterval is how often typing and presence are checked for expiry
+	ActivityCheckInterval = time.Second
 )
@@ -0,0 +1,110 @@
+package configs
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variable of each setting, e.g. MINIMAL_SIGNAL_REDIS_ADDRESS for -redis-address
+const EnvPrefix = "MINIMAL_SIGNAL_"
+
+// config is a typed configuration, holding its defaults before it is loaded
+type config interface {
+	// bindFlags defines a flag for each setting, with the current value as default
+	bindFlags(fs *flag.FlagSet)
+	Validate() error
+}
+
+// stringList is a flag of comma-separated values
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable of the setting of a flag
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// load fills cfg from, by increasing priority: a YAML file, environment variables and the flags in args.
+// The file is given by the -config flag or the MINIMAL_SIGNAL_CONFIG environment variable.
+// fs may already define flags of the caller, their values and the remaining arguments are in fs after load.
+func load(cfg config, fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) error {
+	configPath := fs.String("config", "", "path of a YAML config file")
+	cfg.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// Flags are applied again over the file and the environment
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	path := *configPath
+	if path == "" {
+		path, _ = lookupEnv(envName("config"))
+	}
+	if path != "" {
+		if err := loadFile(cfg, path); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookupEnv(envName(f.Name))
+		if !ok || f.Name == "config" {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %w", value, envName(f.Name), err))
+		}
+	})
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for name, value := range explicit {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return cfg.Validate()
+}
+
+// loadFile decodes the YAML file at path into cfg. Settings missing from the file keep their value.
+func loadFile(cfg config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to decode config file %s: %w", path, err)
+	}
+	return nil
+}
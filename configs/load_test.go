@@ -0,0 +1,99 @@
+package configs
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+listen_address: 0.0.0.0:9000
+redis_address: redis:6379
+queue_ttl: 48h
+message_rate_limit:
+  per_second: 5
+  burst: 10
+`)
+	env := fakeEnv(map[string]string{
+		"MINIMAL_SIGNAL_CONFIG":        path,
+		"MINIMAL_SIGNAL_REDIS_ADDRESS": "env-redis:6379",
+		"MINIMAL_SIGNAL_QUEUE_TTL":     "24h",
+	})
+
+	cfg := DefaultServerConfig()
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	require.NoError(t, load(cfg, fs, []string{"-queue-ttl", "1h"}, env))
+
+	// Flags win over the environment, which wins over the file, which wins over the defaults
+	assert.Equal(t, time.Hour, cfg.QueueTTL)
+	assert.Equal(t, "env-redis:6379", cfg.RedisAddress)
+	assert.Equal(t, "0.0.0.0:9000", cfg.ListenAddress)
+	assert.Equal(t, RateLimit{PerSecond: 5, Burst: 10}, cfg.MessageRateLimit)
+	assert.Equal(t, DefaultServerConfig().MaxQueueLength, cfg.MaxQueueLength)
+}
+
+func TestLoadCallerFlags(t *testing.T) {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	link := fs.Bool("link", false, "")
+
+	cfg := DefaultClientConfig()
+	require.NoError(t, load(cfg, fs, []string{"-link", "-secret-dir", "keys", "alice"}, fakeEnv(nil)))
+	assert.True(t, *link)
+	assert.Equal(t, "keys", cfg.SecretDir)
+	assert.Equal(t, []string{"alice"}, fs.Args())
+}
+
+func TestLoadInvalid(t *testing.T) {
+	loadServer := func(args []string, env map[string]string) error {
+		return load(DefaultServerConfig(), flag.NewFlagSet("server", flag.ContinueOnError), args, fakeEnv(env))
+	}
+
+	assert.Error(t, loadServer([]string{"-queue-ttl", "0s"}, nil))
+	assert.Error(t, loadServer([]string{"-listen-address", "8080"}, nil))
+	assert.Error(t, loadServer([]string{"-tls-cert", ""}, nil))
+	assert.NoError(t, loadServer([]string{"-tls-cert", "", "-disable-tls"}, nil))
+	assert.Error(t, loadServer(nil, map[string]string{"MINIMAL_SIGNAL_MAX_QUEUE_LENGTH": "many"}))
+	assert.Error(t, loadServer([]string{"-log-hash-key", "not hex"}, nil))
+	assert.Error(t, loadServer([]string{"-log-hash-key", "0011"}, nil), "too short")
+	// Unknown settings in the file are rejected rather than ignored
+	assert.Error(t, loadServer([]string{"-config", writeConfigFile(t, "queue_tll: 1h\n")}, nil))
+	assert.Error(t, loadServer([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, nil))
+}
+
+func TestLoadPinnedKeys(t *testing.T) {
+	pin := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	cfg := DefaultClientConfig()
+	require.NoError(t, load(cfg, flag.NewFlagSet("client", flag.ContinueOnError), nil,
+		fakeEnv(map[string]string{"MINIMAL_SIGNAL_PINNED_KEYS": pin + ", " + pin})))
+	assert.Equal(t, []string{pin, pin}, cfg.PinnedKeys)
+
+	assert.Error(t, load(DefaultClientConfig(), flag.NewFlagSet("client", flag.ContinueOnError),
+		[]string{"-pinned-keys", "not-a-pin"}, fakeEnv(nil)))
+	assert.Error(t, load(DefaultClientConfig(), flag.NewFlagSet("client", flag.ContinueOnError),
+		[]string{"-pinned-keys", pin, "-disable-tls"}, fakeEnv(nil)))
+}
+
+func TestExampleConfig(t *testing.T) {
+	cfg := DefaultServerConfig()
+	require.NoError(t, loadFile(cfg, "server.example.yaml"))
+	assert.Equal(t, DefaultServerConfig(), cfg)
+}
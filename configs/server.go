@@ -0,0 +1,219 @@
+package configs
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ServerConfig holds the settings of the server
+type ServerConfig struct {
+	// ListenAddress is the address the server listens on
+	ListenAddress string `yaml:"listen_address"`
+	RedisAddress  string `yaml:"redis_address"`
+
+	// TLSCertFile and TLSKeyFile are the PEM files of the certificate and key the server serves HTTPS and WSS with
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+	// DisableTLS serves plain HTTP and WebSocket instead, only for development behind a trusted network
+	DisableTLS bool `yaml:"disable_tls"`
+	// WriteTimeout is how long writing a frame to a device may take before its connection is dropped
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// PongTimeout is how long a device may take to answer a ping before its connection is dropped.
+	// Devices are pinged every 9/10 of it.
+	PongTimeout time.Duration `yaml:"pong_timeout"`
+	// PresenceTTL is how long the presence of a device in Redis outlives its server if it stops without
+	// cleaning up. Other servers route messages to the device until then, which are queued instead.
+	PresenceTTL time.Duration `yaml:"presence_ttl"`
+	// SendBufferSize is the number of messages waiting to be written to a device. A device that lets more wait
+	// is disconnected, its messages are queued.
+	SendBufferSize int `yaml:"send_buffer_size"`
+	// ShutdownTimeout is how long the server waits for clients to disconnect when it shuts down
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// ProvisioningTimeout is how long a new device waits to be linked by an existing one
+	ProvisioningTimeout time.Duration `yaml:"provisioning_timeout"`
+
+	// QueueTTL is how long messages wait for an offline device before they are dropped
+	QueueTTL time.Duration `yaml:"queue_ttl"`
+	// MaxQueueLength and MaxQueueBytes limit the messages queued for an offline device, from all peers
+	MaxQueueLength int64 `yaml:"max_queue_length"`
+	MaxQueueBytes  int64 `yaml:"max_queue_bytes"`
+	// MailboxPageSize is the number of queued messages read from Redis at a time when a device connects
+	MailboxPageSize int64 `yaml:"mailbox_page_size"`
+
+	// Rate limits, applied per IP address, and per signing account or per WebSocket connection for messages
+	KeyFetchRateLimit   RateLimit `yaml:"key_fetch_rate_limit"`
+	KeyPublishRateLimit RateLimit `yaml:"key_publish_rate_limit"`
+	MessageRateLimit    RateLimit `yaml:"message_rate_limit"`
+	// DirectoryRateLimit counts the users looked up in the directory, not the requests. It is only applied per
+	// IP address, directory requests are not tied to a user.
+	DirectoryRateLimit RateLimit `yaml:"directory_rate_limit"`
+	// ProvisioningRateLimit counts the new devices waiting to be linked and the envelopes sent to them, per IP
+	// address only, so that codes cannot be guessed
+	ProvisioningRateLimit RateLimit `yaml:"provisioning_rate_limit"`
+	// RateLimitIdleTimeout is how long the rate limit of an unused user or IP address is remembered
+	RateLimitIdleTimeout time.Duration `yaml:"rate_limit_idle_timeout"`
+
+	// LogLevel is the lowest level logged: debug, info, warning or error
+	LogLevel string `yaml:"log_level"`
+	// LogFormat is text, or json for one JSON object per line
+	LogFormat string `yaml:"log_format"`
+	// LogHashUserIDs replaces user IDs and IP addresses in logs with a keyed hash
+	LogHashUserIDs bool `yaml:"log_hash_user_ids"`
+	// LogHashKey is the key of the hash in hex, the same on every server so that their logs can be correlated,
+	// also across restarts. If it is empty a random key is used, hashes then change when the server restarts.
+	LogHashKey string `yaml:"log_hash_key"`
+	// LogMessageDumps logs the metadata of every message and published or fetched key bundle at debug level.
+	// Key material and ciphertext are never logged.
+	LogMessageDumps bool `yaml:"log_message_dumps"`
+}
+
+// RateLimit is a token bucket: PerSecond tokens are added every second, up to Burst
+type RateLimit struct {
+	PerSecond float64 `yaml:"per_second"`
+	Burst     int     `yaml:"burst"`
+}
+
+// DefaultServerConfig returns the settings used when nothing else is configured
+func DefaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		ListenAddress:         "localhost:8080",
+		RedisAddress:          "localhost:6379",
+		TLSCertFile:           "secrets/server.crt",
+		TLSKeyFile:            "secrets/server.key",
+		WriteTimeout:          10 * time.Second,
+		PongTimeout:           time.Minute,
+		SendBufferSize:        64,
+		PresenceTTL:           time.Minute,
+		ShutdownTimeout:       30 * time.Second,
+		ProvisioningTimeout:   10 * time.Minute,
+		QueueTTL:              30 * 24 * time.Hour,
+		MaxQueueLength:        1000,
+		MaxQueueBytes:         16 << 20,
+		MailboxPageSize:       100,
+		KeyFetchRateLimit:     RateLimit{PerSecond: 1, Burst: 20},
+		KeyPublishRateLimit:   RateLimit{PerSecond: 0.1, Burst: 5},
+		MessageRateLimit:      RateLimit{PerSecond: 10, Burst: 50},
+		DirectoryRateLimit:    RateLimit{PerSecond: 1, Burst: MaxDirectoryHashes},
+		ProvisioningRateLimit: RateLimit{PerSecond: 0.1, Burst: 10},
+		RateLimitIdleTimeout:  10 * time.Minute,
+		LogLevel:              "info",
+		LogFormat:             "text",
+	}
+}
+
+// LoadServerConfig loads the settings of the server over the defaults, see load.
+// Flags of the caller may already be defined in fs.
+func LoadServerConfig(fs *flag.FlagSet, args []string) (*ServerConfig, error) {
+	cfg := DefaultServerConfig()
+	if err := load(cfg, fs, args, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *ServerConfig) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddress, "listen-address", c.ListenAddress, "address the server listens on")
+	fs.StringVar(&c.RedisAddress, "redis-address", c.RedisAddress, "address of the Redis server")
+	fs.StringVar(&c.TLSCertFile, "tls-cert", c.TLSCertFile, "PEM file of the TLS certificate")
+	fs.StringVar(&c.TLSKeyFile, "tls-key", c.TLSKeyFile, "PEM file of the TLS private key")
+	fs.BoolVar(&c.DisableTLS, "disable-tls", c.DisableTLS, "serve plain HTTP and WebSocket, for development only")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "how long writing to a device may take")
+	fs.DurationVar(&c.PongTimeout, "pong-timeout", c.PongTimeout, "how long a device may take to answer a ping")
+	fs.DurationVar(&c.PresenceTTL, "presence-ttl", c.PresenceTTL, "how long the presence of a device outlives a server that stopped without cleaning up")
+	fs.IntVar(&c.SendBufferSize, "send-buffer-size", c.SendBufferSize, "number of messages waiting to be written to a device before it is disconnected")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for clients to disconnect on shutdown")
+	fs.DurationVar(&c.ProvisioningTimeout, "provisioning-timeout", c.ProvisioningTimeout, "how long a new device waits to be linked")
+	fs.DurationVar(&c.QueueTTL, "queue-ttl", c.QueueTTL, "how long messages wait for an offline device")
+	fs.Int64Var(&c.MaxQueueLength, "max-queue-length", c.MaxQueueLength, "maximum number of messages queued for a device")
+	fs.Int64Var(&c.MaxQueueBytes, "max-queue-bytes", c.MaxQueueBytes, "maximum size of the messages queued for a device")
+	fs.Int64Var(&c.MailboxPageSize, "mailbox-page-size", c.MailboxPageSize, "number of queued messages read at a time when a device connects")
+	c.KeyFetchRateLimit.bindFlags(fs, "key-fetch", "key fetches")
+	c.KeyPublishRateLimit.bindFlags(fs, "key-publish", "key publishes")
+	c.MessageRateLimit.bindFlags(fs, "message", "messages")
+	c.DirectoryRateLimit.bindFlags(fs, "directory", "users looked up in the directory")
+	c.ProvisioningRateLimit.bindFlags(fs, "provisioning", "devices waiting to be linked and envelopes sent to them")
+	fs.DurationVar(&c.RateLimitIdleTimeout, "rate-limit-idle-timeout", c.RateLimitIdleTimeout, "how long the rate limit of an idle user or IP address is remembered")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "lowest level logged: debug, info, warning or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: text or json")
+	fs.BoolVar(&c.LogHashUserIDs, "log-hash-user-ids", c.LogHashUserIDs, "replace user IDs and IP addresses in logs with a hash")
+	fs.StringVar(&c.LogHashKey, "log-hash-key", c.LogHashKey, "key of the hash of user IDs and IP addresses in logs, in hex, random if empty")
+	fs.BoolVar(&c.LogMessageDumps, "log-message-dumps", c.LogMessageDumps, "log the metadata of every message and key bundle at debug level")
+}
+
+func (l *RateLimit) bindFlags(fs *flag.FlagSet, prefix string, what string) {
+	fs.Float64Var(&l.PerSecond, prefix+"-rate", l.PerSecond, what+" allowed per second, per IP address and per account or connection")
+	fs.IntVar(&l.Burst, prefix+"-burst", l.Burst, what+" allowed at once, per IP address and per account or connection")
+}
+
+// Validate checks that the settings are usable
+func (c *ServerConfig) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		errs = append(errs, fmt.Errorf("invalid listen address: %w", err))
+	}
+	if _, _, err := net.SplitHostPort(c.RedisAddress); err != nil {
+		errs = append(errs, fmt.Errorf("invalid Redis address: %w", err))
+	}
+	if !c.DisableTLS && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("TLS certificate and key files must be set unless TLS is disabled"))
+	}
+	for name, d := range map[string]time.Duration{
+		"write timeout":           c.WriteTimeout,
+		"pong timeout":            c.PongTimeout,
+		"presence TTL":            c.PresenceTTL,
+		"shutdown timeout":        c.ShutdownTimeout,
+		"provisioning timeout":    c.ProvisioningTimeout,
+		"queue TTL":               c.QueueTTL,
+		"rate limit idle timeout": c.RateLimitIdleTimeout,
+	} {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive", name))
+		}
+	}
+	if c.SendBufferSize < 1 {
+		errs = append(errs, errors.New("send buffer size must be positive"))
+	}
+	if c.MaxQueueLength <= 0 || c.MaxQueueBytes <= 0 {
+		errs = append(errs, errors.New("queue limits must be positive"))
+	}
+	if c.MailboxPageSize < 1 {
+		errs = append(errs, errors.New("mailbox page size must be positive"))
+	}
+	for name, l := range map[string]RateLimit{
+		"key fetch":    c.KeyFetchRateLimit,
+		"key publish":  c.KeyPublishRateLimit,
+		"message":      c.MessageRateLimit,
+		"directory":    c.DirectoryRateLimit,
+		"provisioning": c.ProvisioningRateLimit,
+	} {
+		if l.PerSecond <= 0 || l.Burst < 1 {
+			errs = append(errs, fmt.Errorf("%s rate limit must allow requests", name))
+		}
+	}
+	if c.DirectoryRateLimit.Burst < MaxDirectoryHashes {
+		errs = append(errs, fmt.Errorf("directory rate limit burst must allow a request of %d users", MaxDirectoryHashes))
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log level: %w", err))
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("invalid log format %q, must be text or json", c.LogFormat))
+	}
+	if key, err := hex.DecodeString(c.LogHashKey); err != nil || (c.LogHashKey != "" && len(key) < MinLogHashKeySize) {
+		errs = append(errs, fmt.Errorf("log hash key must be at least %d bytes in hex", MinLogHashKeySize))
+	}
+	return errors.Join(errs...)
+}
+
+// PingInterval returns how often devices are pinged, often enough for them to answer within PongTimeout
+func (c *ServerConfig) PingInterval() time.Duration {
+	return c.PongTimeout * 9 / 10
+}
@@ -0,0 +1,42 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	certPEM, keyPEM, err := Generate([]string{"localhost", "127.0.0.1"}, time.Hour)
+	require.NoError(t, err)
+
+	// The pair is usable by a TLS server
+	_, err = tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(certPEM)
+	require.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"localhost"}, cert.DNSNames)
+	require.Len(t, cert.IPAddresses, 1)
+	assert.True(t, cert.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
+
+	// Clients trusting the certificate itself accept it for its hosts only
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "localhost"})
+	assert.NoError(t, err)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "example.com"})
+	assert.Error(t, err)
+
+	pin := Pin(cert)
+	assert.True(t, ValidPin(pin))
+	assert.False(t, ValidPin(pin[:10]))
+}
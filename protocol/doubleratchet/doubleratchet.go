@@ -2,11 +2,15 @@ package doubleratchet
 
 import (
 	"minimal-signal/crypto/key_ed25519"
+	"slices"
 )
 
 const (
 	// maxSkip is the constant specifying the maximum number of message keys that can be skipped in a single chain
 	maxSkip = 1000
+	// maxSkippedKeys is the maximum number of skipped message keys kept across chains, the oldest ones are
+	// deleted beyond it
+	maxSkippedKeys = 2 * maxSkip
 )
 
 var (
@@ -131,7 +135,7 @@ func (dr *DoubleRatchet) Encrypt(plaintext []byte, associatedData []byte, forwar
 func (dr *DoubleRatchet) Decrypt(header Header, ciphertext []byte, associatedData []byte) ([]byte, error) {
 	var (
 		// If no error occurs, dr.CurrentState will be updated with newState
-		newState = *dr.CurrentState
+		newState = dr.CurrentState.clone()
 		mk       *MsgKey
 	)
 	// 1. Try to decrypt with skipped message keys
@@ -140,6 +144,7 @@ func (dr *DoubleRatchet) Decrypt(header Header, ciphertext []byte, associatedDat
 		return nil, err
 	}
 	if plaintext != nil {
+		dr.CurrentState = &newState
 		return plaintext, nil
 	}
 
@@ -172,15 +177,19 @@ func (dr *DoubleRatchet) Decrypt(header Header, ciphertext []byte, associatedDat
 	}
 	newState.Nr++
 
-	// 5. Update State
-	dr.CurrentState = &newState
-
-	// 6. Decrypt
+	// 5. Decrypt
 	adHeader, err := utils.concat(associatedData, header)
 	if err != nil {
 		return nil, err
 	}
-	return utils.decrypt(*mk, ciphertext, adHeader)
+	plaintext, err = utils.decrypt(*mk, ciphertext, adHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	// 6. Update State only once the message has been authenticated
+	dr.CurrentState = &newState
+	return plaintext, nil
 }
 
 // MaxSkip returns the constant specifying the maximum number of message keys that can be skipped in a single chain
@@ -201,25 +210,52 @@ func (dr *DoubleRatchet) skipMessageKeys(newState *State, until MsgIndex) error
 			if err != nil {
 				return err
 			}
-			newState.MkSkipped[MkSkippedKey{
+			key := MkSkippedKey{
 				RatchetPub: *newState.Dhr,
 				N:          newState.Nr,
-			}] = mk
+			}
+			newState.MkSkipped[key] = mk
+			newState.MkSkippedOrder = append(newState.MkSkippedOrder, key)
 			newState.Nr++
 		}
 	}
+	evictSkippedKeys(newState)
 	return nil
 }
 
+// evictSkippedKeys deletes the oldest skipped message keys once there are more than maxSkippedKeys,
+// the messages they were for are unlikely to ever arrive
+func evictSkippedKeys(newState *State) {
+	if len(newState.MkSkippedOrder) < len(newState.MkSkipped) {
+		// States saved before the order was kept: their keys are the oldest
+		ordered := make(map[MkSkippedKey]bool, len(newState.MkSkippedOrder))
+		for _, key := range newState.MkSkippedOrder {
+			ordered[key] = true
+		}
+		var older []MkSkippedKey
+		for key := range newState.MkSkipped {
+			if !ordered[key] {
+				older = append(older, key)
+			}
+		}
+		newState.MkSkippedOrder = append(older, newState.MkSkippedOrder...)
+	}
+	for len(newState.MkSkipped) > maxSkippedKeys {
+		delete(newState.MkSkipped, newState.MkSkippedOrder[0])
+		newState.MkSkippedOrder = newState.MkSkippedOrder[1:]
+	}
+}
+
 func trySkippedMessageKeys(newState *State, header *Header, ciphertext, AD []byte) ([]byte, error) {
-	if mk, exists := newState.MkSkipped[MkSkippedKey{
+	key := MkSkippedKey{
 		RatchetPub: header.RatchetPub,
 		N:          header.N,
-	}]; exists {
-		delete(newState.MkSkipped, MkSkippedKey{
-			RatchetPub: header.RatchetPub,
-			N:          header.N,
-		})
+	}
+	if mk, exists := newState.MkSkipped[key]; exists {
+		delete(newState.MkSkipped, key)
+		if i := slices.Index(newState.MkSkippedOrder, key); i >= 0 {
+			newState.MkSkippedOrder = slices.Delete(newState.MkSkippedOrder, i, i+1)
+		}
 		adHeader, err := utils.concat(AD, *header)
 		if err != nil {
 			return nil, err
@@ -193,3 +193,96 @@ func TestDHRatchetSendAndReceiveChain(t *testing.T) {
 	// Additional check: Ensure Alice's public key (Dhs) is properly updated for Bob
 	assert.Equal(t, aliceState.Dhs.Pub, *bobState.Dhr, "Bob's received public key should match Alice's new DH public key")
 }
+
+func TestDecryptFailureKeepsState(t *testing.T) {
+	sk, err := key_ed25519.New()
+	assert.NoError(t, err)
+	bobSK, err := key_ed25519.New()
+	assert.NoError(t, err)
+	bobPub, err := bobSK.Public()
+	assert.NoError(t, err)
+
+	aliceRatchet, err := InitAlice(RatchetKey(*sk), *bobPub)
+	assert.NoError(t, err)
+	bobRatchet := InitBob(RatchetKey(*sk), key_ed25519.Pair{Priv: *bobSK, Pub: *bobPub})
+
+	ad := []byte("test associated data")
+	header, ciphertext, err := aliceRatchet.Encrypt([]byte("Hello, Bob!"), ad, false)
+	assert.NoError(t, err)
+
+	// A tampered copy of the message must not advance Bob's state
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[0] ^= 0xff
+	_, err = bobRatchet.Decrypt(*header, tampered, ad)
+	assert.ErrorIs(t, err, ErrInvalidTag)
+	assert.Nil(t, bobRatchet.CurrentState.Ckr, "Bob's receiving chain should not be initialized by a failed decryption")
+
+	// A truncated message is rejected instead of panicking
+	_, err = bobRatchet.Decrypt(*header, ciphertext[:8], ad)
+	assert.ErrorIs(t, err, ErrInvalidTag)
+
+	// The genuine message still decrypts afterwards
+	plaintext, err := bobRatchet.Decrypt(*header, ciphertext, ad)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("Hello, Bob!"), plaintext)
+
+	// Skipped message keys survive a failed decryption too
+	header1, ciphertext1, err := aliceRatchet.Encrypt([]byte("first"), ad, false)
+	assert.NoError(t, err)
+	header2, ciphertext2, err := aliceRatchet.Encrypt([]byte("second"), ad, false)
+	assert.NoError(t, err)
+
+	plaintext, err = bobRatchet.Decrypt(*header2, ciphertext2, ad)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), plaintext)
+
+	tampered = append([]byte(nil), ciphertext1...)
+	tampered[0] ^= 0xff
+	_, err = bobRatchet.Decrypt(*header1, tampered, ad)
+	assert.Error(t, err)
+
+	plaintext, err = bobRatchet.Decrypt(*header1, ciphertext1, ad)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), plaintext)
+}
+
+func TestSkippedKeysEvicted(t *testing.T) {
+	sk, err := key_ed25519.New()
+	assert.NoError(t, err)
+	bobSK, err := key_ed25519.New()
+	assert.NoError(t, err)
+	bobPub, err := bobSK.Public()
+	assert.NoError(t, err)
+
+	aliceRatchet, err := InitAlice(RatchetKey(*sk), *bobPub)
+	assert.NoError(t, err)
+	bobRatchet := InitBob(RatchetKey(*sk), key_ed25519.Pair{Priv: *bobSK, Pub: *bobPub})
+
+	ad := []byte("test associated data")
+	type message struct {
+		header     *Header
+		ciphertext []byte
+	}
+	messages := make([]message, 2501)
+	for i := range messages {
+		header, ciphertext, err := aliceRatchet.Encrypt([]byte("message"), ad, false)
+		assert.NoError(t, err)
+		messages[i] = message{header, ciphertext}
+	}
+
+	// Bob only gets a few of them, like when most messages are dropped
+	for _, i := range []int{1000, 2000, 2500} {
+		_, err := bobRatchet.Decrypt(*messages[i].header, messages[i].ciphertext, ad)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, bobRatchet.CurrentState.MkSkipped, maxSkippedKeys)
+	assert.Len(t, bobRatchet.CurrentState.MkSkippedOrder, maxSkippedKeys)
+
+	// The oldest skipped keys are gone, the newer ones still decrypt
+	_, err = bobRatchet.Decrypt(*messages[0].header, messages[0].ciphertext, ad)
+	assert.Error(t, err)
+	plaintext, err := bobRatchet.Decrypt(*messages[600].header, messages[600].ciphertext, ad)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("message"), plaintext)
+	assert.Len(t, bobRatchet.CurrentState.MkSkippedOrder, maxSkippedKeys-1)
+}
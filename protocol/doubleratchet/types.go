@@ -3,6 +3,7 @@ package doubleratchet
 import (
 	"encoding/json"
 	"minimal-signal/crypto/key_ed25519"
+	"slices"
 )
 
 type (
@@ -57,6 +58,19 @@ type State struct {
 	Pn MsgIndex
 	// MkSkipped is a map of skipped-over message keys, indexed by ratchet public key and message number
 	MkSkipped map[MkSkippedKey]*MsgKey
+	// MkSkippedOrder holds the keys of MkSkipped in the order they were skipped, to evict the oldest ones
+	MkSkippedOrder []MkSkippedKey
+}
+
+// clone returns a copy of the State that can be modified without affecting the original
+func (s *State) clone() State {
+	c := *s
+	c.MkSkipped = make(map[MkSkippedKey]*MsgKey, len(s.MkSkipped))
+	for k, v := range s.MkSkipped {
+		c.MkSkipped[k] = v
+	}
+	c.MkSkippedOrder = slices.Clone(s.MkSkippedOrder)
+	return c
 }
 
 type MkSkippedKey struct {
@@ -153,6 +153,9 @@ func (dr *doubleRatchetUtilsImpl) decrypt(mk MsgKey, ciphertext []byte, associat
 	copy(iv[:], key[64:])
 
 	// Verify the tag
+	if len(ciphertext) < crypto.HMACSHA256Size {
+		return nil, ErrInvalidTag
+	}
 	tagFromCiphertext := ciphertext[len(ciphertext)-crypto.HMACSHA256Size:]
 	ciphertext = ciphertext[:len(ciphertext)-crypto.HMACSHA256Size]
 	tag := hmac.Hash(crypto.DefaultHashFunc, authKey[:], append(associatedData, ciphertext...))
@@ -0,0 +1,11 @@
+package fingerprint
+
+import "errors"
+
+var (
+	ErrInvalidPayload      = errors.New("invalid scannable fingerprint payload")
+	ErrVersionMismatch     = errors.New("scannable fingerprint version mismatch")
+	ErrUnsupportedVersion  = errors.New("unsupported fingerprint version")
+	ErrInvalidIterations   = errors.New("fingerprint iteration count must be positive")
+	ErrFingerprintMismatch = errors.New("fingerprints do not match")
+)
@@ -3,34 +3,154 @@ package fingerprint
 import (
 	"crypto/sha512"
 	"encoding/binary"
+	"fmt"
 	"minimal-signal/crypto/key_ed25519"
+	"strings"
 )
 
+// Version identifies how fingerprints are computed. Both sides of a conversation must use the same version
+// for their safety numbers to match, so the version is part of the scannable fingerprint.
+type Version byte
+
+const (
+	// Version1 hashes the key and identifier without any version, then SHA-512 alone on each iteration.
+	// Kept to compare with clients that predate versioning.
+	Version1 Version = 1
+	// Version2 follows Signal's numeric fingerprint: the version, key and identifier are hashed first,
+	// then the key is hashed in again on each iteration. Keys have no type byte here.
+	Version2 Version = 2
+
+	// CurrentVersion is the version used for new fingerprints
+	CurrentVersion = Version2
+
+	// DisplayableSize is the number of digits of the fingerprint of one identity
+	DisplayableSize = 30
+)
+
+// iterations returns the number of SHA-512 iterations of version, false if it is not supported
+func iterations(version Version) (int, bool) {
+	switch version {
+	case Version1, Version2:
+		return 5200, true
+	default:
+		return 0, false
+	}
+}
+
+// Generator computes fingerprints of one version
+type Generator struct {
+	Version    Version
+	Iterations int
+}
+
+// NewGenerator returns a generator for version with its default iteration count
+func NewGenerator(version Version) (*Generator, error) {
+	n, ok := iterations(version)
+	if !ok {
+		return nil, ErrUnsupportedVersion
+	}
+	return &Generator{Version: version, Iterations: n}, nil
+}
+
 // Fingerprint impl mimics what Signal app actually does
-func Fingerprint(pubKey key_ed25519.PublicKey, userIdentifier []byte) (*[30]int, error) {
-	digest := append(pubKey[:], userIdentifier...)
-	hash := sha512.New()
-	for i := 0; i < 5200; i++ {
-		_, err := hash.Write(digest)
-		if err != nil {
-			return nil, err
-		}
-		digest = hash.Sum(nil)
-		hash.Reset()
+//
+// Deprecated: Fingerprint computes Version1 fingerprints, use a Generator instead.
+func Fingerprint(pubKey key_ed25519.PublicKey, userIdentifier []byte) (*[DisplayableSize]int, error) {
+	g, err := NewGenerator(Version1)
+	if err != nil {
+		return nil, err
 	}
+	return g.Displayable(pubKey, userIdentifier)
+}
 
-	var result [30]byte
-	copy(result[:], digest[:30])
+// Displayable returns the digits of the fingerprint of one identity
+func (g *Generator) Displayable(pubKey key_ed25519.PublicKey, userIdentifier []byte) (*[DisplayableSize]int, error) {
+	digest, err := g.hash(pubKey, userIdentifier)
+	if err != nil {
+		return nil, err
+	}
 
-	var finalResult [30]int
-	for i := 0; i < 6; i++ {
-		chunk := result[i*5 : (i+1)*5]
+	// Each 5 bytes chunk gives 5 digits
+	var result [DisplayableSize]int
+	for i := 0; i < DisplayableSize/5; i++ {
+		chunk := digest[i*5 : (i+1)*5]
 		num := binary.BigEndian.Uint64(append([]byte{0, 0, 0}, chunk...)) % 100000
 		for j := 4; j >= 0; j-- {
-			finalResult[i*5+j] = int(num % 10)
+			result[i*5+j] = int(num % 10)
 			num /= 10
 		}
 	}
+	return &result, nil
+}
 
-	return &finalResult, nil
+// Combined returns the safety number of a conversation as shown to the users: the digits of both identities
+// in groups of 5. Both sides get the same safety number as the identities are sorted.
+func (g *Generator) Combined(localKey key_ed25519.PublicKey, localIdentifier []byte, remoteKey key_ed25519.PublicKey, remoteIdentifier []byte) (string, error) {
+	local, err := g.Displayable(localKey, localIdentifier)
+	if err != nil {
+		return "", err
+	}
+	remote, err := g.Displayable(remoteKey, remoteIdentifier)
+	if err != nil {
+		return "", err
+	}
+
+	first, second := formatDigits(local[:]), formatDigits(remote[:])
+	if g.Version == Version1 {
+		// Version1 sorted by identifier, which leaves both orders possible between devices of the same user
+		if string(localIdentifier) > string(remoteIdentifier) {
+			first, second = second, first
+		}
+	} else if first > second {
+		first, second = second, first
+	}
+	return first + " " + second, nil
+}
+
+// formatDigits returns digits in groups of 5 separated by spaces
+func formatDigits(digits []int) string {
+	var sb strings.Builder
+	for i, digit := range digits {
+		if i > 0 && i%5 == 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%d", digit)
+	}
+	return sb.String()
+}
+
+// hash iterates SHA-512 over an identity key and its user identifier.
+// The displayable and scannable fingerprints are both taken from the result.
+func (g *Generator) hash(pubKey key_ed25519.PublicKey, userIdentifier []byte) ([]byte, error) {
+	if g.Iterations < 1 {
+		return nil, ErrInvalidIterations
+	}
+
+	digest := make([]byte, 0, 2+len(pubKey)+len(userIdentifier))
+	switch g.Version {
+	case Version1:
+	case Version2:
+		digest = binary.BigEndian.AppendUint16(digest, uint16(g.Version))
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+	digest = append(digest, pubKey[:]...)
+	digest = append(digest, userIdentifier...)
+
+	// The result of each iteration is written to the same buffer
+	hash := sha512.New()
+	buffer := make([]byte, 0, sha512.Size)
+	for i := 0; i < g.Iterations; i++ {
+		hash.Reset()
+		if _, err := hash.Write(digest); err != nil {
+			return nil, err
+		}
+		if g.Version != Version1 {
+			if _, err := hash.Write(pubKey[:]); err != nil {
+				return nil, err
+			}
+		}
+		digest = hash.Sum(buffer[:0])
+	}
+	return digest, nil
 }
@@ -0,0 +1,97 @@
+package fingerprint
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"minimal-signal/crypto/key_ed25519"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testKeys returns fixed keys for the test vectors: 00 01 .. 1f for alice and ff fe .. e0 for bob
+func testKeys() (alice, bob key_ed25519.PublicKey) {
+	for i := range alice {
+		alice[i] = byte(i)
+		bob[i] = byte(0xff - i)
+	}
+	return alice, bob
+}
+
+// The vectors were computed independently of this package, with Python's hashlib: the digest starts as the
+// version on 2 bytes big endian (Version2 only), the key and the identifier, and each iteration replaces it
+// with SHA-512 of the digest followed by the key (Version2) or of the digest alone (Version1).
+func TestVectors(t *testing.T) {
+	aliceKey, bobKey := testKeys()
+	tests := []struct {
+		version      Version
+		alice, bob   string
+		aliceScanned string
+	}{
+		{
+			version:      Version1,
+			alice:        "90322 26343 90575 91135 82493 46317",
+			bob:          "60662 34044 67628 76957 15668 21721",
+			aliceScanned: "bb9ebbc5b2bf5427782780440b13efbe497b1c1f43e0ac13dd435dd8026d98dd",
+		},
+		{
+			version:      Version2,
+			alice:        "81797 63147 53081 78104 25179 73029",
+			bob:          "47783 57196 39934 20001 06135 96253",
+			aliceScanned: "4d70670645790ea3de6b7caaa2fd39a7d76b6518b8a5feda7b8fc15f5265fb52",
+		},
+	}
+	for _, tt := range tests {
+		g, err := NewGenerator(tt.version)
+		require.NoError(t, err)
+
+		alice, err := g.Displayable(aliceKey, []byte("alice"))
+		require.NoError(t, err)
+		assert.Equal(t, tt.alice, formatDigits(alice[:]), "version %d", tt.version)
+		bob, err := g.Displayable(bobKey, []byte("bob"))
+		require.NoError(t, err)
+		assert.Equal(t, tt.bob, formatDigits(bob[:]), "version %d", tt.version)
+
+		scannable, err := g.Scannable(aliceKey, []byte("alice"), bobKey, []byte("bob"))
+		require.NoError(t, err)
+		assert.Equal(t, tt.aliceScanned, hex.EncodeToString(scannable.LocalFingerprint[:]), "version %d", tt.version)
+	}
+}
+
+func TestIterationsSelectable(t *testing.T) {
+	aliceKey, _ := testKeys()
+	g := &Generator{Version: Version2, Iterations: 1}
+	alice, err := g.Displayable(aliceKey, []byte("alice"))
+	require.NoError(t, err)
+	assert.Equal(t, "13502 25801 98751 64731 73730 20391", formatDigits(alice[:]))
+
+	g.Iterations = 0
+	_, err = g.Displayable(aliceKey, []byte("alice"))
+	assert.ErrorIs(t, err, ErrInvalidIterations)
+
+	_, err = NewGenerator(Version(0))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestCombinedIsSymmetric(t *testing.T) {
+	aliceKey, bobKey := testKeys()
+	for _, version := range []Version{Version1, Version2} {
+		g, err := NewGenerator(version)
+		require.NoError(t, err)
+
+		fromAlice, err := g.Combined(aliceKey, []byte("alice"), bobKey, []byte("bob"))
+		require.NoError(t, err)
+		fromBob, err := g.Combined(bobKey, []byte("bob"), aliceKey, []byte("alice"))
+		require.NoError(t, err)
+		assert.Equal(t, fromAlice, fromBob, "version %d", version)
+		assert.Len(t, fromAlice, 2*DisplayableSize+11)
+	}
+
+	// Version2 puts the lowest fingerprint first
+	g, err := NewGenerator(Version2)
+	require.NoError(t, err)
+	combined, err := g.Combined(aliceKey, []byte("alice"), bobKey, []byte("bob"))
+	require.NoError(t, err)
+	assert.Equal(t, "47783 57196 39934 20001 06135 96253 81797 63147 53081 78104 25179 73029", combined)
+}
@@ -0,0 +1,82 @@
+package fingerprint
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"minimal-signal/crypto/key_ed25519"
+)
+
+// Like Signal, the safety number can also be compared by scanning a code instead of reading it aloud.
+// The scannable payload holds a version and the fingerprints of both identities, each from the point
+// of view of the device showing it: scanning the peer's code means checking that their local fingerprint
+// is our remote one and the other way around.
+
+const (
+	// ScannableFingerprintSize is the length of each fingerprint in the scannable payload
+	ScannableFingerprintSize = 32
+)
+
+// Scannable is the content of a scannable fingerprint
+type Scannable struct {
+	// Version is the version of the fingerprints, the peer computes ours with the same one
+	Version           Version
+	LocalFingerprint  [ScannableFingerprintSize]byte
+	RemoteFingerprint [ScannableFingerprintSize]byte
+}
+
+// Scannable returns the scannable fingerprint of a conversation, seen from the local user
+func (g *Generator) Scannable(localKey key_ed25519.PublicKey, localIdentifier []byte, remoteKey key_ed25519.PublicKey, remoteIdentifier []byte) (*Scannable, error) {
+	local, err := g.hash(localKey, localIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := g.hash(remoteKey, remoteIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	scannable := &Scannable{Version: g.Version}
+	copy(scannable.LocalFingerprint[:], local[:ScannableFingerprintSize])
+	copy(scannable.RemoteFingerprint[:], remote[:ScannableFingerprintSize])
+	return scannable, nil
+}
+
+// Payload encodes the scannable fingerprint as the text put in the QR code: version || local || remote, in base64
+func (s *Scannable) Payload() string {
+	data := make([]byte, 0, 1+2*ScannableFingerprintSize)
+	data = append(data, byte(s.Version))
+	data = append(data, s.LocalFingerprint[:]...)
+	data = append(data, s.RemoteFingerprint[:]...)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseScannable decodes a payload produced by Payload
+func ParseScannable(payload string) (*Scannable, error) {
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || len(data) == 0 {
+		return nil, ErrInvalidPayload
+	}
+	if _, ok := iterations(Version(data[0])); !ok {
+		return nil, ErrUnsupportedVersion
+	}
+	if len(data) != 1+2*ScannableFingerprintSize {
+		return nil, ErrInvalidPayload
+	}
+
+	scannable := &Scannable{Version: Version(data[0])}
+	copy(scannable.LocalFingerprint[:], data[1:1+ScannableFingerprintSize])
+	copy(scannable.RemoteFingerprint[:], data[1+ScannableFingerprintSize:])
+	return scannable, nil
+}
+
+// Compare checks the scannable fingerprint shown by the peer against ours
+func (s *Scannable) Compare(theirs *Scannable) error {
+	if s.Version != theirs.Version {
+		return ErrVersionMismatch
+	}
+	if subtle.ConstantTimeCompare(s.LocalFingerprint[:], theirs.RemoteFingerprint[:]) != 1 ||
+		subtle.ConstantTimeCompare(s.RemoteFingerprint[:], theirs.LocalFingerprint[:]) != 1 {
+		return ErrFingerprintMismatch
+	}
+	return nil
+}
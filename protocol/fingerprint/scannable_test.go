@@ -0,0 +1,83 @@
+package fingerprint
+
+import (
+	"testing"
+
+	"minimal-signal/crypto/key_ed25519"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPublicKey(t *testing.T) key_ed25519.PublicKey {
+	priv, err := key_ed25519.New()
+	require.NoError(t, err)
+	pub, err := priv.Public()
+	require.NoError(t, err)
+	return *pub
+}
+
+func newTestGenerator(t *testing.T) *Generator {
+	g, err := NewGenerator(CurrentVersion)
+	require.NoError(t, err)
+	return g
+}
+
+func TestScannableMatches(t *testing.T) {
+	g := newTestGenerator(t)
+	aliceKey, bobKey := newPublicKey(t), newPublicKey(t)
+
+	alice, err := g.Scannable(aliceKey, []byte("alice"), bobKey, []byte("bob"))
+	require.NoError(t, err)
+	bob, err := g.Scannable(bobKey, []byte("bob"), aliceKey, []byte("alice"))
+	require.NoError(t, err)
+
+	// Alice scans the code shown by Bob
+	scanned, err := ParseScannable(bob.Payload())
+	require.NoError(t, err)
+	assert.Equal(t, bob, scanned)
+	assert.NoError(t, alice.Compare(scanned))
+	assert.NoError(t, bob.Compare(alice))
+}
+
+func TestScannableMismatch(t *testing.T) {
+	g := newTestGenerator(t)
+	aliceKey, bobKey, mitmKey := newPublicKey(t), newPublicKey(t), newPublicKey(t)
+
+	// Alice got the key of a man in the middle instead of Bob's
+	alice, err := g.Scannable(aliceKey, []byte("alice"), mitmKey, []byte("bob"))
+	require.NoError(t, err)
+	bob, err := g.Scannable(bobKey, []byte("bob"), aliceKey, []byte("alice"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, alice.Compare(bob), ErrFingerprintMismatch)
+
+	// Comparing with our own code must not succeed either
+	assert.ErrorIs(t, alice.Compare(alice), ErrFingerprintMismatch)
+}
+
+func TestParseScannableInvalid(t *testing.T) {
+	scannable, err := newTestGenerator(t).Scannable(newPublicKey(t), []byte("alice"), newPublicKey(t), []byte("bob"))
+	require.NoError(t, err)
+	payload := scannable.Payload()
+
+	_, err = ParseScannable(payload[:len(payload)-4])
+	assert.ErrorIs(t, err, ErrInvalidPayload)
+	_, err = ParseScannable("not base64!")
+	assert.ErrorIs(t, err, ErrInvalidPayload)
+
+	scannable.Version = 0
+	_, err = ParseScannable(scannable.Payload())
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestScannableVersionMismatch(t *testing.T) {
+	aliceKey, bobKey := newPublicKey(t), newPublicKey(t)
+	g1, err := NewGenerator(Version1)
+	require.NoError(t, err)
+
+	alice, err := newTestGenerator(t).Scannable(aliceKey, []byte("alice"), bobKey, []byte("bob"))
+	require.NoError(t, err)
+	bob, err := g1.Scannable(bobKey, []byte("bob"), aliceKey, []byte("alice"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, alice.Compare(bob), ErrVersionMismatch)
+}
@@ -0,0 +1,9 @@
+package provisioning
+
+import "errors"
+
+var (
+	ErrInvalidCode         = errors.New("invalid provisioning code")
+	ErrInvalidSecretLength = errors.New("invalid secret length")
+	ErrInvalidTag          = errors.New("invalid tag")
+)
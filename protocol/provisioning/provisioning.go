@@ -0,0 +1,140 @@
+package provisioning
+
+import (
+	hmac2 "crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"minimal-signal/common"
+	"minimal-signal/crypto"
+	"minimal-signal/crypto/aes256"
+	"minimal-signal/crypto/dh25519"
+	"minimal-signal/crypto/hkdf"
+	"minimal-signal/crypto/hmac"
+	"minimal-signal/crypto/key_ed25519"
+)
+
+// Provisioning hands the account keys of an existing device to a new device, like Signal's device linking:
+// - the new device generates an ephemeral key pair and shows its public key as a code (or QR code)
+// - the existing device encrypts the account keys to that public key and sends them through the server
+// - the new device decrypts them with its ephemeral private key
+// The server only relays the envelope and cannot read it.
+
+var (
+	HKDFInfo = []byte("minimal-signal-provisioning")
+)
+
+// Message is the account material given to the new device
+type Message struct {
+	// Username is the username of the account, the new device derives the account ID from IdentityKey
+	Username    string                 `json:"username" validate:"required"`
+	DeviceID    common.DeviceID        `json:"device_id" validate:"required"`
+	IdentityKey key_ed25519.PrivateKey `json:"identity_key" validate:"required"`
+}
+
+// Envelope is an encrypted Message
+type Envelope struct {
+	// EphPubKey is the ephemeral public key of the sending device
+	EphPubKey key_ed25519.PublicKey `json:"eph_pub_key" validate:"required"`
+	// Body is the AES-256-CBC ciphertext of the Message followed by its HMAC-SHA256 tag
+	Body []byte `json:"body" validate:"required"`
+}
+
+// Code returns the code the new device shows for its ephemeral public key
+func Code(pubKey key_ed25519.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(pubKey[:])
+}
+
+// ParseCode returns the ephemeral public key of the new device from its code
+func ParseCode(code string) (key_ed25519.PublicKey, error) {
+	var pubKey key_ed25519.PublicKey
+	decoded, err := base64.RawURLEncoding.DecodeString(code)
+	if err != nil || len(decoded) != len(pubKey) {
+		return pubKey, ErrInvalidCode
+	}
+	copy(pubKey[:], decoded)
+	if _, err := pubKey.ToPoint(); err != nil {
+		return pubKey, ErrInvalidCode
+	}
+	return pubKey, nil
+}
+
+// Encrypt encrypts msg to the ephemeral public key of the new device
+func Encrypt(msg *Message, newDevicePubKey key_ed25519.PublicKey) (*Envelope, error) {
+	plaintext, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	ephKey, err := key_ed25519.New()
+	if err != nil {
+		return nil, err
+	}
+	ephPubKey, err := ephKey.Public()
+	if err != nil {
+		return nil, err
+	}
+
+	encKey, authKey, iv, err := deriveKeys(*ephKey, newDevicePubKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := aes256.Encrypt(plaintext, encKey, iv)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tag also covers the ephemeral public key
+	tag := hmac.Hash(crypto.DefaultHashFunc, authKey[:], append(ephPubKey[:], ciphertext...))
+	return &Envelope{
+		EphPubKey: *ephPubKey,
+		Body:      append(ciphertext, tag...),
+	}, nil
+}
+
+// Decrypt decrypts an envelope with the ephemeral private key of the new device
+func Decrypt(envelope *Envelope, newDevicePrivKey key_ed25519.PrivateKey) (*Message, error) {
+	if len(envelope.Body) < crypto.HMACSHA256Size {
+		return nil, ErrInvalidTag
+	}
+	encKey, authKey, iv, err := deriveKeys(newDevicePrivKey, envelope.EphPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the tag
+	ciphertext := envelope.Body[:len(envelope.Body)-crypto.HMACSHA256Size]
+	tagFromBody := envelope.Body[len(envelope.Body)-crypto.HMACSHA256Size:]
+	tag := hmac.Hash(crypto.DefaultHashFunc, authKey[:], append(envelope.EphPubKey[:], ciphertext...))
+	if !hmac2.Equal(tag, tagFromBody) {
+		return nil, ErrInvalidTag
+	}
+
+	plaintext, err := aes256.Decrypt(ciphertext, encKey, iv)
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal(plaintext, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// deriveKeys derives the encryption key, authentication key and IV from the DH output of both devices' keys
+func deriveKeys(privKey key_ed25519.PrivateKey, pubKey key_ed25519.PublicKey) (encKey, authKey [32]byte, iv [16]byte, err error) {
+	secret, err := dh25519.GetSharedSecret(privKey, pubKey)
+	if err != nil {
+		return encKey, authKey, iv, err
+	}
+
+	key := make([]byte, 80)
+	if n, err := hkdf.KDF(crypto.DefaultHashFunc, secret, nil, HKDFInfo, key); err != nil {
+		return encKey, authKey, iv, err
+	} else if n != 80 {
+		return encKey, authKey, iv, ErrInvalidSecretLength
+	}
+	copy(encKey[:], key[:32])
+	copy(authKey[:], key[32:64])
+	copy(iv[:], key[64:])
+	return encKey, authKey, iv, nil
+}
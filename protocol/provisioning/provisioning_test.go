@@ -0,0 +1,64 @@
+package provisioning
+
+import (
+	"testing"
+
+	"minimal-signal/crypto/key_ed25519"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	identityKey, err := key_ed25519.New()
+	require.NoError(t, err)
+	msg := &Message{Username: "alice", DeviceID: 2, IdentityKey: *identityKey}
+
+	// The new device shows its code, the existing device parses it
+	newDeviceKey, err := key_ed25519.New()
+	require.NoError(t, err)
+	newDevicePub, err := newDeviceKey.Public()
+	require.NoError(t, err)
+	parsedPub, err := ParseCode(Code(*newDevicePub))
+	require.NoError(t, err)
+	assert.Equal(t, *newDevicePub, parsedPub)
+
+	envelope, err := Encrypt(msg, parsedPub)
+	require.NoError(t, err)
+	assert.NotContains(t, string(envelope.Body), "alice")
+
+	t.Run("new device decrypts", func(t *testing.T) {
+		decrypted, err := Decrypt(envelope, *newDeviceKey)
+		require.NoError(t, err)
+		assert.Equal(t, msg, decrypted)
+	})
+
+	t.Run("other key fails", func(t *testing.T) {
+		otherKey, err := key_ed25519.New()
+		require.NoError(t, err)
+		_, err = Decrypt(envelope, *otherKey)
+		assert.ErrorIs(t, err, ErrInvalidTag)
+	})
+
+	t.Run("tampered body fails", func(t *testing.T) {
+		tampered := *envelope
+		tampered.Body = append([]byte(nil), envelope.Body...)
+		tampered.Body[0] ^= 0xff
+		_, err := Decrypt(&tampered, *newDeviceKey)
+		assert.ErrorIs(t, err, ErrInvalidTag)
+	})
+
+	t.Run("truncated body fails", func(t *testing.T) {
+		truncated := *envelope
+		truncated.Body = envelope.Body[:4]
+		_, err := Decrypt(&truncated, *newDeviceKey)
+		assert.ErrorIs(t, err, ErrInvalidTag)
+	})
+}
+
+func TestParseCodeRejectsGarbage(t *testing.T) {
+	for _, code := range []string{"", "not base64 !", "c2hvcnQ"} {
+		_, err := ParseCode(code)
+		assert.ErrorIs(t, err, ErrInvalidCode, code)
+	}
+}
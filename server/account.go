@@ -0,0 +1,502 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/crypto/key_ed25519"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+)
+
+// An account is registered with the identity key of its user, stored in ServerAccountKey, under the account ID
+// derived from that key. Publishing keys, revoking a device, setting the username and deleting the account are
+// then only allowed to the holder of that identity key. Usernames map to account IDs in ServerUsernameKey,
+// and back in ServerAccountUsernameKey.
+
+// accountEvent is published to every server when an account or one of its devices is removed
+type accountEvent struct {
+	User string `json:"user"`
+	// Device is the revoked device, 0 if the account was deleted
+	Device common.DeviceID `json:"device,omitempty"`
+}
+
+// accountIdentity returns the identity key an account is registered with, ErrUnknownUser if there is none
+func (s *Server) accountIdentity(userID string) (*key_ed25519.PublicKey, error) {
+	data, err := s.redisClient.Get(s.ctx, fmt.Sprintf(configs.ServerAccountKey, userID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrUnknownUser
+	} else if err != nil {
+		return nil, err
+	}
+	var identityKey key_ed25519.PublicKey
+	if len(data) != len(identityKey) {
+		return nil, fmt.Errorf("invalid identity key of %d bytes", len(data))
+	}
+	copy(identityKey[:], data)
+	return &identityKey, nil
+}
+
+// decodeAccountRequest reads the AccountRequest of a request, replying 400 Bad Request if it is invalid
+func (s *Server) decodeAccountRequest(w http.ResponseWriter, r *http.Request) (*common.AccountRequest, bool) {
+	var request common.AccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.logger.Errorf("Error decoding account request: %v", err)
+		http.Error(w, "Invalid account request", http.StatusBadRequest)
+		return nil, false
+	}
+	return &request, true
+}
+
+// freshSignature records the signature of an account request, and returns false if it was already used.
+// A request is refused once expired, its signature is kept as long as it could be accepted.
+func (s *Server) freshSignature(signature []byte) (bool, error) {
+	hash := sha256.Sum256(signature)
+	key := fmt.Sprintf(configs.ServerAccountRequestKey, hex.EncodeToString(hash[:]))
+	// Requests are accepted from AccountRequestMaxAge before to AccountRequestMaxAge after their timestamp
+	return s.redisClient.SetNX(s.ctx, key, 1, 2*configs.AccountRequestMaxAge).Result()
+}
+
+// refuseReplay replies 403 Forbidden to a signed request that was already received, and returns false
+func (s *Server) refuseReplay(w http.ResponseWriter, signature []byte, action string, userID string) bool {
+	fresh, err := s.freshSignature(signature)
+	if err != nil {
+		s.userLogger(userID).Errorf("Error recording %s request: %v", action, err)
+		http.Error(w, "Error recording request", http.StatusInternalServerError)
+		return false
+	}
+	if !fresh {
+		s.userLogger(userID).Warnf("Refusing replayed %s request", action)
+		http.Error(w, "Replayed request", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authenticate checks that an AccountRequest was signed with the identity key of the account, and was not
+// received before. Otherwise it replies 404 Not Found for unknown accounts and 403 Forbidden for bad signatures
+// and replays, and returns false.
+func (s *Server) authenticate(w http.ResponseWriter, request *common.AccountRequest, action string, userID string, deviceID common.DeviceID) bool {
+	return s.authenticateWith(w, request, action, userID, func(identityKey key_ed25519.PublicKey) error {
+		return request.Verify(identityKey, action, userID, deviceID, configs.AccountRequestMaxAge)
+	})
+}
+
+// authenticateWith is authenticate for requests whose signature verify checks against the identity key
+func (s *Server) authenticateWith(w http.ResponseWriter, request *common.AccountRequest, action string, userID string, verify func(key_ed25519.PublicKey) error) bool {
+	identityKey, err := s.accountIdentity(userID)
+	if errors.Is(err, ErrUnknownUser) {
+		http.Error(w, "Unknown user", http.StatusNotFound)
+		return false
+	} else if err != nil {
+		s.userLogger(userID).Errorf("Error retrieving account: %v", err)
+		http.Error(w, "Error retrieving account", http.StatusInternalServerError)
+		return false
+	}
+	if err := verify(*identityKey); err != nil {
+		s.userLogger(userID).Warnf("Refusing %s request: %v", action, err)
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return false
+	}
+	return s.refuseReplay(w, request.Signature, action, userID)
+}
+
+// HandleRegister registers an account with the identity key of a common.AccountRequest. Registering again
+// with the same key succeeds, with another one fails with 409 Conflict.
+func (s *Server) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	if !s.allowRequest(w, r, s.keyPublishLimiter) {
+		return
+	}
+	userID := mux.Vars(r)["userID"]
+	request, ok := s.decodeAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	if userID != common.AccountID(request.IdentityKey) {
+		http.Error(w, "User ID is not the account ID of the identity key", http.StatusBadRequest)
+		return
+	}
+	if err := request.Verify(request.IdentityKey, common.AccountRegister, userID, 0, configs.AccountRequestMaxAge); err != nil {
+		s.userLogger(userID).Warnf("Refusing registration: %v", err)
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	if !s.refuseReplay(w, request.Signature, common.AccountRegister, userID) || !s.allowAccount(w, r, s.keyPublishLimiter, userID) {
+		return
+	}
+
+	created, err := s.redisClient.SetNX(s.ctx, fmt.Sprintf(configs.ServerAccountKey, userID), request.IdentityKey[:], 0).Result()
+	if err != nil {
+		s.userLogger(userID).Errorf("Error registering account: %v", err)
+		http.Error(w, "Error registering account", http.StatusInternalServerError)
+		return
+	}
+	if !created {
+		identityKey, err := s.accountIdentity(userID)
+		if err != nil {
+			s.userLogger(userID).Errorf("Error retrieving account: %v", err)
+			http.Error(w, "Error retrieving account", http.StatusInternalServerError)
+			return
+		}
+		if *identityKey != request.IdentityKey {
+			http.Error(w, "User ID taken", http.StatusConflict)
+			return
+		}
+		return
+	}
+	s.userLogger(userID).Info("Account registered")
+}
+
+// HandleGetAccount replies the common.Account of a user ID, 404 Not Found if it is not registered
+func (s *Server) HandleGetAccount(w http.ResponseWriter, r *http.Request) {
+	if !s.allowRequest(w, r, s.keyFetchLimiter) {
+		return
+	}
+	userID := mux.Vars(r)["userID"]
+	if _, err := s.accountIdentity(userID); errors.Is(err, ErrUnknownUser) {
+		http.Error(w, "Unknown user", http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.userLogger(userID).Errorf("Error retrieving account: %v", err)
+		http.Error(w, "Error retrieving account", http.StatusInternalServerError)
+		return
+	}
+
+	username, err := s.redisClient.Get(s.ctx, fmt.Sprintf(configs.ServerAccountUsernameKey, userID)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		s.userLogger(userID).Errorf("Error retrieving username: %v", err)
+		http.Error(w, "Error retrieving username", http.StatusInternalServerError)
+		return
+	}
+	s.replyAccount(w, &common.Account{ID: userID, Username: username})
+}
+
+// HandleResolveUsername replies the common.Account a username belongs to, 404 Not Found if it is free
+func (s *Server) HandleResolveUsername(w http.ResponseWriter, r *http.Request) {
+	if !s.allowRequest(w, r, s.keyFetchLimiter) {
+		return
+	}
+	username := common.NormalizeUsername(mux.Vars(r)["username"])
+	userID, err := s.redisClient.Get(s.ctx, fmt.Sprintf(configs.ServerUsernameKey, username)).Result()
+	if errors.Is(err, redis.Nil) {
+		http.Error(w, "Unknown username", http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.logger.Errorf("Error resolving username: %v", err)
+		http.Error(w, "Error resolving username", http.StatusInternalServerError)
+		return
+	}
+	s.replyAccount(w, &common.Account{ID: userID, Username: username})
+}
+
+func (s *Server) replyAccount(w http.ResponseWriter, account *common.Account) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(account); err != nil {
+		s.userLogger(account.ID).Errorf("Error encoding account: %v", err)
+	}
+}
+
+// setUsernameScript gives the username ARGV[2] to the account ARGV[1] and frees its previous one, all at once so
+// that two accounts cannot claim the same username and no username is left pointing to an account that moved
+// on. KEYS are the username, the username of the account and the account, ARGV[3] formats the key of the
+// previous username.
+var setUsernameScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[3]) == 0 then
+	return 2
+end
+local owner = redis.call("GET", KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return 1
+end
+local previous = redis.call("GET", KEYS[2])
+redis.call("SET", KEYS[1], ARGV[1])
+redis.call("SET", KEYS[2], ARGV[2])
+if previous and previous ~= ARGV[2] then
+	redis.call("DEL", string.format(ARGV[3], previous))
+end
+return 0
+`)
+
+// Results of setUsernameScript
+const (
+	setUsernameTaken     = 1
+	setUsernameNoAccount = 2
+)
+
+// HandleSetUsername sets the username of an account, freeing its previous one. A username of another account
+// fails with 409 Conflict. Usernames are stored in lower case.
+func (s *Server) HandleSetUsername(w http.ResponseWriter, r *http.Request) {
+	if !s.allowRequest(w, r, s.keyPublishLimiter) {
+		return
+	}
+	userID := mux.Vars(r)["userID"]
+	request, ok := s.decodeAccountRequest(w, r)
+	if !ok || !s.authenticate(w, request, common.AccountSetUsername, userID, 0) || !s.allowAccount(w, r, s.keyPublishLimiter, userID) {
+		return
+	}
+	username, err := common.ValidateUsername(request.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keys := []string{
+		fmt.Sprintf(configs.ServerUsernameKey, username),
+		fmt.Sprintf(configs.ServerAccountUsernameKey, userID),
+		fmt.Sprintf(configs.ServerAccountKey, userID),
+	}
+	claimed, err := setUsernameScript.Run(s.ctx, s.redisClient, keys, userID, username, configs.ServerUsernameKey).Int()
+	if err != nil {
+		s.userLogger(userID).Errorf("Error setting username: %v", err)
+		http.Error(w, "Error setting username", http.StatusInternalServerError)
+		return
+	}
+	switch claimed {
+	case setUsernameTaken:
+		http.Error(w, "Username taken", http.StatusConflict)
+		return
+	case setUsernameNoAccount:
+		http.Error(w, "Unknown user", http.StatusNotFound)
+		return
+	}
+	s.userLogger(userID).Info("Username set")
+}
+
+// HandleUnregister deletes an account and everything the server stores about it, and tells the peers
+// connected to it
+func (s *Server) HandleUnregister(w http.ResponseWriter, r *http.Request) {
+	if !s.allowRequest(w, r, s.keyPublishLimiter) {
+		return
+	}
+	userID := mux.Vars(r)["userID"]
+	request, ok := s.decodeAccountRequest(w, r)
+	if !ok || !s.authenticate(w, request, common.AccountUnregister, userID, 0) || !s.allowAccount(w, r, s.keyPublishLimiter, userID) {
+		return
+	}
+
+	if err := s.deleteAccount(userID); err != nil {
+		s.userLogger(userID).Errorf("Error deleting account: %v", err)
+		http.Error(w, "Error deleting account", http.StatusInternalServerError)
+		return
+	}
+	s.publishAccountEvent(accountEvent{User: userID})
+	s.userLogger(userID).Info("Account deleted")
+}
+
+// HandleRevokeDevice removes the keys and queued messages of one device of an account
+func (s *Server) HandleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	if !s.allowRequest(w, r, s.keyPublishLimiter) {
+		return
+	}
+	userID := mux.Vars(r)["userID"]
+	deviceID, err := common.ParseDeviceID(mux.Vars(r)["deviceID"])
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+	request, ok := s.decodeAccountRequest(w, r)
+	if !ok || !s.authenticate(w, request, common.AccountRevokeDevice, userID, deviceID) || !s.allowAccount(w, r, s.keyPublishLimiter, userID) {
+		return
+	}
+
+	registered, err := s.redisClient.SIsMember(s.ctx, fmt.Sprintf(configs.ServerUserDevicesKey, userID), uint32(deviceID)).Result()
+	if err != nil {
+		s.deviceLogger(userID, deviceID).Errorf("Error checking device: %v", err)
+		http.Error(w, "Error checking device", http.StatusInternalServerError)
+		return
+	}
+	if !registered {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return
+	}
+	if err := s.deleteDevice(userID, deviceID); err != nil {
+		s.deviceLogger(userID, deviceID).Errorf("Error revoking device: %v", err)
+		http.Error(w, "Error revoking device", http.StatusInternalServerError)
+		return
+	}
+	s.publishAccountEvent(accountEvent{User: userID, Device: deviceID})
+	s.deviceLogger(userID, deviceID).Info("Device revoked")
+}
+
+// reserveDeviceScript increments the last device ID of the account and returns it, 0 if there is no account.
+// Accounts that never linked a device start from their highest registered device. KEYS are the last device
+// ID, the devices and the account.
+var reserveDeviceScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[3]) == 0 then
+	return 0
+end
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	local last = 1
+	for _, member in ipairs(redis.call("SMEMBERS", KEYS[2])) do
+		last = math.max(last, tonumber(member))
+	end
+	redis.call("SET", KEYS[1], last)
+end
+return redis.call("INCR", KEYS[1])
+`)
+
+// HandleReserveDevice replies a common.DeviceReservation with a device ID no other device of the account
+// got, for a device being linked
+func (s *Server) HandleReserveDevice(w http.ResponseWriter, r *http.Request) {
+	if !s.allowRequest(w, r, s.keyPublishLimiter) {
+		return
+	}
+	userID := mux.Vars(r)["userID"]
+	request, ok := s.decodeAccountRequest(w, r)
+	if !ok || !s.authenticate(w, request, common.AccountReserveDevice, userID, 0) || !s.allowAccount(w, r, s.keyPublishLimiter, userID) {
+		return
+	}
+
+	keys := []string{
+		fmt.Sprintf(configs.ServerLastDeviceKey, userID),
+		fmt.Sprintf(configs.ServerUserDevicesKey, userID),
+		fmt.Sprintf(configs.ServerAccountKey, userID),
+	}
+	deviceID, err := reserveDeviceScript.Run(s.ctx, s.redisClient, keys).Int64()
+	if err != nil {
+		s.userLogger(userID).Errorf("Error reserving device: %v", err)
+		http.Error(w, "Error reserving device", http.StatusInternalServerError)
+		return
+	}
+	if deviceID == 0 {
+		http.Error(w, "Unknown user", http.StatusNotFound)
+		return
+	}
+
+	reservation := common.DeviceReservation{DeviceID: common.DeviceID(deviceID)}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&reservation); err != nil {
+		s.userLogger(userID).Errorf("Error encoding device reservation: %v", err)
+	}
+	s.deviceLogger(userID, reservation.DeviceID).Info("Device reserved")
+}
+
+// maxTxRetries is how many times a transaction is retried when a key it watches changes meanwhile
+const maxTxRetries = 5
+
+// watch runs fn in a transaction watching keys, retrying it if one of them changed before it committed
+func (s *Server) watch(fn func(tx *redis.Tx) error, keys ...string) error {
+	for i := 0; i < maxTxRetries; i++ {
+		err := s.redisClient.Watch(s.ctx, fn, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return redis.TxFailedErr
+}
+
+// deviceQueues returns the peers with a mailbox for a device, and watches their set in tx
+func (s *Server) deviceQueues(tx *redis.Tx, userID string, deviceID common.DeviceID) ([]string, error) {
+	key := queuesKey(connKey{from: userID, device: deviceID})
+	if err := tx.Watch(s.ctx, key).Err(); err != nil {
+		return nil, err
+	}
+	peers, err := tx.SMembers(s.ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get queues: %w", err)
+	}
+	return peers, nil
+}
+
+// deleteDeviceKeys deletes in pipe the keys of a device and the mailboxes of peers
+func (s *Server) deleteDeviceKeys(pipe redis.Pipeliner, userID string, deviceID common.DeviceID, peers []string) {
+	device := connKey{from: userID, device: deviceID}
+	pipe.Del(s.ctx, fmt.Sprintf(configs.ServerUserPubKey, userID, deviceID), queuesKey(device))
+	pipe.SRem(s.ctx, fmt.Sprintf(configs.ServerUserDevicesKey, userID), uint32(deviceID))
+	for _, peer := range peers {
+		key := connKey{from: userID, device: deviceID, to: peer}
+		pipe.Del(s.ctx, mailboxKey(key), queueBytesKey(key))
+	}
+}
+
+// deleteDevice deletes the keys of a device and the messages queued for it
+func (s *Server) deleteDevice(userID string, deviceID common.DeviceID) error {
+	return s.watch(func(tx *redis.Tx) error {
+		peers, err := s.deviceQueues(tx, userID, deviceID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(s.ctx, func(pipe redis.Pipeliner) error {
+			s.deleteDeviceKeys(pipe, userID, deviceID, peers)
+			return nil
+		})
+		return err
+	})
+}
+
+// deleteAccount deletes every device of an account and the account itself, in a single transaction so that
+// a device added or a username set meanwhile is not left behind
+func (s *Server) deleteAccount(userID string) error {
+	devicesKey := fmt.Sprintf(configs.ServerUserDevicesKey, userID)
+	usernameKey := fmt.Sprintf(configs.ServerAccountUsernameKey, userID)
+	return s.watch(func(tx *redis.Tx) error {
+		members, err := tx.SMembers(s.ctx, devicesKey).Result()
+		if err != nil {
+			return fmt.Errorf("failed to get devices: %w", err)
+		}
+		queues := make(map[common.DeviceID][]string, len(members))
+		for _, member := range members {
+			deviceID, err := common.ParseDeviceID(member)
+			if err != nil {
+				return err
+			}
+			if queues[deviceID], err = s.deviceQueues(tx, userID, deviceID); err != nil {
+				return fmt.Errorf("device %d: %w", deviceID, err)
+			}
+		}
+		username, err := tx.Get(s.ctx, usernameKey).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return fmt.Errorf("failed to get username: %w", err)
+		}
+
+		_, err = tx.TxPipelined(s.ctx, func(pipe redis.Pipeliner) error {
+			for deviceID, peers := range queues {
+				s.deleteDeviceKeys(pipe, userID, deviceID, peers)
+			}
+			pipe.Del(s.ctx, fmt.Sprintf(configs.ServerAccountKey, userID), devicesKey, usernameKey, fmt.Sprintf(configs.ServerLastDeviceKey, userID))
+			if username != "" {
+				pipe.Del(s.ctx, fmt.Sprintf(configs.ServerUsernameKey, username))
+			}
+			pipe.SRem(s.ctx, configs.ServerDirectoryKey, common.DirectoryHash(userID))
+			return nil
+		})
+		return err
+	}, devicesKey, usernameKey)
+}
+
+// publishAccountEvent tells every server that an account or device was removed, see handleAccountEvent
+func (s *Server) publishAccountEvent(event accountEvent) {
+	data, err := json.Marshal(&event)
+	if err == nil {
+		err = s.redisClient.Publish(s.ctx, configs.ServerAccountsChannel, data).Err()
+	}
+	if err != nil {
+		s.userLogger(event.User).Errorf("Error publishing account event: %v", err)
+	}
+}
+
+// handleAccountEvent closes the local connections of a removed device or account. The peers connected to
+// a deleted account are told it is gone.
+func (s *Server) handleAccountEvent(event accountEvent) {
+	notice, err := json.Marshal(&common.ErrorReply{Code: common.ErrorAccountDeleted, To: event.User})
+	if err != nil {
+		s.logger.Errorf("Error marshalling account notice: %v", err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, conn := range s.connectedUsers {
+		if key.from == event.User && (event.Device == 0 || key.device == event.Device) {
+			conn.ws.Close()
+		} else if key.to == event.User && event.Device == 0 {
+			conn.deliver(outgoing{data: notice})
+		}
+	}
+}
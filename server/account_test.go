@@ -0,0 +1,389 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/crypto/key_ed25519"
+	"minimal-signal/protocol/x3dh/bob"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// accountRouter serves the account and key endpoints of s
+func accountRouter(s *Server) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc(configs.PublishKeysPath+"/{userID}/{deviceID}", s.HandlePostKeys).Methods(http.MethodPost)
+	r.HandleFunc(configs.PublishKeysPath+"/{userID}/{deviceID}", s.HandleRevokeDevice).Methods(http.MethodDelete)
+	r.HandleFunc(configs.PublishKeysPath+"/{userID}", s.HandleGetKeys).Methods(http.MethodGet)
+	r.HandleFunc(configs.AccountsPath+"/{userID}", s.HandleRegister).Methods(http.MethodPost)
+	r.HandleFunc(configs.AccountsPath+"/{userID}", s.HandleUnregister).Methods(http.MethodDelete)
+	r.HandleFunc(configs.AccountsPath+"/{userID}", s.HandleGetAccount).Methods(http.MethodGet)
+	r.HandleFunc(configs.AccountsPath+"/{userID}/username", s.HandleSetUsername).Methods(http.MethodPut)
+	r.HandleFunc(configs.AccountsPath+"/{userID}/devices", s.HandleReserveDevice).Methods(http.MethodPost)
+	r.HandleFunc(configs.UsernamesPath+"/{username}", s.HandleResolveUsername).Methods(http.MethodGet)
+	return r
+}
+
+// accountTestConfig returns a configuration without the key publish rate limit, which these tests exceed
+func accountTestConfig() *configs.ServerConfig {
+	config := configs.DefaultServerConfig()
+	config.KeyPublishRateLimit = configs.RateLimit{PerSecond: 100, Burst: 100}
+	return config
+}
+
+// newTestKeys returns the keys of a device, with its own identity key
+func newTestKeys(t *testing.T) *bob.BobPrekeyBundle {
+	identityKey, err := key_ed25519.New()
+	require.NoError(t, err)
+	prekey, err := key_ed25519.New()
+	require.NoError(t, err)
+	oneTimePrekey, err := key_ed25519.New()
+	require.NoError(t, err)
+	return &bob.BobPrekeyBundle{IdentityKey: *identityKey, Prekey: *prekey, OneTimePrekey: oneTimePrekey}
+}
+
+// accountRequest sends an AccountRequest signed with the identity key of keys, and returns the status code
+func accountRequest(t *testing.T, r http.Handler, method string, path string, keys *bob.BobPrekeyBundle, action string, userID string, deviceID common.DeviceID) int {
+	request, err := common.SignAccountRequest(keys.IdentityKey, action, userID, deviceID)
+	require.NoError(t, err)
+	body, err := json.Marshal(request)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewReader(body)))
+	return rec.Code
+}
+
+// registerTestAccount registers the account of the identity key of keys, and returns its ID
+func registerTestAccount(t *testing.T, r http.Handler, keys *bob.BobPrekeyBundle) string {
+	identityKey, err := keys.IdentityKey.Public()
+	require.NoError(t, err)
+	userID := common.AccountID(*identityKey)
+	code := accountRequest(t, r, http.MethodPost, configs.AccountsPath+"/"+userID, keys, common.AccountRegister, userID, 0)
+	require.Equal(t, http.StatusOK, code)
+	return userID
+}
+
+// postTestKeys publishes the public keys of a device, and returns the status code
+func postTestKeys(t *testing.T, r http.Handler, userID string, deviceID common.DeviceID, keys *bob.BobPrekeyBundle) int {
+	bundle, err := keys.ToPublicBundle()
+	require.NoError(t, err)
+	bundle.OneTimePrekey, err = keys.OneTimePrekey.Public()
+	require.NoError(t, err)
+	data, err := json.Marshal(&bundle)
+	require.NoError(t, err)
+	request, err := common.SignPublishKeysRequest(keys.IdentityKey, userID, deviceID, data)
+	require.NoError(t, err)
+	return publishTestRequest(t, r, userID, deviceID, request)
+}
+
+// publishTestRequest sends a PublishKeysRequest for a device, and returns the status code
+func publishTestRequest(t *testing.T, r http.Handler, userID string, deviceID common.DeviceID, request *common.PublishKeysRequest) int {
+	body, err := json.Marshal(request)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s/%d", configs.PublishKeysPath, userID, deviceID), bytes.NewReader(body)))
+	return rec.Code
+}
+
+// setTestUsername sets the username of an account, and returns the status code
+func setTestUsername(t *testing.T, r http.Handler, userID string, keys *bob.BobPrekeyBundle, username string) int {
+	request, err := common.SignUsernameRequest(keys.IdentityKey, userID, username)
+	require.NoError(t, err)
+	body, err := json.Marshal(request)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, configs.AccountsPath+"/"+userID+"/username", bytes.NewReader(body)))
+	return rec.Code
+}
+
+// getTestAccount fetches path, and returns the status code and the account replied
+func getTestAccount(t *testing.T, r http.Handler, path string) (int, common.Account) {
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var account common.Account
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&account))
+	}
+	return rec.Code, account
+}
+
+func TestRegisterAndRevokeDevice(t *testing.T) {
+	s, mr, _ := newTestServer(t, accountTestConfig())
+	r := accountRouter(s)
+	bobKeys, malloryKeys := newTestKeys(t), newTestKeys(t)
+	bobPub, err := bobKeys.IdentityKey.Public()
+	require.NoError(t, err)
+	bobID := common.AccountID(*bobPub)
+
+	assert.Equal(t, http.StatusForbidden, postTestKeys(t, r, bobID, common.PrimaryDeviceID, bobKeys), "keys need an account")
+	assert.Equal(t, bobID, registerTestAccount(t, r, bobKeys))
+	registerTestAccount(t, r, bobKeys)
+	assert.Equal(t, http.StatusBadRequest, accountRequest(t, r, http.MethodPost, configs.AccountsPath+"/"+bobID, malloryKeys, common.AccountRegister, bobID, 0), "account ID of another key")
+
+	// Devices share the identity key of the account
+	assert.Equal(t, http.StatusForbidden, postTestKeys(t, r, bobID, common.PrimaryDeviceID, malloryKeys))
+	require.Equal(t, http.StatusOK, postTestKeys(t, r, bobID, common.PrimaryDeviceID, bobKeys))
+	secondKeys := newTestKeys(t)
+	secondKeys.IdentityKey = bobKeys.IdentityKey
+	require.Equal(t, http.StatusOK, postTestKeys(t, r, bobID, 2, secondKeys))
+
+	revokePath := fmt.Sprintf("%s/%s/2", configs.PublishKeysPath, bobID)
+	assert.Equal(t, http.StatusForbidden, accountRequest(t, r, http.MethodDelete, revokePath, malloryKeys, common.AccountRevokeDevice, bobID, 2))
+	assert.Equal(t, http.StatusForbidden, accountRequest(t, r, http.MethodDelete, revokePath, bobKeys, common.AccountRevokeDevice, bobID, common.PrimaryDeviceID), "signed for another device")
+	require.Equal(t, http.StatusOK, accountRequest(t, r, http.MethodDelete, revokePath, bobKeys, common.AccountRevokeDevice, bobID, 2))
+	assert.Equal(t, http.StatusNotFound, accountRequest(t, r, http.MethodDelete, revokePath, bobKeys, common.AccountRevokeDevice, bobID, 2))
+
+	members, err := mr.Members(fmt.Sprintf(configs.ServerUserDevicesKey, bobID))
+	require.NoError(t, err)
+	assert.Equal(t, []string{fmt.Sprint(common.PrimaryDeviceID)}, members)
+	assert.False(t, mr.Exists(fmt.Sprintf(configs.ServerUserPubKey, bobID, 2)))
+}
+
+// reserveTestDevice reserves a device ID for the account of keys
+func reserveTestDevice(t *testing.T, r http.Handler, keys *bob.BobPrekeyBundle, userID string) common.DeviceID {
+	request, err := common.SignAccountRequest(keys.IdentityKey, common.AccountReserveDevice, userID, 0)
+	require.NoError(t, err)
+	body, err := json.Marshal(request)
+	require.NoError(t, err)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, configs.AccountsPath+"/"+userID+"/devices", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var reservation common.DeviceReservation
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&reservation))
+	return reservation.DeviceID
+}
+
+func TestReserveDevice(t *testing.T) {
+	s, mr, _ := newTestServer(t, accountTestConfig())
+	r := accountRouter(s)
+	bobKeys, malloryKeys := newTestKeys(t), newTestKeys(t)
+	bobID := registerTestAccount(t, r, bobKeys)
+
+	// Reservations start after the registered devices, and every one gets its own ID
+	mr.SAdd(fmt.Sprintf(configs.ServerUserDevicesKey, bobID), "1", "3")
+	assert.Equal(t, common.DeviceID(4), reserveTestDevice(t, r, bobKeys, bobID))
+	var wg sync.WaitGroup
+	reserved := make([]common.DeviceID, 4)
+	for i := range reserved {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reserved[i] = reserveTestDevice(t, r, bobKeys, bobID)
+		}()
+	}
+	wg.Wait()
+	assert.ElementsMatch(t, []common.DeviceID{5, 6, 7, 8}, reserved)
+
+	// Only the account reserves its devices
+	path := configs.AccountsPath + "/" + bobID + "/devices"
+	assert.Equal(t, http.StatusForbidden, accountRequest(t, r, http.MethodPost, path, malloryKeys, common.AccountReserveDevice, bobID, 0))
+}
+
+func TestReplayedKeysRefused(t *testing.T) {
+	s, mr, _ := newTestServer(t, accountTestConfig())
+	r := accountRouter(s)
+	bobKeys, malloryKeys := newTestKeys(t), newTestKeys(t)
+	bobID := registerTestAccount(t, r, bobKeys)
+	require.Equal(t, http.StatusOK, postTestKeys(t, r, bobID, common.PrimaryDeviceID, bobKeys))
+
+	// Anyone can fetch the bundle of Bob, signed with his identity key, but not publish it for another device
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, configs.PublishKeysPath+"/"+bobID, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var bundles []common.DevicePrekeyBundle
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&bundles))
+	require.Len(t, bundles, 1)
+	fetched, err := json.Marshal(&bundles[0].Bundle)
+	require.NoError(t, err)
+	forged, err := common.SignPublishKeysRequest(malloryKeys.IdentityKey, bobID, 2, fetched)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, publishTestRequest(t, r, bobID, 2, forged))
+
+	// Nor can a request of Bob be replayed for another device
+	signed, err := common.SignPublishKeysRequest(bobKeys.IdentityKey, bobID, common.PrimaryDeviceID, fetched)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, publishTestRequest(t, r, bobID, 2, signed))
+	signed.Bundle = append(json.RawMessage(nil), fetched...)
+	signed.Bundle = append(signed.Bundle[:len(signed.Bundle)-1], []byte(`,"extra":1}`)...)
+	assert.Equal(t, http.StatusForbidden, publishTestRequest(t, r, bobID, common.PrimaryDeviceID, signed), "bundle changed")
+
+	members, err := mr.Members(fmt.Sprintf(configs.ServerUserDevicesKey, bobID))
+	require.NoError(t, err)
+	assert.Equal(t, []string{fmt.Sprint(common.PrimaryDeviceID)}, members)
+}
+
+func TestUsernames(t *testing.T) {
+	s, _, _ := newTestServer(t, accountTestConfig())
+	r := accountRouter(s)
+	bobKeys, malloryKeys := newTestKeys(t), newTestKeys(t)
+	bobID := registerTestAccount(t, r, bobKeys)
+	malloryID := registerTestAccount(t, r, malloryKeys)
+
+	code, account := getTestAccount(t, r, configs.AccountsPath+"/"+bobID)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, common.Account{ID: bobID}, account, "no username yet")
+	require.Equal(t, http.StatusOK, setTestUsername(t, r, bobID, bobKeys, "bob"))
+	assert.Equal(t, http.StatusOK, setTestUsername(t, r, bobID, bobKeys, "bob"))
+	assert.Equal(t, http.StatusConflict, setTestUsername(t, r, malloryID, malloryKeys, "bob"))
+	assert.Equal(t, http.StatusForbidden, setTestUsername(t, r, bobID, malloryKeys, "robert"))
+	assert.Equal(t, http.StatusBadRequest, setTestUsername(t, r, malloryID, malloryKeys, "not a username"))
+
+	code, account = getTestAccount(t, r, configs.UsernamesPath+"/bob")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, common.Account{ID: bobID, Username: "bob"}, account)
+
+	// Renaming frees the previous username, the account ID stays
+	require.Equal(t, http.StatusOK, setTestUsername(t, r, bobID, bobKeys, "robert"))
+	code, _ = getTestAccount(t, r, configs.UsernamesPath+"/bob")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, account = getTestAccount(t, r, configs.AccountsPath+"/"+bobID)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, common.Account{ID: bobID, Username: "robert"}, account)
+	assert.Equal(t, http.StatusOK, setTestUsername(t, r, malloryID, malloryKeys, "bob"))
+
+	// Usernames are compared in lower case
+	assert.Equal(t, http.StatusConflict, setTestUsername(t, r, malloryID, malloryKeys, "Robert"))
+	code, account = getTestAccount(t, r, configs.UsernamesPath+"/ROBERT")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, common.Account{ID: bobID, Username: "robert"}, account)
+
+	code, _ = getTestAccount(t, r, configs.AccountsPath+"/"+common.AccountID(key_ed25519.PublicKey{}))
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestReplayedRequestsRefused(t *testing.T) {
+	s, _, _ := newTestServer(t, accountTestConfig())
+	r := accountRouter(s)
+	bobKeys := newTestKeys(t)
+	bobID := registerTestAccount(t, r, bobKeys)
+
+	send := func(method string, path string, request any) int {
+		body, err := json.Marshal(request)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewReader(body)))
+		return rec.Code
+	}
+
+	// A username change cannot be replayed to take the username back
+	request, err := common.SignUsernameRequest(bobKeys.IdentityKey, bobID, "bob")
+	require.NoError(t, err)
+	usernamePath := configs.AccountsPath + "/" + bobID + "/username"
+	require.Equal(t, http.StatusOK, send(http.MethodPut, usernamePath, request))
+	require.Equal(t, http.StatusOK, setTestUsername(t, r, bobID, bobKeys, "robert"))
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPut, usernamePath, request))
+	_, account := getTestAccount(t, r, configs.AccountsPath+"/"+bobID)
+	assert.Equal(t, "robert", account.Username)
+
+	// Nor can a key publish, to roll the device back to an older bundle
+	bundle, err := bobKeys.ToPublicBundle()
+	require.NoError(t, err)
+	data, err := json.Marshal(&bundle)
+	require.NoError(t, err)
+	publish, err := common.SignPublishKeysRequest(bobKeys.IdentityKey, bobID, common.PrimaryDeviceID, data)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, publishTestRequest(t, r, bobID, common.PrimaryDeviceID, publish))
+	assert.Equal(t, http.StatusForbidden, publishTestRequest(t, r, bobID, common.PrimaryDeviceID, publish))
+}
+
+func TestUsernameClaimedOnce(t *testing.T) {
+	s, _, _ := newTestServer(t, accountTestConfig())
+	r := accountRouter(s)
+	keys := []*bob.BobPrekeyBundle{newTestKeys(t), newTestKeys(t), newTestKeys(t), newTestKeys(t)}
+	userIDs := make([]string, len(keys))
+	for i := range keys {
+		userIDs[i] = registerTestAccount(t, r, keys[i])
+	}
+
+	// Accounts racing for a username, each also freeing the one it had
+	codes := make([]int, len(keys))
+	var wg sync.WaitGroup
+	for i := range keys {
+		require.Equal(t, http.StatusOK, setTestUsername(t, r, userIDs[i], keys[i], fmt.Sprintf("user%d", i)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = setTestUsername(t, r, userIDs[i], keys[i], "alice")
+		}()
+	}
+	wg.Wait()
+
+	winners := 0
+	for i := range keys {
+		code, account := getTestAccount(t, r, fmt.Sprintf("%s/user%d", configs.UsernamesPath, i))
+		if codes[i] == http.StatusOK {
+			winners++
+			assert.Equal(t, http.StatusNotFound, code, "previous username freed")
+		} else {
+			assert.Equal(t, http.StatusConflict, codes[i])
+			assert.Equal(t, http.StatusOK, code)
+			assert.Equal(t, userIDs[i], account.ID)
+		}
+	}
+	assert.Equal(t, 1, winners)
+}
+
+func TestUnregisterDeletesAccount(t *testing.T) {
+	s, mr, httpServer := newTestServer(t, accountTestConfig())
+	r := accountRouter(s)
+	bobKeys := newTestKeys(t)
+	bobID := registerTestAccount(t, r, bobKeys)
+	require.Equal(t, http.StatusOK, setTestUsername(t, r, bobID, bobKeys, "bob"))
+	require.Equal(t, http.StatusOK, postTestKeys(t, r, bobID, common.PrimaryDeviceID, bobKeys))
+
+	// A message waits in the mailbox of Bob
+	alice := dialTestServer(t, mr, httpServer, "alice", bobID)
+	connected(t, s, 1)
+	require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: bobID, ToDevice: common.PrimaryDeviceID, Message: []byte("hello")}))
+	key := connKey{from: bobID, device: common.PrimaryDeviceID, to: "alice"}
+	require.Eventually(t, func() bool { return mr.Exists(mailboxKey(key)) }, time.Second, 10*time.Millisecond)
+
+	// A device that does not exist is not a deleted account
+	require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: bobID, ToDevice: 2, Message: []byte("hello")}))
+	alice.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err := alice.ReadMessage()
+	require.Error(t, err, "no reply")
+	alice = dialTestServer(t, mr, httpServer, "alice", bobID)
+	connected(t, s, 1)
+
+	unregisterPath := configs.AccountsPath + "/" + bobID
+	assert.Equal(t, http.StatusForbidden, accountRequest(t, r, http.MethodDelete, unregisterPath, newTestKeys(t), common.AccountUnregister, bobID, 0))
+	require.Equal(t, http.StatusOK, accountRequest(t, r, http.MethodDelete, unregisterPath, bobKeys, common.AccountUnregister, bobID, 0))
+	assert.Equal(t, http.StatusNotFound, accountRequest(t, r, http.MethodDelete, unregisterPath, bobKeys, common.AccountUnregister, bobID, 0))
+
+	// Alice is told, and told again when she sends another message
+	for i := 0; i < 2; i++ {
+		var reply common.ErrorReply
+		alice.SetReadDeadline(time.Now().Add(time.Second))
+		require.NoError(t, alice.ReadJSON(&reply))
+		assert.Equal(t, common.ErrorAccountDeleted, reply.Code)
+		assert.Equal(t, bobID, reply.To)
+		require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: bobID, ToDevice: common.PrimaryDeviceID, Message: []byte("hello")}))
+	}
+
+	for _, key := range []string{
+		fmt.Sprintf(configs.ServerAccountKey, bobID), fmt.Sprintf(configs.ServerUserDevicesKey, bobID),
+		fmt.Sprintf(configs.ServerAccountUsernameKey, bobID), fmt.Sprintf(configs.ServerUsernameKey, "bob"),
+		fmt.Sprintf(configs.ServerUserPubKey, bobID, common.PrimaryDeviceID), mailboxKey(key), queueBytesKey(key), queuesKey(key),
+		fmt.Sprintf(configs.ServerLastDeviceKey, bobID),
+	} {
+		assert.False(t, mr.Exists(key), key)
+	}
+	members, _ := mr.Members(configs.ServerDirectoryKey)
+	assert.Empty(t, members)
+
+	// The username is free again
+	carolKeys := newTestKeys(t)
+	assert.Equal(t, http.StatusOK, setTestUsername(t, r, registerTestAccount(t, r, carolKeys), carolKeys, "bob"))
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"minimal-signal/common"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseReasonSlowConsumer is the reason of the close frame, with the CloseTryAgainLater code, sent to a device
+// that does not read its messages fast enough. Its messages are kept in its offline queue.
+const CloseReasonSlowConsumer = "slow_consumer"
+
+// outgoing is a frame waiting to be written to a device
+type outgoing struct {
+	data []byte
+	// msg is the message data encodes, nil for frames that are not kept if the device is gone, like error replies
+	msg *common.MessageBundle
+}
+
+// deviceConn is the WebSocket connection of a device. A single writer goroutine writes the frames given
+// to deliver, the handler goroutine of the connection reads.
+type deviceConn struct {
+	key connKey
+	ws  *websocket.Conn
+
+	send chan outgoing
+	// wakeup tells the writer to deliver the mailbox of the device, which has new messages
+	wakeup chan struct{}
+	// stop is closed to stop the writer, which then moves the undelivered messages to the offline queue
+	stop chan struct{}
+	// done is closed once the writer returned
+	done chan struct{}
+
+	// mutex guards the fields below
+	mutex sync.Mutex
+	// stopping is set once stop is closed
+	stopping bool
+	// slow is set if the device did not read its messages fast enough
+	slow bool
+	// backlog is set while the mailbox of the device is delivered, messages given meanwhile go to the mailbox
+	// after it instead of the buffer, so that they neither overtake it nor count as the device being slow
+	backlog bool
+	// overflow holds the messages given after the writer was stopped, they are queued after the buffered ones
+	overflow []outgoing
+	// spilled is set once the undelivered messages are queued, the next ones must be queued by the caller
+	spilled bool
+}
+
+func (s *Server) newDeviceConn(key connKey, ws *websocket.Conn) *deviceConn {
+	return &deviceConn{
+		key:    key,
+		ws:     ws,
+		send:   make(chan outgoing, s.config.SendBufferSize),
+		wakeup: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		// The mailbox is delivered before the writer starts
+		backlog: true,
+	}
+}
+
+// setBacklog records whether the mailbox of the device is being delivered
+func (c *deviceConn) setBacklog(backlog bool) {
+	c.mutex.Lock()
+	c.backlog = backlog
+	c.mutex.Unlock()
+}
+
+// wake tells the writer that the mailbox of the device has new messages
+func (c *deviceConn) wake() {
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// deliver hands a frame to the writer. If the device does not keep up, the connection is closed and the
+// message is queued along the ones still buffered. It returns false if the connection is already gone or
+// its mailbox is being delivered, the caller must queue the message itself. Frames that are not queued, like
+// error replies and ephemeral messages, are dropped instead while the buffer is full during the backlog.
+func (c *deviceConn) deliver(o outgoing) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.spilled {
+		return false
+	}
+	if c.stopping {
+		c.overflow = append(c.overflow, o)
+		return true
+	}
+	if c.backlog && o.msg != nil && !o.msg.Ephemeral {
+		return false
+	}
+	select {
+	case c.send <- o:
+	default:
+		if c.backlog {
+			return false
+		}
+		c.slow = true
+		c.overflow = append(c.overflow, o)
+		c.stopLocked()
+	}
+	return true
+}
+
+// close stops the writer and waits until the undelivered messages are queued
+func (c *deviceConn) close() {
+	c.mutex.Lock()
+	c.stopLocked()
+	c.mutex.Unlock()
+	<-c.done
+}
+
+// abort closes a connection whose writer never started, and queues the messages given to it meanwhile
+func (s *Server) abort(c *deviceConn) {
+	c.ws.Close()
+	s.stopWriter(c, nil)
+	close(c.done)
+}
+
+// stopLocked stops the writer. Must hold mutex.
+func (c *deviceConn) stopLocked() {
+	if !c.stopping {
+		c.stopping = true
+		close(c.stop)
+	}
+}
+
+// write writes a frame, failing if it takes longer than the write timeout
+func (s *Server) write(ws *websocket.Conn, messageType int, data []byte) error {
+	ws.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	return ws.WriteMessage(messageType, data)
+}
+
+// runWriter writes the frames given to deliver and the mailbox of the device when woken up, and pings the device,
+// until the connection is stopped or fails. Messages it could not write are queued.
+func (s *Server) runWriter(c *deviceConn) {
+	defer close(c.done)
+	ticker := time.NewTicker(s.config.PingInterval())
+	defer ticker.Stop()
+
+	for {
+		// Stopping wins over writing what is buffered
+		select {
+		case <-c.stop:
+			s.stopWriter(c, nil)
+			return
+		default:
+		}
+
+		select {
+		case <-c.stop:
+			s.stopWriter(c, nil)
+			return
+		case o := <-c.send:
+			if err := s.write(c.ws, websocket.TextMessage, o.data); err != nil {
+				s.connLogger(c.key).Errorf("Error sending to device: %v", err)
+				s.stopWriter(c, &o)
+				return
+			}
+		case <-c.wakeup:
+			c.setBacklog(true)
+			delivered := s.retrieveQueuedMessages(c.key, c.ws)
+			c.setBacklog(false)
+			if !delivered {
+				c.ws.Close()
+				s.stopWriter(c, nil)
+				return
+			}
+		case <-ticker.C:
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.config.WriteTimeout)); err != nil {
+				s.connLogger(c.key).Errorf("Error pinging device: %v", err)
+				s.stopWriter(c, nil)
+				return
+			}
+			// In case a wake-up was lost
+			c.wake()
+		}
+	}
+}
+
+// stopWriter closes the connection if it is broken or the device is too slow, so that the reader stops too,
+// and queues the undelivered messages in order: failed, then the buffered ones, then the overflow
+func (s *Server) stopWriter(c *deviceConn, failed *outgoing) {
+	c.mutex.Lock()
+	c.stopLocked()
+	slow := c.slow
+	c.mutex.Unlock()
+
+	if slow {
+		s.connLogger(c.key).Warn("Device is too slow, closing connection")
+		s.metrics.slowConsumers.Inc()
+		closeMsg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, CloseReasonSlowConsumer)
+		c.ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(s.config.WriteTimeout))
+	}
+	if failed != nil || slow {
+		c.ws.Close()
+	}
+
+	var undelivered []outgoing
+	if failed != nil {
+		undelivered = append(undelivered, *failed)
+	}
+	// Messages given while these are queued go to the overflow, and are queued after them
+	for {
+		c.mutex.Lock()
+		for len(c.send) > 0 {
+			undelivered = append(undelivered, <-c.send)
+		}
+		undelivered = append(undelivered, c.overflow...)
+		c.overflow = nil
+		if len(undelivered) == 0 {
+			c.spilled = true
+			c.mutex.Unlock()
+			return
+		}
+		c.mutex.Unlock()
+
+		for _, o := range undelivered {
+			if o.msg == nil {
+				continue
+			}
+			if err := s.queueMessage(c.key, o.msg); err != nil {
+				s.messageLogger(o.msg).Errorf("Error queuing undelivered message: %v", err)
+				s.metrics.queueFailed(err)
+			}
+		}
+		undelivered = nil
+	}
+}
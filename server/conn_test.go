@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestWebSocketPair returns both ends of a WebSocket connection
+func newTestWebSocketPair(t *testing.T) (server *websocket.Conn, client *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		conns <- conn
+	}))
+	t.Cleanup(httpServer.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	server = <-conns
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+func TestSlowConsumerSpillsToQueue(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.SendBufferSize = 2
+	s, mr, _ := newTestServer(t, config)
+	serverWS, clientWS := newTestWebSocketPair(t)
+	key := connKey{from: "bob", device: common.PrimaryDeviceID, to: "alice"}
+	conn := s.newDeviceConn(key, serverWS)
+	conn.setBacklog(false)
+
+	// The writer does not run yet, as if it was stuck writing to the device
+	for i := 0; i < 4; i++ {
+		msg := &common.MessageBundle{From: "alice", To: "bob", ToDevice: common.PrimaryDeviceID, Message: []byte{byte(i)}}
+		assert.True(t, conn.deliver(outgoing{data: []byte("message"), msg: msg}))
+	}
+	// Error replies are dropped
+	assert.True(t, conn.deliver(outgoing{data: []byte("reply")}))
+
+	s.runWriter(conn)
+	assert.False(t, conn.deliver(outgoing{data: []byte("late")}), "the caller queues messages once the connection is gone")
+
+	queued := mailbox(t, mr, key)
+	require.Len(t, queued, 4)
+	for i, msg := range queued {
+		assert.Equal(t, []byte{byte(i)}, msg.Message.Message, "queued in order")
+	}
+
+	clientWS.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := clientWS.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.CloseTryAgainLater, closeErr.Code)
+	assert.Equal(t, CloseReasonSlowConsumer, closeErr.Text)
+}
+
+func TestBacklogNotSlow(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.SendBufferSize = 1
+	s, _, _ := newTestServer(t, config)
+	serverWS, _ := newTestWebSocketPair(t)
+	conn := s.newDeviceConn(connKey{from: "bob", device: common.PrimaryDeviceID, to: "alice"}, serverWS)
+
+	// While the mailbox is delivered, messages go to the mailbox after it, the rest while there is room
+	for i := 0; i < 3; i++ {
+		msg := &common.MessageBundle{From: "alice", To: "bob", ToDevice: common.PrimaryDeviceID, Message: []byte{byte(i)}}
+		assert.False(t, conn.deliver(outgoing{data: []byte("message"), msg: msg}))
+	}
+	assert.True(t, conn.deliver(outgoing{data: []byte("reply")}))
+	assert.False(t, conn.deliver(outgoing{data: []byte("reply")}))
+	assert.False(t, conn.slow)
+	assert.False(t, conn.stopping)
+
+	// Afterwards, a device that does not keep up is slow
+	conn.setBacklog(false)
+	assert.True(t, conn.deliver(outgoing{data: []byte("reply")}))
+	assert.True(t, conn.slow)
+}
+
+func TestUnresponsiveDeviceDisconnected(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.PongTimeout = 100 * time.Millisecond
+	s, mr, httpServer := newTestServer(t, config)
+
+	// Reading answers pings
+	alive := dialTestServer(t, mr, httpServer, "alice", "bob")
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// This one never reads, so it never answers
+	dialTestServer(t, mr, httpServer, "bob", "alice")
+	connected(t, s, 2)
+
+	time.Sleep(3 * config.PongTimeout)
+	connected(t, s, 1)
+	s.mutex.Lock()
+	_, ok := s.connectedUsers[connKey{from: "alice", device: common.PrimaryDeviceID, to: "bob"}]
+	s.mutex.Unlock()
+	assert.True(t, ok)
+}
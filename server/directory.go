@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"net/http"
+)
+
+// The directory tells clients which of their contacts are still registered, so that the contacts list can show
+// the ones that deleted their account. Every user with a published key bundle is in it, a Redis set of their
+// common.DirectoryHash. Users registered before the directory are added the next time one of their devices
+// publishes its keys, which clients do each time they start.
+
+// HandleDirectory replies which of the users of a common.DirectoryRequest are registered. Every user looked up
+// takes a token from the rate limit of the IP address, so that the directory cannot be enumerated quickly.
+func (s *Server) HandleDirectory(w http.ResponseWriter, r *http.Request) {
+	var request common.DirectoryRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&request); err != nil {
+		s.logger.Errorf("Error decoding directory request: %v", err)
+		http.Error(w, "Invalid directory request", http.StatusBadRequest)
+		return
+	}
+	if len(request.Hashes) > configs.MaxDirectoryHashes {
+		http.Error(w, fmt.Sprintf("At most %d users may be looked up at once", configs.MaxDirectoryHashes), http.StatusBadRequest)
+		return
+	}
+	if !s.allowRequestN(w, r, s.directoryLimiter, max(len(request.Hashes), 1)) {
+		return
+	}
+
+	response := common.DirectoryResponse{Registered: []string{}}
+	if len(request.Hashes) > 0 {
+		hashes := make([]any, len(request.Hashes))
+		for i, hash := range request.Hashes {
+			hashes[i] = hash
+		}
+		registered, err := s.redisClient.SMIsMember(s.ctx, configs.ServerDirectoryKey, hashes...).Result()
+		if err != nil {
+			s.logger.Errorf("Error looking up directory: %v", err)
+			http.Error(w, "Error looking up directory", http.StatusInternalServerError)
+			return
+		}
+		for i, ok := range registered {
+			if ok {
+				response.Registered = append(response.Registered, request.Hashes[i])
+			}
+		}
+	}
+	s.metrics.directoryLookups.Add(float64(len(request.Hashes)))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&response); err != nil {
+		s.logger.Errorf("Error encoding directory response: %v", err)
+	}
+}
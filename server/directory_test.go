@@ -0,0 +1,54 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirectory(t *testing.T) {
+	s, mr, _ := newTestServer(t, configs.DefaultServerConfig())
+	r := mux.NewRouter()
+	r.HandleFunc(configs.DirectoryPath, s.HandleDirectory).Methods(http.MethodPost)
+	r.HandleFunc(configs.PublishKeysPath+"/{userID}", s.HandleGetKeys).Methods(http.MethodGet)
+	mr.SAdd(configs.ServerDirectoryKey, common.DirectoryHash("bob"))
+
+	lookup := func(hashes ...string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(&common.DirectoryRequest{Hashes: hashes})
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, configs.DirectoryPath, bytes.NewReader(body)))
+		return rec
+	}
+
+	rec := lookup(common.DirectoryHash("bob"), common.DirectoryHash("carol"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var response common.DirectoryResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	assert.Equal(t, []string{common.DirectoryHash("bob")}, response.Registered)
+
+	hashes := make([]string, configs.MaxDirectoryHashes+1)
+	for i := range hashes {
+		hashes[i] = common.DirectoryHash(fmt.Sprint(i))
+	}
+	assert.Equal(t, http.StatusBadRequest, lookup(hashes...).Code)
+
+	// Every user looked up counts towards the rate limit, the first request took 2
+	assert.Equal(t, http.StatusOK, lookup(hashes[:configs.MaxDirectoryHashes-2]...).Code)
+	assert.Equal(t, http.StatusTooManyRequests, lookup(hashes[0]).Code)
+
+	// Unknown users have no keys
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, configs.PublishKeysPath+"/carol", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
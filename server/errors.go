@@ -0,0 +1,9 @@
+package server
+
+import "errors"
+
+var (
+	ErrQueueFull            = errors.New("message queue of recipient is full")
+	ErrUnknownUser          = errors.New("no device registered")
+	ErrNoProvisioningDevice = errors.New("no device waiting for provisioning code")
+)
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// healthCheckTimeout is how long Redis may take to answer a health check
+const healthCheckTimeout = 2 * time.Second
+
+// HandleHealth replies 200 OK if the server can reach Redis, 503 Service Unavailable otherwise
+func (s *Server) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if err := s.pingRedis(r.Context()); err != nil {
+		s.logger.Errorf("Health check failed: %v", err)
+		http.Error(w, "Redis unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// HandleReady replies 200 OK if the server accepts connections: it can reach Redis and is not shutting down
+func (s *Server) HandleReady(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	draining := s.draining
+	s.mutex.Unlock()
+	if draining {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	s.HandleHealth(w, r)
+}
+
+func (s *Server) pingRedis(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	return s.redisClient.Ping(ctx).Err()
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"minimal-signal/configs"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	s, mr, _ := newTestServer(t, configs.DefaultServerConfig())
+	check := func(handler http.HandlerFunc) int {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, check(s.HandleHealth))
+	assert.Equal(t, http.StatusOK, check(s.HandleReady))
+
+	// A draining server is healthy but no longer ready
+	s.mutex.Lock()
+	s.draining = true
+	s.mutex.Unlock()
+	assert.Equal(t, http.StatusOK, check(s.HandleHealth))
+	assert.Equal(t, http.StatusServiceUnavailable, check(s.HandleReady))
+
+	mr.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, check(s.HandleHealth))
+}
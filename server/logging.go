@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logs carry metadata only: who talks to whom, sizes and counters, whether keys are present.
+// Key material and ciphertext never reach the logger, and user IDs and IP addresses are hashed if
+// ServerConfig.LogHashUserIDs is set, with a secret key so that the hashes cannot be computed from a list of them.
+
+// ConfigureLogger applies the log level and format of config to logger
+func ConfigureLogger(logger *logrus.Logger, config *configs.ServerConfig) error {
+	level, err := logrus.ParseLevel(config.LogLevel)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+	logger.SetLevel(level)
+	if config.LogFormat == "json" {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	}
+	return nil
+}
+
+// newLogHashKey returns the key user IDs are hashed with, nil if they are logged as is
+func newLogHashKey(config *configs.ServerConfig, logger *logrus.Logger) []byte {
+	if !config.LogHashUserIDs {
+		return nil
+	}
+	if config.LogHashKey != "" {
+		key, err := hex.DecodeString(config.LogHashKey)
+		if err != nil {
+			panic(fmt.Sprintf("invalid log hash key: %v", err))
+		}
+		return key
+	}
+	logger.Warn("No log hash key is set, hashes in logs change when the server restarts")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("failed to generate log hash key: %v", err))
+	}
+	return key
+}
+
+// logUser returns how a user ID appears in logs
+func (s *Server) logUser(userID string) string {
+	if s.logHashKey == nil {
+		return userID
+	}
+	mac := hmac.New(sha256.New, s.logHashKey)
+	mac.Write([]byte(userID))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// logAddr returns how the IP address of a remote address appears in logs, hashed like user IDs
+func (s *Server) logAddr(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return s.logUser(host)
+}
+
+// userLogger returns a logger for the requests of a user
+func (s *Server) userLogger(userID string) *logrus.Entry {
+	return s.logger.WithField("user", s.logUser(userID))
+}
+
+// deviceLogger returns a logger for a device of a user
+func (s *Server) deviceLogger(userID string, deviceID common.DeviceID) *logrus.Entry {
+	return s.userLogger(userID).WithField("device", deviceID)
+}
+
+// connLogger returns a logger for a connection
+func (s *Server) connLogger(key connKey) *logrus.Entry {
+	return s.deviceLogger(key.from, key.device).WithField("peer", s.logUser(key.to))
+}
+
+// messageLogger returns a logger for a message, with its sender and recipient
+func (s *Server) messageLogger(msg *common.MessageBundle) *logrus.Entry {
+	return s.logger.WithFields(logrus.Fields{
+		"from":        s.logUser(msg.From),
+		"from_device": msg.FromDevice,
+		"to":          s.logUser(msg.To),
+		"to_device":   msg.ToDevice,
+	})
+}
+
+// dumpMessage logs the metadata of a message at debug level, if LogMessageDumps is set
+func (s *Server) dumpMessage(msg *common.MessageBundle) {
+	if !s.config.LogMessageDumps {
+		return
+	}
+	s.messageLogger(msg).WithFields(logrus.Fields{
+		"size":         len(msg.Message),
+		"n":            msg.Header.N,
+		"pn":           msg.Header.Pn,
+		"handshake":    msg.Handshake != nil,
+		"expire_timer": msg.ExpireTimer,
+		"ephemeral":    msg.Ephemeral,
+	}).Debug("Message")
+}
+
+// dumpBundles logs the devices of prekey bundles at debug level, if LogMessageDumps is set
+func (s *Server) dumpBundles(userID string, what string, bundles []common.DevicePrekeyBundle) {
+	if !s.config.LogMessageDumps {
+		return
+	}
+	devices := make([]common.DeviceID, len(bundles))
+	oneTimePrekeys := 0
+	for i, bundle := range bundles {
+		devices[i] = bundle.DeviceID
+		if bundle.Bundle.OneTimePrekey != nil {
+			oneTimePrekeys++
+		}
+	}
+	s.userLogger(userID).WithFields(logrus.Fields{
+		"devices":          devices,
+		"one_time_prekeys": oneTimePrekeys,
+	}).Debug(what)
+}
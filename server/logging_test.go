@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/crypto/key_ed25519"
+	"minimal-signal/protocol/doubleratchet"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// secretKey returns a public key filled with b, easy to find in logs
+func secretKey(b byte) key_ed25519.PublicKey {
+	var key key_ed25519.PublicKey
+	for i := range key {
+		key[i] = b
+	}
+	return key
+}
+
+// requireNotLogged fails if an entry logged to hook contains secret, in any of the usual encodings
+func requireNotLogged(t *testing.T, hook *test.Hook, secret []byte) {
+	t.Helper()
+	forms := []string{string(secret), hex.EncodeToString(secret), base64.StdEncoding.EncodeToString(secret), fmt.Sprint(secret)}
+	for _, entry := range hook.AllEntries() {
+		logged, err := entry.String()
+		require.NoError(t, err)
+		for _, form := range forms {
+			require.NotContains(t, logged, form)
+		}
+	}
+}
+
+func TestLogsRedactSecrets(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.LogLevel = "debug"
+	config.LogMessageDumps = true
+	config.LogHashUserIDs = true
+	logger, hook := test.NewNullLogger()
+	require.NoError(t, ConfigureLogger(logger, config))
+	mr := miniredis.RunT(t)
+	s := NewServer(context.Background(), config, redis.NewClient(&redis.Options{Addr: mr.Addr()}), logger)
+	t.Cleanup(s.Close)
+
+	r := accountRouter(s)
+	r.HandleFunc(configs.WebSocketPath, s.HandleConnections)
+	httpServer := httptest.NewServer(r)
+	t.Cleanup(httpServer.Close)
+
+	// Account registered, key bundles published and fetched
+	keys := newTestKeys(t)
+	bobID := registerTestAccount(t, r, keys)
+	require.Equal(t, http.StatusOK, setTestUsername(t, r, bobID, keys, "bob"))
+	require.Equal(t, http.StatusOK, postTestKeys(t, r, bobID, common.PrimaryDeviceID, keys))
+	bundle, err := keys.ToPublicBundle()
+	require.NoError(t, err)
+	oneTimePrekey, err := keys.OneTimePrekey.Public()
+	require.NoError(t, err)
+	resp, err := http.Get(fmt.Sprintf("%s%s/%s", httpServer.URL, configs.PublishKeysPath, bobID))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A message relayed from Alice to Bob
+	alice := dialTestServer(t, mr, httpServer, "alice", bobID)
+	bob := dialTestDevice(t, httpServer, keys.IdentityKey, bobID, common.PrimaryDeviceID, "alice")
+	connected(t, s, 2)
+	msg := &common.MessageBundle{
+		To:        bobID,
+		ToDevice:  common.PrimaryDeviceID,
+		Message:   []byte("attack at dawn"),
+		Header:    doubleratchet.Header{RatchetPub: secretKey(0xb1), N: 3},
+		Handshake: &common.X3DHHandshakeBundle{EphPubKey: secretKey(0xb2), OneTimePubKey: oneTimePrekey},
+	}
+	copy(msg.AD[:], bytes.Repeat([]byte{0xb3}, 64))
+	require.NoError(t, alice.WriteJSON(msg))
+	bob.SetReadDeadline(time.Now().Add(time.Second))
+	var received common.MessageBundle
+	require.NoError(t, bob.ReadJSON(&received))
+	require.Eventually(t, func() bool {
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Message" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	for _, secret := range [][]byte{
+		[]byte("attack at dawn"), bundle.IdentityKey[:], bundle.Prekey[:], bundle.PrekeySig, oneTimePrekey[:],
+		msg.Header.RatchetPub[:], msg.Handshake.EphPubKey[:], msg.AD[:],
+	} {
+		requireNotLogged(t, hook, secret)
+	}
+
+	// Metadata is logged, with hashed user IDs
+	var dumps int
+	for _, entry := range hook.AllEntries() {
+		logged, err := entry.String()
+		require.NoError(t, err)
+		assert.NotContains(t, logged, "alice")
+		assert.NotContains(t, logged, bobID)
+		if entry.Message == "Message" {
+			dumps++
+			assert.Equal(t, logrus.DebugLevel, entry.Level)
+			assert.Equal(t, len("attack at dawn"), entry.Data["size"])
+			assert.Equal(t, s.logUser(bobID), entry.Data["to"])
+		}
+	}
+	assert.Equal(t, 1, dumps)
+}
+
+func TestMessageDumpsDisabledByDefault(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	s := NewServer(context.Background(), configs.DefaultServerConfig(), nil, logger)
+
+	s.dumpMessage(&common.MessageBundle{From: "alice", To: "bob"})
+	assert.Empty(t, hook.AllEntries())
+	assert.Equal(t, "alice", s.logUser("alice"), "user IDs are only hashed if configured")
+}
+
+func TestLogHashKeyFromConfig(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.LogHashUserIDs = true
+	config.LogHashKey = hex.EncodeToString(bytes.Repeat([]byte{0x42}, 32))
+	logger, hook := test.NewNullLogger()
+	s1 := NewServer(context.Background(), config, nil, logger)
+	s2 := NewServer(context.Background(), config, nil, logger)
+	assert.Empty(t, hook.AllEntries(), "no warning about a random key")
+
+	// Servers sharing the key, or restarted, hash alike
+	assert.Equal(t, s1.logUser("alice"), s2.logUser("alice"))
+	assert.NotEqual(t, "alice", s1.logUser("alice"))
+
+	// IP addresses are hashed without their port
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	s1.replyRateLimited(httptest.NewRecorder(), r, logrus.NewEntry(logger), time.Second)
+	require.Len(t, hook.AllEntries(), 1)
+	logged, err := hook.LastEntry().String()
+	require.NoError(t, err)
+	assert.NotContains(t, logged, "192.0.2.1")
+	assert.Contains(t, logged, s1.logUser("192.0.2.1"))
+	assert.Equal(t, s1.logAddr("192.0.2.1:1234"), s1.logAddr("192.0.2.1:5678"))
+}
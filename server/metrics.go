@@ -0,0 +1,142 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serverMetrics holds the Prometheus metrics of a server. Each server has its own registry,
+// so that several of them can run in one process.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	queuedMessages          prometheus.Counter
+	deliveredQueuedMessages prometheus.Counter
+	expiredMessages         prometheus.Counter
+	queueRejected           prometheus.Counter
+	queueDepth              prometheus.Histogram
+	queueSize               prometheus.Histogram
+	slowConsumers           prometheus.Counter
+	routedMessages          prometheus.Counter
+	relayedMessages         prometheus.Counter
+	droppedMessages         *prometheus.CounterVec
+	keyFetches              prometheus.Counter
+	keyPublishes            prometheus.Counter
+	directoryLookups        prometheus.Counter
+}
+
+// Reasons a message is dropped, the reason label of droppedMessages
+const (
+	dropInvalid       = "invalid"
+	dropUnknownDevice = "unknown_device"
+	dropQueueFull     = "queue_full"
+	dropQueueError    = "queue_error"
+	dropEphemeral     = "ephemeral"
+)
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		queuedMessages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minimal_signal_queued_messages_total",
+			Help: "Messages queued for offline devices.",
+		}),
+		deliveredQueuedMessages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minimal_signal_delivered_queued_messages_total",
+			Help: "Queued messages delivered when their device connected.",
+		}),
+		expiredMessages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minimal_signal_expired_queued_messages_total",
+			Help: "Queued messages dropped because they expired before their device connected.",
+		}),
+		queueRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minimal_signal_queue_rejected_messages_total",
+			Help: "Messages refused because the queue of their device was full.",
+		}),
+		queueDepth: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "minimal_signal_queue_depth_messages",
+			Help:    "Number of messages queued for a device, observed each time a message is queued.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 7),
+		}),
+		queueSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "minimal_signal_queue_size_bytes",
+			Help:    "Size of the messages queued for a device, observed each time a message is queued.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+		}),
+		slowConsumers: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minimal_signal_slow_consumers_total",
+			Help: "Connections closed because their device did not read its messages fast enough.",
+		}),
+		routedMessages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minimal_signal_routed_messages_total",
+			Help: "Wake-ups and ephemeral messages published to the server their device is connected to.",
+		}),
+		relayedMessages: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minimal_signal_relayed_messages_total",
+			Help: "Messages handed to the connection of their device on this server.",
+		}),
+		droppedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "minimal_signal_dropped_messages_total",
+			Help: "Messages neither delivered nor queued, by reason.",
+		}, []string{"reason"}),
+		keyFetches: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minimal_signal_key_fetches_total",
+			Help: "Prekey bundles of users fetched.",
+		}),
+		keyPublishes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minimal_signal_key_publishes_total",
+			Help: "Prekey bundles of devices published.",
+		}),
+		directoryLookups: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "minimal_signal_directory_lookups_total",
+			Help: "Users looked up in the directory.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.queuedMessages,
+		m.deliveredQueuedMessages,
+		m.expiredMessages,
+		m.queueRejected,
+		m.queueDepth,
+		m.queueSize,
+		m.slowConsumers,
+		m.routedMessages,
+		m.relayedMessages,
+		m.droppedMessages,
+		m.keyFetches,
+		m.keyPublishes,
+		m.directoryLookups,
+	)
+	return m
+}
+
+// registerGauges registers the metrics read from the state of s when they are scraped
+func (s *Server) registerGauges() {
+	s.metrics.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "minimal_signal_connected_devices",
+			Help: "Connections of devices to this server, one per peer they talk to.",
+		}, func() float64 {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			return float64(len(s.connectedUsers))
+		}),
+	)
+}
+
+// queueFailed counts a message dropped because it could not be queued
+func (m *serverMetrics) queueFailed(err error) {
+	if errors.Is(err, ErrQueueFull) {
+		m.droppedMessages.WithLabelValues(dropQueueFull).Inc()
+	} else {
+		m.droppedMessages.WithLabelValues(dropQueueError).Inc()
+	}
+}
+
+// HandleMetrics serves the metrics of the server in the Prometheus format
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
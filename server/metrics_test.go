@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	s, mr, httpServer := newTestServer(t, configs.DefaultServerConfig())
+	mr.SAdd(fmt.Sprintf(configs.ServerUserDevicesKey, "bob"), fmt.Sprint(common.PrimaryDeviceID))
+	alice := dialTestServer(t, mr, httpServer, "alice", "bob")
+	bob := dialTestServer(t, mr, httpServer, "bob", "alice")
+	connected(t, s, 2)
+
+	require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: "bob", ToDevice: common.PrimaryDeviceID, Message: []byte("hello")}))
+	var received common.MessageBundle
+	bob.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, bob.ReadJSON(&received))
+	require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: "carol", ToDevice: common.PrimaryDeviceID, Message: []byte("hello")}))
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.metrics.droppedMessages.WithLabelValues(dropUnknownDevice)) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.relayedMessages))
+
+	rec := httptest.NewRecorder()
+	s.HandleMetrics(rec, httptest.NewRequest(http.MethodGet, configs.MetricsPath, nil))
+	assert.Contains(t, rec.Body.String(), "minimal_signal_connected_devices 2\n")
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"minimal-signal/configs"
+	"minimal-signal/protocol/provisioning"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// The new device may wait on another server than the one the envelope is posted to. The server it waits on
+// records it under the code in Redis and subscribes to the provisioning channel of the code, the envelope is
+// published there unless it is posted to that same server.
+
+// provisioningKey and provisioningChannel return the Redis key and channel of a provisioning code
+func provisioningKey(code string) string {
+	return fmt.Sprintf(configs.ServerProvisioningKey, code)
+}
+
+func provisioningChannel(code string) string {
+	return fmt.Sprintf(configs.ServerProvisioningChannel, code)
+}
+
+// HandleProvisioning keeps the WebSocket of a new device open until an existing device of the account
+// sends it a provisioning envelope, addressed with the code the new device shows
+func (s *Server) HandleProvisioning(w http.ResponseWriter, r *http.Request) {
+	if !s.allowRequest(w, r, s.provisioningLimiter) {
+		return
+	}
+	code := r.URL.Query().Get("id")
+	if _, err := provisioning.ParseCode(code); err != nil {
+		s.logger.Errorf("Invalid provisioning code: %v", err)
+		http.Error(w, "Invalid provisioning code", http.StatusBadRequest)
+		return
+	}
+	if !s.startHandler(w) {
+		return
+	}
+	defer s.handlers.Done()
+
+	// Only one device waits for a code, on any server
+	claimed, err := s.redisClient.SetNX(s.ctx, provisioningKey(code), s.instanceID, s.config.ProvisioningTimeout).Result()
+	if err != nil {
+		s.logger.Errorf("Error claiming provisioning code: %v", err)
+		http.Error(w, "Error claiming provisioning code", http.StatusInternalServerError)
+		return
+	} else if !claimed {
+		s.logger.Error("A device is already waiting for this provisioning code")
+		http.Error(w, "A device is already waiting for this code", http.StatusConflict)
+		return
+	}
+	defer func() {
+		if err := releasePresenceScript.Run(s.ctx, s.redisClient, []string{provisioningKey(code)}, s.instanceID).Err(); err != nil {
+			s.logger.Errorf("Error releasing provisioning code: %v", err)
+		}
+	}()
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Errorf("Error upgrading to WebSocket: %v", err)
+		return
+	}
+	defer ws.Close()
+
+	s.mutex.Lock()
+	s.provisioningConns[code] = ws
+	s.mutex.Unlock()
+	pubsub, err := s.subscription()
+	if err == nil {
+		err = pubsub.Subscribe(s.ctx, provisioningChannel(code))
+	}
+	if err != nil {
+		// Envelopes posted to this server still reach the device
+		s.logger.Errorf("Error subscribing to provisioning channel: %v", err)
+	}
+	s.logger.Infof("Device waiting for provisioning")
+
+	// The new device closes the socket once it got the envelope, give up if it never comes
+	ws.SetReadDeadline(time.Now().Add(s.config.ProvisioningTimeout))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	s.mutex.Lock()
+	if s.provisioningConns[code] == ws {
+		delete(s.provisioningConns, code)
+	}
+	s.mutex.Unlock()
+	if pubsub != nil {
+		if err := pubsub.Unsubscribe(s.ctx, provisioningChannel(code)); err != nil {
+			s.logger.Errorf("Error unsubscribing from provisioning channel: %v", err)
+		}
+	}
+}
+
+// HandlePostProvisioning relays a provisioning envelope to the new device waiting for it, on this server or
+// through the server it waits on. The envelope is encrypted to the new device, the server cannot read it.
+func (s *Server) HandlePostProvisioning(w http.ResponseWriter, r *http.Request) {
+	if !s.allowRequest(w, r, s.provisioningLimiter) {
+		return
+	}
+	code := mux.Vars(r)["code"]
+
+	var envelope provisioning.Envelope
+	if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+		s.logger.Errorf("Error decoding provisioning envelope: %v", err)
+		http.Error(w, "Invalid provisioning envelope", http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		s.logger.Errorf("Error encoding provisioning envelope: %v", err)
+		http.Error(w, "Error encoding provisioning envelope", http.StatusInternalServerError)
+		return
+	}
+
+	// A code can only be used once
+	owner, err := s.redisClient.GetDel(s.ctx, provisioningKey(code)).Result()
+	if errors.Is(err, redis.Nil) {
+		s.logger.Error("No device waiting for provisioning code")
+		http.Error(w, "No device waiting for this code", http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.logger.Errorf("Error looking up provisioning code: %v", err)
+		http.Error(w, "Error looking up provisioning code", http.StatusInternalServerError)
+		return
+	}
+
+	if owner == s.instanceID {
+		err = s.deliverProvisioning(code, data)
+	} else {
+		var receivers int64
+		receivers, err = s.redisClient.Publish(s.ctx, provisioningChannel(code), data).Result()
+		if err == nil && receivers == 0 {
+			// The server the device waited on is gone
+			err = ErrNoProvisioningDevice
+		}
+	}
+	if errors.Is(err, ErrNoProvisioningDevice) {
+		s.logger.Error("No device waiting for provisioning code")
+		http.Error(w, "No device waiting for this code", http.StatusNotFound)
+		return
+	} else if err != nil {
+		s.logger.Errorf("Error sending provisioning envelope: %v", err)
+		http.Error(w, "Error sending provisioning envelope", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("Provisioning envelope delivered")
+	w.WriteHeader(http.StatusOK)
+}
+
+// deliverProvisioning writes an encoded provisioning envelope to the new device waiting on this server for code
+func (s *Server) deliverProvisioning(code string, data []byte) error {
+	s.mutex.Lock()
+	ws, ok := s.provisioningConns[code]
+	delete(s.provisioningConns, code)
+	s.mutex.Unlock()
+	if !ok {
+		return ErrNoProvisioningDevice
+	}
+	return s.write(ws, websocket.TextMessage, data)
+}
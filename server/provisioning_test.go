@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"minimal-signal/configs"
+	"minimal-signal/crypto/key_ed25519"
+	"minimal-signal/protocol/provisioning"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestProvisioningServer returns a server backed by mr serving the provisioning endpoints
+func newTestProvisioningServer(t *testing.T, config *configs.ServerConfig, mr *miniredis.Miniredis) (*Server, *httptest.Server) {
+	s, _ := newTestServerWithRedis(t, config, mr)
+	r := mux.NewRouter()
+	r.HandleFunc(configs.ProvisioningPath, s.HandleProvisioning)
+	r.HandleFunc(configs.ProvisioningPath+"/{code}", s.HandlePostProvisioning).Methods(http.MethodPost)
+	httpServer := httptest.NewServer(r)
+	t.Cleanup(httpServer.Close)
+	return s, httpServer
+}
+
+// newTestProvisioningCode returns the code a new device shows
+func newTestProvisioningCode(t *testing.T) string {
+	key, err := key_ed25519.New()
+	require.NoError(t, err)
+	pub, err := key.Public()
+	require.NoError(t, err)
+	return provisioning.Code(*pub)
+}
+
+// waitProvisioning connects a new device waiting for the envelope of code
+func waitProvisioning(t *testing.T, httpServer *httptest.Server, code string) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + configs.ProvisioningPath + "?id=" + code
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func postProvisioning(t *testing.T, httpServer *httptest.Server, code string, envelope *provisioning.Envelope) int {
+	payload, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	resp, err := http.Post(httpServer.URL+configs.ProvisioningPath+"/"+code, "application/json", bytes.NewReader(payload))
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestProvisioningBetweenServers(t *testing.T) {
+	mr := miniredis.RunT(t)
+	_, httpA := newTestProvisioningServer(t, configs.DefaultServerConfig(), mr)
+	_, httpB := newTestProvisioningServer(t, configs.DefaultServerConfig(), mr)
+	envelope := &provisioning.Envelope{Body: []byte("sealed")}
+
+	// The envelope reaches the new device whichever server it is posted to
+	for _, poster := range []*httptest.Server{httpB, httpA} {
+		code := newTestProvisioningCode(t)
+		newDevice, _, err := waitProvisioning(t, httpA, code)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return mr.PubSubNumSub(provisioningChannel(code))[provisioningChannel(code)] == 1
+		}, time.Second, 10*time.Millisecond)
+
+		// Only one device waits for a code, on any server
+		_, resp, err := waitProvisioning(t, httpB, code)
+		require.Error(t, err)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+		require.Equal(t, http.StatusOK, postProvisioning(t, poster, code, envelope))
+		var received provisioning.Envelope
+		newDevice.SetReadDeadline(time.Now().Add(time.Second))
+		require.NoError(t, newDevice.ReadJSON(&received))
+		assert.Equal(t, envelope, &received)
+
+		// A code is used once
+		assert.Equal(t, http.StatusNotFound, postProvisioning(t, httpB, code, envelope))
+	}
+
+	// Nobody waits for this code
+	assert.Equal(t, http.StatusNotFound, postProvisioning(t, httpB, newTestProvisioningCode(t), envelope))
+}
+
+func TestProvisioningRateLimited(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.ProvisioningRateLimit = configs.RateLimit{PerSecond: 0.001, Burst: 2}
+	_, httpServer := newTestProvisioningServer(t, config, miniredis.RunT(t))
+
+	// Guessing codes and waiting for them share the allowance of the IP address
+	envelope := &provisioning.Envelope{Body: []byte("sealed")}
+	assert.Equal(t, http.StatusNotFound, postProvisioning(t, httpServer, newTestProvisioningCode(t), envelope))
+	_, _, err := waitProvisioning(t, httpServer, newTestProvisioningCode(t))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, postProvisioning(t, httpServer, newTestProvisioningCode(t), envelope))
+	_, resp, err := waitProvisioning(t, httpServer, newTestProvisioningCode(t))
+	require.Error(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// Messages to an offline device wait in one mailbox per peer, a Redis stream read through a consumer group.
+// An entry is acked and deleted once written to the device, until then it stays pending and is delivered
+// again on the next connection. All the mailboxes of a device share a quota, so that nobody can fill Redis
+// by sending messages to a device that never connects:
+// - mailboxKey is the stream of messages from a peer
+// - queueBytesKey is the size of the messages in that stream
+// - ServerQueuesKey is the set of peers with a mailbox for the device
+// Every key expires ServerConfig.QueueTTL after the last message was queued, or earlier if all messages disappear.
+
+const (
+	// mailboxGroup and mailboxConsumer read every mailbox, a device has a single connection per peer
+	mailboxGroup    = "delivery"
+	mailboxConsumer = "device"
+	// mailboxField is the field of a stream entry holding its queuedMessage
+	mailboxField = "message"
+)
+
+// releaseBytesScript subtracts the size of delivered messages from the size of a mailbox, unless the
+// mailbox expired: a new key would never expire
+var releaseBytesScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("DECRBY", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// queuedMessage is a message waiting in the offline queue of a device
+type queuedMessage struct {
+	Message *common.MessageBundle `json:"bundle"`
+	// ExpiresAt is the Unix time after which the message is no longer delivered, 0 if it does not expire
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+// mailboxKey returns the Redis key of the mailbox of a connection
+func mailboxKey(key connKey) string {
+	return fmt.Sprintf(configs.ServerMailboxKey, key.from, key.device, key.to)
+}
+
+// queueBytesKey returns the Redis key of the size of the mailbox of a connection
+func queueBytesKey(key connKey) string {
+	return fmt.Sprintf(configs.ServerMessageQueueBytesKey, key.from, key.device, key.to)
+}
+
+// queuesKey returns the Redis key of the peers with a mailbox for the device of a connection
+func queuesKey(key connKey) string {
+	return fmt.Sprintf(configs.ServerQueuesKey, key.from, key.device)
+}
+
+// queueTTL returns how long msg may wait in a queue, at most maxTTL
+func queueTTL(msg *common.MessageBundle, maxTTL time.Duration) time.Duration {
+	ttl := maxTTL
+	if timer := time.Duration(msg.ExpireTimer) * time.Second; timer > 0 && timer < ttl {
+		// Disappearing messages are not delivered past their timer
+		ttl = timer
+	}
+	return ttl
+}
+
+// queueScript appends a message to a mailbox if the device stays within its quota, checked against every
+// mailbox of the device at once so that concurrent messages cannot exceed it. KEYS are the mailbox, its size
+// and the set of peers with a mailbox for the device, then the mailbox and size of every other peer in ARGV[7:].
+// ARGV are the peer, the entry field, the message, the maximum length and size and the TTL in milliseconds.
+// It returns the status, the length and the size of the queue of the device: queueRetry if a peer was added
+// since the keys were read, queueFull if the message is over the quota.
+var queueScript = redis.NewScript(`
+local known = {[ARGV[1]] = true}
+for i = 7, #ARGV do
+	known[ARGV[i]] = true
+end
+for _, peer in ipairs(redis.call("SMEMBERS", KEYS[3])) do
+	if not known[peer] then
+		return {-1, 0, 0}
+	end
+end
+
+local length = redis.call("XLEN", KEYS[1])
+local size = tonumber(redis.call("GET", KEYS[2]) or "0")
+for i = 4, #KEYS, 2 do
+	local peerLength = redis.call("XLEN", KEYS[i])
+	if peerLength == 0 then
+		-- The mailbox expired or was emptied
+		redis.call("SREM", KEYS[3], ARGV[7 + (i - 4) / 2])
+	end
+	length = length + peerLength
+	size = size + tonumber(redis.call("GET", KEYS[i + 1]) or "0")
+end
+length = length + 1
+size = size + #ARGV[3]
+if length > tonumber(ARGV[4]) or size > tonumber(ARGV[5]) then
+	return {0, 0, 0}
+end
+
+redis.call("XADD", KEYS[1], "*", ARGV[2], ARGV[3])
+redis.call("INCRBY", KEYS[2], #ARGV[3])
+redis.call("SADD", KEYS[3], ARGV[1])
+for i = 1, 3 do
+	-- Never shorten the expiry set for a message with a longer TTL
+	local ttl = redis.call("PTTL", KEYS[i])
+	if ttl < tonumber(ARGV[6]) then
+		redis.call("PEXPIRE", KEYS[i], ARGV[6])
+	end
+end
+return {1, length, size}
+`)
+
+// Statuses returned by queueScript
+const (
+	queueRetry = -1
+	queueFull  = 0
+)
+
+// queueRetries is how many times queueScript is run again when peers get a mailbox for the device meanwhile
+const queueRetries = 3
+
+// Queue a message in Redis. It fails with ErrQueueFull if the recipient device reached its quota.
+// Ephemeral messages are dropped instead.
+func (s *Server) queueMessage(recipient connKey, msg *common.MessageBundle) error {
+	if msg.Ephemeral {
+		s.metrics.droppedMessages.WithLabelValues(dropEphemeral).Inc()
+		return nil
+	}
+	ttl := queueTTL(msg, s.config.QueueTTL)
+	messageJSON, err := json.Marshal(queuedMessage{Message: msg, ExpiresAt: time.Now().Add(ttl).Unix()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	for i := 0; i < queueRetries; i++ {
+		peers, err := s.redisClient.SMembers(s.ctx, queuesKey(recipient)).Result()
+		if err != nil {
+			return fmt.Errorf("failed to get queues: %w", err)
+		}
+		keys := []string{mailboxKey(recipient), queueBytesKey(recipient), queuesKey(recipient)}
+		args := []any{recipient.to, mailboxField, messageJSON, s.config.MaxQueueLength, s.config.MaxQueueBytes, ttl.Milliseconds()}
+		for _, peer := range peers {
+			if peer == recipient.to {
+				continue
+			}
+			key := connKey{from: recipient.from, device: recipient.device, to: peer}
+			keys = append(keys, mailboxKey(key), queueBytesKey(key))
+			args = append(args, peer)
+		}
+
+		result, err := queueScript.Run(s.ctx, s.redisClient, keys, args...).Int64Slice()
+		if err != nil {
+			return fmt.Errorf("failed to queue message: %w", err)
+		}
+		switch result[0] {
+		case queueRetry:
+			continue
+		case queueFull:
+			s.metrics.queueRejected.Inc()
+			return ErrQueueFull
+		}
+		s.metrics.queuedMessages.Inc()
+		s.metrics.queueDepth.Observe(float64(result[1]))
+		s.metrics.queueSize.Observe(float64(result[2]))
+		return nil
+	}
+	return fmt.Errorf("failed to queue message: peers kept changing")
+}
+
+// Retrieve queued messages for a device when it reconnects or is woken up, a page at a time: first the ones
+// left pending by a previous connection, then the new ones. It returns false if reading the mailbox or writing to
+// the device failed, the device must then reconnect to get the rest of its mailbox in order.
+func (s *Server) retrieveQueuedMessages(key connKey, ws *websocket.Conn) bool {
+	mailbox := mailboxKey(key)
+	if exists, err := s.redisClient.Exists(s.ctx, mailbox).Result(); err != nil {
+		s.connLogger(key).Errorf("Error retrieving queued messages: %v", err)
+		return false
+	} else if exists == 0 {
+		return true
+	}
+	// The group is not created with the stream, it would have to be in the same transaction and fail there
+	// if it already exists
+	if err := s.redisClient.XGroupCreate(s.ctx, mailbox, mailboxGroup, "0").Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		s.connLogger(key).Errorf("Error creating mailbox group: %v", err)
+		return false
+	}
+
+	for _, start := range []string{"0", ">"} {
+		for {
+			streams, err := s.redisClient.XReadGroup(s.ctx, &redis.XReadGroupArgs{
+				Group:    mailboxGroup,
+				Consumer: mailboxConsumer,
+				Streams:  []string{mailbox, start},
+				Count:    s.config.MailboxPageSize,
+				Block:    -1,
+			}).Result()
+			if errors.Is(err, redis.Nil) {
+				break
+			} else if err != nil {
+				s.connLogger(key).Errorf("Error retrieving queued messages: %v", err)
+				return false
+			}
+			if len(streams) == 0 || len(streams[0].Messages) == 0 {
+				break
+			}
+			if !s.deliverMailboxPage(key, ws, streams[0].Messages) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// deliverMailboxPage writes entries of a mailbox to a device, then acks and deletes them.
+// It returns false if it stopped early, the remaining entries stay pending for the next connection.
+func (s *Server) deliverMailboxPage(key connKey, ws *websocket.Conn, entries []redis.XMessage) bool {
+	now := time.Now().Unix()
+	for _, entry := range entries {
+		// Values are empty if the entry was deleted while pending
+		data, _ := entry.Values[mailboxField].(string)
+		var queued queuedMessage
+		if err := json.Unmarshal([]byte(data), &queued); err != nil || queued.Message == nil {
+			s.connLogger(key).Errorf("Error decoding queued message %s: %v", entry.ID, err)
+		} else if queued.ExpiresAt != 0 && queued.ExpiresAt <= now {
+			s.metrics.expiredMessages.Inc()
+		} else if messageJSON, err := json.Marshal(queued.Message); err != nil {
+			s.connLogger(key).Errorf("Error marshalling queued message: %v", err)
+		} else if err := s.write(ws, websocket.TextMessage, messageJSON); err != nil {
+			s.connLogger(key).Errorf("Error sending queued message: %v", err)
+			return false
+		} else {
+			s.metrics.deliveredQueuedMessages.Inc()
+		}
+
+		if _, err := s.redisClient.TxPipelined(s.ctx, func(pipe redis.Pipeliner) error {
+			pipe.XAck(s.ctx, mailboxKey(key), mailboxGroup, entry.ID)
+			pipe.XDel(s.ctx, mailboxKey(key), entry.ID)
+			releaseBytesScript.Eval(s.ctx, pipe, []string{queueBytesKey(key)}, len(data))
+			return nil
+		}); err != nil {
+			s.connLogger(key).Errorf("Error acknowledging queued message: %v", err)
+			return false
+		}
+	}
+	return true
+}
+
+// migrateLegacyQueue moves the messages queued before mailboxes and account IDs into the mailbox of a primary
+// device, once per connection. They were queued in a list per sender and recipient username, with usernames in
+// the messages. The list is watched, so that messages pushed to it meanwhile are moved too instead of deleted.
+func (s *Server) migrateLegacyQueue(key connKey) error {
+	if key.device != common.PrimaryDeviceID {
+		return nil
+	}
+	usernames, err := s.redisClient.MGet(s.ctx, fmt.Sprintf(configs.ServerAccountUsernameKey, key.to), fmt.Sprintf(configs.ServerAccountUsernameKey, key.from)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get usernames: %w", err)
+	}
+	sender, _ := usernames[0].(string)
+	recipient, _ := usernames[1].(string)
+	if sender == "" || recipient == "" {
+		return nil
+	}
+	legacyKey := fmt.Sprintf(configs.LegacyServerMessageQueueKey, sender, recipient)
+
+	var moved int
+	err = s.watch(func(tx *redis.Tx) error {
+		messages, err := tx.LRange(s.ctx, legacyKey, 0, -1).Result()
+		if err != nil || len(messages) == 0 {
+			return err
+		}
+
+		ttl := s.config.QueueTTL
+		expiresAt := time.Now().Add(ttl).Unix()
+		keys := []string{mailboxKey(key), queueBytesKey(key), queuesKey(key)}
+		_, err = tx.TxPipelined(s.ctx, func(pipe redis.Pipeliner) error {
+			var size int64
+			for _, message := range messages {
+				var msg common.MessageBundle
+				if err := json.Unmarshal([]byte(message), &msg); err != nil {
+					s.connLogger(key).Errorf("Error decoding queued message: %v", err)
+					continue
+				}
+				msg.From, msg.FromDevice, msg.To, msg.ToDevice = key.to, common.PrimaryDeviceID, key.from, key.device
+				messageJSON, err := json.Marshal(queuedMessage{Message: &msg, ExpiresAt: expiresAt})
+				if err != nil {
+					return fmt.Errorf("failed to marshal message: %w", err)
+				}
+				pipe.XAdd(s.ctx, &redis.XAddArgs{Stream: keys[0], Values: []string{mailboxField, string(messageJSON)}})
+				size += int64(len(messageJSON))
+			}
+			pipe.IncrBy(s.ctx, keys[1], size)
+			pipe.SAdd(s.ctx, keys[2], key.to)
+			for _, key := range keys {
+				pipe.ExpireNX(s.ctx, key, ttl)
+				pipe.ExpireGT(s.ctx, key, ttl)
+			}
+			pipe.Del(s.ctx, legacyKey)
+			return nil
+		})
+		if err == nil {
+			moved = len(messages)
+		}
+		return err
+	}, legacyKey)
+	if err != nil {
+		return err
+	}
+	if moved > 0 {
+		s.connLogger(key).Infof("Moved %d queued messages to the mailbox", moved)
+	}
+	return nil
+}
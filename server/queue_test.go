@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/crypto/key_ed25519"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mailbox returns the messages in the mailbox of a connection
+func mailbox(t *testing.T, mr *miniredis.Miniredis, key connKey) []queuedMessage {
+	if !mr.Exists(mailboxKey(key)) {
+		return nil
+	}
+	entries, err := mr.Stream(mailboxKey(key))
+	require.NoError(t, err)
+	var messages []queuedMessage
+	for _, entry := range entries {
+		require.Equal(t, []string{mailboxField, entry.Values[1]}, entry.Values)
+		var msg queuedMessage
+		require.NoError(t, json.Unmarshal([]byte(entry.Values[1]), &msg))
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func TestQueueTTL(t *testing.T) {
+	maxTTL := configs.DefaultServerConfig().QueueTTL
+	assert.Equal(t, maxTTL, queueTTL(&common.MessageBundle{}, maxTTL))
+	assert.Equal(t, 30*time.Second, queueTTL(&common.MessageBundle{ExpireTimer: 30}, maxTTL))
+
+	// A timer longer than the queue TTL does not keep the message longer
+	assert.Equal(t, maxTTL, queueTTL(&common.MessageBundle{ExpireTimer: uint32((maxTTL + time.Hour) / time.Second)}, maxTTL))
+}
+
+func TestMailboxDeliveredInPages(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.MailboxPageSize = 2
+	s, mr, httpServer := newTestServer(t, config)
+	key := connKey{from: "bob", device: common.PrimaryDeviceID, to: "alice"}
+	for i := 0; i < 5; i++ {
+		require.NoError(t, s.queueMessage(key, &common.MessageBundle{From: "alice", To: "bob", Message: []byte{byte(i)}}))
+	}
+
+	// A failed write leaves the messages read so far pending
+	serverWS, clientWS := newTestWebSocketPair(t)
+	clientWS.Close()
+	serverWS.Close()
+	s.retrieveQueuedMessages(key, serverWS)
+	require.Len(t, mailbox(t, mr, key), 5)
+
+	bob := dialTestServer(t, mr, httpServer, "bob", "alice")
+	bob.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 5; i++ {
+		var received common.MessageBundle
+		require.NoError(t, bob.ReadJSON(&received))
+		assert.Equal(t, []byte{byte(i)}, received.Message, "delivered in order")
+	}
+
+	// Delivered messages are deleted
+	connected(t, s, 1)
+	assert.Empty(t, mailbox(t, mr, key))
+	size, err := mr.Get(queueBytesKey(key))
+	require.NoError(t, err)
+	assert.Equal(t, "0", size)
+}
+
+func TestMailboxOnlyReadByItsDevice(t *testing.T) {
+	s, mr, httpServer := newTestServer(t, configs.DefaultServerConfig())
+	bobKey := registerTestDevice(t, mr, "bob", common.PrimaryDeviceID)
+	key := connKey{from: "bob", device: common.PrimaryDeviceID, to: "alice"}
+	require.NoError(t, s.queueMessage(key, &common.MessageBundle{From: "alice", To: "bob", Message: []byte{0}}))
+	dial := func(url string) int {
+		conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		if err == nil {
+			conn.Close()
+			return http.StatusSwitchingProtocols
+		}
+		require.NotNil(t, resp, err)
+		return resp.StatusCode
+	}
+
+	// Mallory can neither claim to be Bob, nor sign for him, nor connect a device he revoked
+	base := fmt.Sprintf("ws%s%s?from=bob&device=1&to=alice", strings.TrimPrefix(httpServer.URL, "http"), configs.WebSocketPath)
+	assert.Equal(t, http.StatusBadRequest, dial(base))
+	malloryKey, err := key_ed25519.New()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, dial(testConnectURL(t, httpServer, *malloryKey, "bob", common.PrimaryDeviceID, "alice")))
+	assert.Equal(t, http.StatusForbidden, dial(testConnectURL(t, httpServer, bobKey, "bob", 2, "alice")))
+	assert.Len(t, mailbox(t, mr, key), 1)
+	assert.False(t, mr.Exists(presenceKey(key)))
+
+	// Nor replay a connection of Bob
+	url := testConnectURL(t, httpServer, bobKey, "bob", common.PrimaryDeviceID, "alice")
+	bob, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer bob.Close()
+	var received common.MessageBundle
+	bob.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, bob.ReadJSON(&received))
+	assert.Equal(t, http.StatusForbidden, dial(url))
+}
+
+func TestUnreadableMailboxDisconnects(t *testing.T) {
+	s, mr, httpServer := newTestServer(t, configs.DefaultServerConfig())
+	key := connKey{from: "bob", device: common.PrimaryDeviceID, to: "alice"}
+	// Not a stream, the mailbox cannot be read
+	mr.Set(mailboxKey(key), "corrupted")
+
+	bob := dialTestServer(t, mr, httpServer, "bob", "alice")
+	bob.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := bob.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr, "closed instead of timing out")
+	connected(t, s, 0)
+}
+
+func TestLegacyQueueMigrated(t *testing.T) {
+	s, mr, httpServer := newTestServer(t, configs.DefaultServerConfig())
+	key := connKey{from: "b0b", device: common.PrimaryDeviceID, to: "a11ce"}
+	mr.Set(fmt.Sprintf(configs.ServerAccountUsernameKey, "b0b"), "bob")
+	mr.Set(fmt.Sprintf(configs.ServerAccountUsernameKey, "a11ce"), "alice")
+	// Queued by username, before mailboxes and account IDs
+	legacyKey := fmt.Sprintf(configs.LegacyServerMessageQueueKey, "alice", "bob")
+	_, err := mr.Push(legacyKey, `{"from":"alice","to":"bob","message":"AA=="}`)
+	require.NoError(t, err)
+	require.NoError(t, s.queueMessage(key, &common.MessageBundle{From: "a11ce", FromDevice: common.PrimaryDeviceID, To: "b0b", Message: []byte{1}}))
+
+	bob := dialTestServer(t, mr, httpServer, "b0b", "a11ce")
+	bob.SetReadDeadline(time.Now().Add(time.Second))
+	var messages [][]byte
+	for i := 0; i < 2; i++ {
+		var received common.MessageBundle
+		require.NoError(t, bob.ReadJSON(&received))
+		assert.Equal(t, "a11ce", received.From, "sender by account ID")
+		assert.Equal(t, common.PrimaryDeviceID, received.FromDevice)
+		messages = append(messages, received.Message)
+	}
+	assert.Equal(t, [][]byte{{1}, {0}}, messages)
+	assert.False(t, mr.Exists(legacyKey))
+}
+
+func TestQueueQuota(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.MaxQueueLength = 3
+	s, mr, _ := newTestServer(t, config)
+	fromAlice := connKey{from: "bob", device: common.PrimaryDeviceID, to: "alice"}
+	fromCarol := connKey{from: "bob", device: common.PrimaryDeviceID, to: "carol"}
+
+	// The quota is shared by the mailboxes of every peer
+	require.NoError(t, s.queueMessage(fromAlice, &common.MessageBundle{From: "alice", To: "bob", Message: []byte{0}}))
+	require.NoError(t, s.queueMessage(fromCarol, &common.MessageBundle{From: "carol", To: "bob", Message: []byte{1}}))
+	require.NoError(t, s.queueMessage(fromAlice, &common.MessageBundle{From: "alice", To: "bob", Message: []byte{2}}))
+	assert.ErrorIs(t, s.queueMessage(fromCarol, &common.MessageBundle{From: "carol", To: "bob", Message: []byte{3}}), ErrQueueFull)
+	assert.Len(t, mailbox(t, mr, fromAlice), 2)
+	assert.Len(t, mailbox(t, mr, fromCarol), 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(s.metrics.queueRejected))
+
+	// So is the size, an expired mailbox no longer counts
+	config.MaxQueueLength = 1000
+	mr.Del(mailboxKey(fromCarol))
+	mr.Del(queueBytesKey(fromCarol))
+	size, err := mr.Get(queueBytesKey(fromAlice))
+	require.NoError(t, err)
+	_, err = fmt.Sscan(size, &config.MaxQueueBytes)
+	require.NoError(t, err)
+	assert.ErrorIs(t, s.queueMessage(fromCarol, &common.MessageBundle{From: "carol", To: "bob", Message: []byte{4}}), ErrQueueFull)
+	config.MaxQueueBytes *= 2
+	require.NoError(t, s.queueMessage(fromCarol, &common.MessageBundle{From: "carol", To: "bob", Message: []byte{5}}))
+	peers, err := mr.Members(queuesKey(fromAlice))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"alice", "carol"}, peers)
+}
+
+func TestQueueFullReplied(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.MaxQueueLength = 1
+	s, mr, httpServer := newTestServer(t, config)
+	mr.SAdd(fmt.Sprintf(configs.ServerUserDevicesKey, "bob"), fmt.Sprint(common.PrimaryDeviceID))
+	alice := dialTestServer(t, mr, httpServer, "alice", "bob")
+	connected(t, s, 1)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: "bob", ToDevice: common.PrimaryDeviceID, Message: []byte{byte(i)}}))
+	}
+	var reply common.ErrorReply
+	alice.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, alice.ReadJSON(&reply))
+	assert.Equal(t, common.ErrorReply{Code: common.ErrorQueueFull, To: "bob", ToDevice: common.PrimaryDeviceID}, reply)
+	assert.Len(t, mailbox(t, mr, connKey{from: "bob", device: common.PrimaryDeviceID, to: "alice"}), 1)
+}
+
+func TestEphemeralMessagesNotQueued(t *testing.T) {
+	s, mr, httpServer := newTestServer(t, configs.DefaultServerConfig())
+	mr.SAdd(fmt.Sprintf(configs.ServerUserDevicesKey, "bob"), fmt.Sprint(common.PrimaryDeviceID))
+	alice := dialTestServer(t, mr, httpServer, "alice", "bob")
+	connected(t, s, 1)
+
+	require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: "bob", ToDevice: common.PrimaryDeviceID, Message: []byte("typing"), Ephemeral: true}))
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.metrics.droppedMessages.WithLabelValues(dropEphemeral)) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Empty(t, mailbox(t, mr, connKey{from: "bob", device: common.PrimaryDeviceID, to: "alice"}))
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter holds a token bucket per key, like a user ID or an IP address
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+	// idleTimeout is how long the bucket of an unused key is kept
+	idleTimeout time.Duration
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	// lastSweep is when idle buckets were last removed
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(config configs.RateLimit, idleTimeout time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:       rate.Limit(config.PerSecond),
+		burst:       config.Burst,
+		idleTimeout: idleTimeout,
+		buckets:     make(map[string]*bucket),
+		lastSweep:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of every key. If one of them is empty, nothing is taken and
+// it returns how long to wait before retrying.
+func (l *rateLimiter) allow(keys ...string) (bool, time.Duration) {
+	return l.allowN(1, keys...)
+}
+
+// allowN takes n tokens from the bucket of every key, like allow
+func (l *rateLimiter) allowN(n int, keys ...string) (bool, time.Duration) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sweep(now)
+
+	reservations := make([]*rate.Reservation, 0, len(keys))
+	var wait time.Duration
+	for _, key := range keys {
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &bucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+			l.buckets[key] = b
+		}
+		b.lastSeen = now
+
+		reservation := b.limiter.ReserveN(now, n)
+		reservations = append(reservations, reservation)
+		if !reservation.OK() {
+			wait = time.Duration(math.MaxInt64)
+		} else if delay := reservation.DelayFrom(now); delay > wait {
+			wait = delay
+		}
+	}
+	if wait == 0 {
+		return true, 0
+	}
+
+	for _, reservation := range reservations {
+		reservation.CancelAt(now)
+	}
+	return false, wait
+}
+
+// sweep removes the buckets unused for idleTimeout, they are full again anyway.
+// Must hold mutex.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idleTimeout {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) >= l.idleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// userKey, deviceKey and ipKey return the rate limiting keys of a user, a device of a user and an IP address
+func userKey(userID string) string {
+	return "user:" + userID
+}
+
+func deviceKey(userID string, deviceID common.DeviceID) string {
+	return fmt.Sprintf("device:%s:%d", userID, deviceID)
+}
+
+func ipKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// allowRequest applies the limits of an endpoint to the IP address of the requester. The user a request is
+// about is not limited, otherwise anyone could lock everybody else out of fetching its keys.
+// Requests over the limit get a 429 with an ErrorReply and a Retry-After header, and false is returned.
+func (s *Server) allowRequest(w http.ResponseWriter, r *http.Request, limiter *rateLimiter) bool {
+	return s.allowRequestN(w, r, limiter, 1)
+}
+
+// allowRequestN is allowRequest for a request that counts as n, like a directory request for n users
+func (s *Server) allowRequestN(w http.ResponseWriter, r *http.Request, limiter *rateLimiter, n int) bool {
+	ok, wait := limiter.allowN(n, ipKey(r))
+	if !ok {
+		s.replyRateLimited(w, r, logrus.NewEntry(s.logger), wait)
+	}
+	return ok
+}
+
+// allowAccount applies the limits of an endpoint to the account that signed a request, once it is authenticated,
+// like allowRequest
+func (s *Server) allowAccount(w http.ResponseWriter, r *http.Request, limiter *rateLimiter, userID string) bool {
+	ok, wait := limiter.allow(userKey(userID))
+	if !ok {
+		s.replyRateLimited(w, r, s.userLogger(userID), wait)
+	}
+	return ok
+}
+
+// replyRateLimited replies 429 Too Many Requests to a request over the limit, to retry after wait
+func (s *Server) replyRateLimited(w http.ResponseWriter, r *http.Request, logger *logrus.Entry, wait time.Duration) {
+	// The path may hold the user ID, the route template is logged instead
+	var route string
+	if current := mux.CurrentRoute(r); current != nil {
+		route, _ = current.GetPathTemplate()
+	}
+	logger.Warnf("Rate limiting %s %s from %s", r.Method, route, s.logAddr(r.RemoteAddr))
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(&common.ErrorReply{Code: common.ErrorRateLimited, RetryAfter: retryAfter})
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/crypto/key_ed25519"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	limiter := newRateLimiter(configs.RateLimit{PerSecond: 0.001, Burst: 2}, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		ok, _ := limiter.allow("user:alice", "ip:1")
+		assert.True(t, ok)
+	}
+	ok, wait := limiter.allow("user:alice", "ip:1")
+	assert.False(t, ok)
+	assert.Positive(t, wait)
+
+	// Another user from the same IP is limited by the IP
+	ok, _ = limiter.allow("user:bob", "ip:1")
+	assert.False(t, ok)
+
+	// A refused request does not use the tokens of the other keys
+	ok, _ = limiter.allow("user:bob", "ip:2")
+	assert.True(t, ok)
+	ok, _ = limiter.allow("user:bob", "ip:2")
+	assert.True(t, ok)
+}
+
+func TestAllowRequestReplies429(t *testing.T) {
+	s := NewServer(context.Background(), configs.DefaultServerConfig(), nil, logrus.New())
+	s.keyFetchLimiter = newRateLimiter(configs.RateLimit{PerSecond: 0.001, Burst: 1}, time.Minute)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/keys/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		if s.allowRequest(w, r, s.keyFetchLimiter) {
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/keys/alice", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/keys/alice", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	var reply common.ErrorReply
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&reply))
+	assert.Equal(t, common.ErrorRateLimited, reply.Code)
+	assert.Positive(t, reply.RetryAfter)
+}
+
+// fromIP serves the requests to h as if they came from ip
+func fromIP(h http.Handler, ip string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = ip + ":1234"
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestRateLimitsPerRequester(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.KeyFetchRateLimit = configs.RateLimit{PerSecond: 0.001, Burst: 1}
+	config.KeyPublishRateLimit = configs.RateLimit{PerSecond: 0.001, Burst: 2}
+	s, _, _ := newTestServer(t, config)
+	r := accountRouter(s)
+	aliceKeys, malloryKeys := newTestKeys(t), newTestKeys(t)
+	alice := fromIP(r, "192.0.2.1")
+	aliceID := registerTestAccount(t, alice, aliceKeys)
+
+	// Mallory fetching the keys of Alice only uses her own allowance
+	keysPath := configs.PublishKeysPath + "/" + aliceID
+	mallory := fromIP(r, "192.0.2.66")
+	for _, want := range []int{http.StatusNotFound, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		mallory.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, keysPath, nil))
+		assert.Equal(t, want, rec.Code)
+	}
+	rec := httptest.NewRecorder()
+	fromIP(r, "192.0.2.2").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, keysPath, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "no keys yet, but not rate limited")
+
+	// Requests for the account of Alice that she did not sign do not use her allowance
+	for i := 0; i < 3; i++ {
+		from := fromIP(r, fmt.Sprintf("198.51.100.%d", i))
+		assert.Equal(t, http.StatusForbidden, postTestKeys(t, from, aliceID, common.PrimaryDeviceID, malloryKeys))
+	}
+	assert.Equal(t, http.StatusOK, postTestKeys(t, alice, aliceID, common.PrimaryDeviceID, aliceKeys))
+	// Her own requests do, from any IP
+	assert.Equal(t, http.StatusTooManyRequests, postTestKeys(t, fromIP(r, "192.0.2.3"), aliceID, common.PrimaryDeviceID, aliceKeys))
+}
+
+func TestMessageRateLimitPerDevice(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.MessageRateLimit = configs.RateLimit{PerSecond: 0.001, Burst: 2}
+	s, mr, _ := newTestServer(t, config)
+	dial := func(ip string, identityKey key_ed25519.PrivateKey, from string, deviceID common.DeviceID, to string) *websocket.Conn {
+		httpServer := httptest.NewServer(fromIP(http.HandlerFunc(s.HandleConnections), ip))
+		t.Cleanup(httpServer.Close)
+		conn, _, err := websocket.DefaultDialer.Dial(testConnectURL(t, httpServer, identityKey, from, deviceID, to), nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	requireRateLimited := func(conn *websocket.Conn, messages int) {
+		for i := 0; i < messages; i++ {
+			require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("flood")))
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+	}
+	aliceKey := registerTestDevice(t, mr, "alice", common.PrimaryDeviceID)
+	mr.SAdd(fmt.Sprintf(configs.ServerUserDevicesKey, "alice"), "2")
+	malloryKey := registerTestDevice(t, mr, "mallory", common.PrimaryDeviceID)
+
+	// A device flooding is disconnected, and reconnecting from another IP does not give it a new allowance
+	requireRateLimited(dial("192.0.2.1", aliceKey, "alice", common.PrimaryDeviceID, "bob"), 3)
+	requireRateLimited(dial("192.0.2.2", aliceKey, "alice", common.PrimaryDeviceID, "carol"), 1)
+	// The IP it flooded from is limited too
+	requireRateLimited(dial("192.0.2.1", malloryKey, "mallory", common.PrimaryDeviceID, "bob"), 1)
+
+	// The other device of Alice has its own allowance
+	alice := dial("192.0.2.3", aliceKey, "alice", 2, "bob")
+	for i := 0; i < 2; i++ {
+		require.NoError(t, alice.WriteMessage(websocket.TextMessage, []byte("not a message")))
+	}
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.metrics.droppedMessages.WithLabelValues(dropInvalid)) == 4
+	}, time.Second, 10*time.Millisecond)
+	connected(t, s, 1)
+	s.mutex.Lock()
+	_, ok := s.connectedUsers[connKey{from: "alice", device: 2, to: "bob"}]
+	s.mutex.Unlock()
+	assert.True(t, ok)
+}
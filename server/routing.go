@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Several servers can share one Redis. Each one subscribes to the delivery channel of the devices connected
+// to it, and records in a presence key, refreshed while connected, that it holds their connection.
+// A message for a device connected elsewhere is queued in its mailbox first, then its server is woken up on the
+// delivery channel to deliver it from there. A wake-up that is lost, because nobody received it or the subscriber
+// dropped it, only delays the message until the next one or until the device is pinged. Ephemeral messages are
+// published as is instead, they are lost if nobody receives them. Provisioning envelopes are routed the same way,
+// see provisioning.go.
+
+// routedMessage is published to the server a recipient device is connected to
+type routedMessage struct {
+	User   string          `json:"user"`
+	Device common.DeviceID `json:"device"`
+	Peer   string          `json:"peer"`
+	// Message is an ephemeral message to deliver, nil to wake the server up to deliver the mailbox
+	Message *common.MessageBundle `json:"bundle,omitempty"`
+}
+
+// releasePresenceScript deletes a presence key if it still belongs to this server, the device may
+// already be connected to another one. It also releases provisioning codes.
+var releasePresenceScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// newInstanceID returns a random identifier of a server, stored in presence keys
+func newInstanceID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("failed to generate instance ID: %v", err))
+	}
+	return hex.EncodeToString(id)
+}
+
+// presenceKey and deliveryChannel return the Redis presence key and delivery channel of a connection
+func presenceKey(key connKey) string {
+	return fmt.Sprintf(configs.ServerPresenceKey, key.from, key.device, key.to)
+}
+
+func deliveryChannel(key connKey) string {
+	return fmt.Sprintf(configs.ServerDeliveryChannel, key.from, key.device, key.to)
+}
+
+// subscription returns the subscription to the messages routed to this server. It subscribes to them and to
+// account events, and refreshes the presence of its devices until the server is closed, when the first device
+// connects.
+func (s *Server) subscription() (*redis.PubSub, error) {
+	s.routingMutex.Lock()
+	defer s.routingMutex.Unlock()
+	if s.pubsub == nil {
+		if err := s.ctx.Err(); err != nil {
+			return nil, err
+		}
+		s.pubsub = s.redisClient.Subscribe(s.ctx, configs.ServerAccountsChannel)
+		go s.runRouting(s.pubsub)
+		go s.runPresence()
+	}
+	return s.pubsub, nil
+}
+
+// runRouting delivers the messages published by other servers to the local devices
+func (s *Server) runRouting(pubsub *redis.PubSub) {
+	for msg := range pubsub.Channel() {
+		if code, ok := strings.CutPrefix(msg.Channel, provisioningChannel("")); ok {
+			if err := s.deliverProvisioning(code, []byte(msg.Payload)); err != nil {
+				s.logger.Errorf("Error sending provisioning envelope: %v", err)
+			} else {
+				s.logger.Info("Provisioning envelope delivered")
+			}
+			continue
+		}
+		if msg.Channel == configs.ServerAccountsChannel {
+			var event accountEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				s.logger.Errorf("Invalid account event: %v", err)
+				continue
+			}
+			s.handleAccountEvent(event)
+			continue
+		}
+
+		var routed routedMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &routed); err != nil {
+			s.logger.Errorf("Invalid routed message: %v", err)
+			continue
+		}
+		key := connKey{from: routed.User, device: routed.Device, to: routed.Peer}
+		if routed.Message == nil {
+			s.wakeLocal(key)
+		} else if !s.sendLocal(key, routed.Message) {
+			s.metrics.droppedMessages.WithLabelValues(dropEphemeral).Inc()
+		}
+	}
+}
+
+// runPresence keeps the presence keys of the local devices from expiring
+func (s *Server) runPresence() {
+	ticker := time.NewTicker(s.config.PresenceTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mutex.Lock()
+		keys := make([]connKey, 0, len(s.connectedUsers))
+		for key := range s.connectedUsers {
+			keys = append(keys, key)
+		}
+		s.mutex.Unlock()
+
+		if _, err := s.redisClient.Pipelined(s.ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				pipe.Set(s.ctx, presenceKey(key), s.instanceID, s.config.PresenceTTL)
+			}
+			return nil
+		}); err != nil {
+			s.logger.Errorf("Error refreshing presence: %v", err)
+		}
+	}
+}
+
+// register subscribes to the messages routed to a device connected to this server and records its presence
+func (s *Server) register(key connKey) error {
+	pubsub, err := s.subscription()
+	if err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	if err := pubsub.Subscribe(s.ctx, deliveryChannel(key)); err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	if err := s.redisClient.Set(s.ctx, presenceKey(key), s.instanceID, s.config.PresenceTTL).Err(); err != nil {
+		return fmt.Errorf("failed to record presence: %w", err)
+	}
+	return nil
+}
+
+// unregister undoes register once the device disconnected
+func (s *Server) unregister(key connKey) {
+	s.routingMutex.Lock()
+	pubsub := s.pubsub
+	s.routingMutex.Unlock()
+	if pubsub != nil {
+		if err := pubsub.Unsubscribe(s.ctx, deliveryChannel(key)); err != nil {
+			s.connLogger(key).Errorf("Error unsubscribing from delivery channel: %v", err)
+		}
+	}
+	if err := releasePresenceScript.Run(s.ctx, s.redisClient, []string{presenceKey(key)}, s.instanceID).Err(); err != nil {
+		s.connLogger(key).Errorf("Error releasing presence: %v", err)
+	}
+}
+
+// wakeLocal tells the device of a connection to this server that its mailbox has new messages.
+// It returns false if the device is not connected to this server.
+func (s *Server) wakeLocal(key connKey) bool {
+	s.mutex.Lock()
+	conn, online := s.connectedUsers[key]
+	s.mutex.Unlock()
+	if online {
+		conn.wake()
+	}
+	return online
+}
+
+// notifyMailbox tells the server the recipient device is connected to, if any, that its mailbox has new messages
+func (s *Server) notifyMailbox(recipient connKey) error {
+	if s.wakeLocal(recipient) {
+		return nil
+	}
+	_, err := s.publishRouted(recipient, &routedMessage{User: recipient.from, Device: recipient.device, Peer: recipient.to})
+	return err
+}
+
+// routeEphemeral publishes an ephemeral message to the server the recipient device is connected to.
+// It returns false if nobody received it.
+func (s *Server) routeEphemeral(recipient connKey, msg *common.MessageBundle) (bool, error) {
+	return s.publishRouted(recipient, &routedMessage{User: recipient.from, Device: recipient.device, Peer: recipient.to, Message: msg})
+}
+
+// publishRouted publishes routed to the server the recipient device is connected to.
+// It returns false if the device is not connected to any other server, or if nobody received it.
+func (s *Server) publishRouted(recipient connKey, routed *routedMessage) (bool, error) {
+	owner, err := s.redisClient.Get(s.ctx, presenceKey(recipient)).Result()
+	if errors.Is(err, redis.Nil) || owner == s.instanceID {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	data, err := json.Marshal(routed)
+	if err != nil {
+		return false, err
+	}
+	// The presence key may outlive the server that set it, nobody receives the message then
+	receivers, err := s.redisClient.Publish(s.ctx, deliveryChannel(recipient), data).Result()
+	if err != nil {
+		return false, err
+	}
+	if receivers > 0 {
+		s.metrics.routedMessages.Inc()
+	}
+	return receivers > 0, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// registered waits until the device of a connection can receive messages routed from other servers
+func registered(t *testing.T, mr *miniredis.Miniredis, key connKey) {
+	require.Eventually(t, func() bool {
+		return mr.Exists(presenceKey(key)) && mr.PubSubNumSub(deliveryChannel(key))[deliveryChannel(key)] == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRoutingBetweenServers(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.SAdd(fmt.Sprintf(configs.ServerUserDevicesKey, "bob"), fmt.Sprint(common.PrimaryDeviceID))
+	_, httpA := newTestServerWithRedis(t, configs.DefaultServerConfig(), mr)
+	b, httpB := newTestServerWithRedis(t, configs.DefaultServerConfig(), mr)
+
+	bobKey := connKey{from: "bob", device: common.PrimaryDeviceID, to: "alice"}
+	alice := dialTestServer(t, mr, httpA, "alice", "bob")
+	bob := dialTestServer(t, mr, httpB, "bob", "alice")
+	registered(t, mr, connKey{from: "alice", device: common.PrimaryDeviceID, to: "bob"})
+	registered(t, mr, bobKey)
+
+	// Alice's server queues the message and wakes Bob's up, which delivers it
+	require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: "bob", ToDevice: common.PrimaryDeviceID, Message: []byte("hello")}))
+	var received common.MessageBundle
+	bob.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, bob.ReadJSON(&received))
+	assert.Equal(t, "alice", received.From)
+	assert.Equal(t, []byte("hello"), received.Message)
+	require.Eventually(t, func() bool {
+		return len(mailbox(t, mr, bobKey)) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Ephemeral messages are published as is
+	require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: "bob", ToDevice: common.PrimaryDeviceID, Message: []byte("typing"), Ephemeral: true}))
+	require.NoError(t, bob.ReadJSON(&received))
+	assert.Equal(t, []byte("typing"), received.Message)
+
+	// Once Bob is gone, messages are queued
+	bob.Close()
+	connected(t, b, 0)
+	assert.False(t, mr.Exists(presenceKey(bobKey)))
+	require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: "bob", ToDevice: common.PrimaryDeviceID, Message: []byte("are you there?")}))
+	require.Eventually(t, func() bool {
+		return len(mailbox(t, mr, bobKey)) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// So are messages to a device whose server died without cleaning up its presence
+	mr.Set(presenceKey(bobKey), "dead")
+	require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: "bob", ToDevice: common.PrimaryDeviceID, Message: []byte("hello?")}))
+	require.Eventually(t, func() bool {
+		return len(mailbox(t, mr, bobKey)) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLostWakeUpDelivered(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.PongTimeout = 200 * time.Millisecond
+	s, mr, httpServer := newTestServer(t, config)
+	bobKey := connKey{from: "bob", device: common.PrimaryDeviceID, to: "alice"}
+	bob := dialTestServer(t, mr, httpServer, "bob", "alice")
+	registered(t, mr, bobKey)
+
+	// Queued by another server whose wake-up never arrived, the mailbox is checked when the device is pinged
+	require.NoError(t, s.queueMessage(bobKey, &common.MessageBundle{From: "alice", To: "bob", Message: []byte("hello")}))
+	var received common.MessageBundle
+	bob.SetReadDeadline(time.Now().Add(2 * config.PongTimeout))
+	require.NoError(t, bob.ReadJSON(&received))
+	assert.Equal(t, []byte("hello"), received.Message)
+}
+
+func TestPresenceRefreshed(t *testing.T) {
+	config := configs.DefaultServerConfig()
+	config.PresenceTTL = 90 * time.Millisecond
+	s, mr, httpServer := newTestServer(t, config)
+	key := connKey{from: "alice", device: common.PrimaryDeviceID, to: "bob"}
+	dialTestServer(t, mr, httpServer, "alice", "bob")
+	registered(t, mr, key)
+
+	// Refreshed while the device is connected
+	for i := 0; i < 3; i++ {
+		mr.FastForward(config.PresenceTTL / 2)
+		time.Sleep(config.PresenceTTL)
+	}
+	assert.True(t, mr.Exists(presenceKey(key)))
+
+	// Expires once the server stops refreshing it
+	s.cancelCtx()
+	time.Sleep(config.PresenceTTL)
+	mr.FastForward(config.PresenceTTL)
+	assert.False(t, mr.Exists(presenceKey(key)))
+}
@@ -3,14 +3,17 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"minimal-signal/common"
 	"minimal-signal/configs"
+	"minimal-signal/crypto/key_ed25519"
 	"minimal-signal/protocol/x3dh/alice"
 	"net/http"
+	"sort"
 	"sync"
+	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
@@ -20,157 +23,330 @@ import (
 type Server struct {
 	ctx       context.Context
 	cancelCtx context.CancelFunc
-
-	redisClient    *redis.Client
-	connectedUsers map[connKey]*websocket.Conn
-	mutex          *sync.Mutex
-	logger         *logrus.Logger
+	config    *configs.ServerConfig
+
+	redisClient *redis.Client
+	// instanceID identifies this server among the ones sharing Redis
+	instanceID string
+	// pubsub receives the messages other servers route to the devices connected to this one, it is created
+	// when the first device connects. routingMutex guards it.
+	pubsub         *redis.PubSub
+	routingMutex   sync.Mutex
+	connectedUsers map[connKey]*deviceConn
+	// provisioningConns holds the new devices waiting on this server for their provisioning envelope, by code
+	provisioningConns map[string]*websocket.Conn
+	// draining is set once the server shuts down, it no longer accepts WebSocket connections
+	draining bool
+	mutex    *sync.Mutex
+	// handlers tracks the WebSocket connections, which http.Server.Shutdown does not wait for
+	handlers sync.WaitGroup
+	logger   *logrus.Logger
+	// logHashKey is the key user IDs are hashed with in logs, nil to log them as is
+	logHashKey []byte
+	metrics    *serverMetrics
+
+	// Rate limits per IP, and per account for the requests signed with its identity key
+	keyFetchLimiter   *rateLimiter
+	keyPublishLimiter *rateLimiter
+	messageLimiter    *rateLimiter
+	directoryLimiter  *rateLimiter
+	// provisioningLimiter is only applied per IP, so that provisioning codes cannot be guessed
+	provisioningLimiter *rateLimiter
 
 	// WebSocket upgrader settings
 	upgrader *websocket.Upgrader
 }
 
+// connKey identifies a connection: the conversation a device of a user has with a peer
 type connKey struct {
-	from string
-	to   string
+	from   string
+	device common.DeviceID
+	to     string
 }
 
-func NewServer(ctx context.Context, redisClient *redis.Client, logger *logrus.Logger) *Server {
+func NewServer(ctx context.Context, config *configs.ServerConfig, redisClient *redis.Client, logger *logrus.Logger) *Server {
 	ctx, cancelCtx := context.WithCancel(ctx)
-	return &Server{
-		ctx:            ctx,
-		cancelCtx:      cancelCtx,
-		redisClient:    redisClient,
-		connectedUsers: make(map[connKey]*websocket.Conn),
-		mutex:          &sync.Mutex{},
-		logger:         logger,
+	s := &Server{
+		ctx:                 ctx,
+		cancelCtx:           cancelCtx,
+		config:              config,
+		redisClient:         redisClient,
+		instanceID:          newInstanceID(),
+		connectedUsers:      make(map[connKey]*deviceConn),
+		provisioningConns:   make(map[string]*websocket.Conn),
+		mutex:               &sync.Mutex{},
+		logger:              logger,
+		logHashKey:          newLogHashKey(config, logger),
+		metrics:             newServerMetrics(),
+		keyFetchLimiter:     newRateLimiter(config.KeyFetchRateLimit, config.RateLimitIdleTimeout),
+		keyPublishLimiter:   newRateLimiter(config.KeyPublishRateLimit, config.RateLimitIdleTimeout),
+		messageLimiter:      newRateLimiter(config.MessageRateLimit, config.RateLimitIdleTimeout),
+		directoryLimiter:    newRateLimiter(config.DirectoryRateLimit, config.RateLimitIdleTimeout),
+		provisioningLimiter: newRateLimiter(config.ProvisioningRateLimit, config.RateLimitIdleTimeout),
 		upgrader: &websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
 	}
+	s.registerGauges()
+	return s
 }
 
 // Handle incoming WebSocket connections
 func (s *Server) HandleConnections(w http.ResponseWriter, r *http.Request) {
-	// Upgrade HTTP request to WebSocket
-	ws, err := s.upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		s.logger.Errorf("Error upgrading to WebSocket: %v", err)
+	if !s.startHandler(w) {
 		return
 	}
-	defer ws.Close()
+	defer s.handlers.Done()
 
 	// Extract userId from the URL query
-	fromID := r.URL.Query().Get("from")
+	query := r.URL.Query()
+	fromID := query.Get("from")
 	if fromID == "" {
 		s.logger.Error("No fromID provided in the query")
+		http.Error(w, "No fromID provided", http.StatusBadRequest)
 		return
 	}
-	toID := r.URL.Query().Get("to")
+	deviceID, err := common.ParseDeviceID(query.Get("device"))
+	if err != nil {
+		s.logger.Errorf("No valid device provided in the query: %v", err)
+		http.Error(w, "No valid device provided", http.StatusBadRequest)
+		return
+	}
+	toID := query.Get("to")
 	if toID == "" {
 		s.logger.Error("No toID provided in the query")
+		http.Error(w, "No toID provided", http.StatusBadRequest)
+		return
+	}
+
+	// Only the holder of the identity key of the account may connect its devices
+	request, err := common.ParseConnectQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.authenticateWith(w, request, common.AccountConnect, fromID, func(identityKey key_ed25519.PublicKey) error {
+		return request.VerifyConnect(identityKey, fromID, deviceID, toID, configs.AccountRequestMaxAge)
+	}) {
+		return
+	}
+	// The connection gets the mailbox and the route of the device, which must not be revoked
+	registered, err := s.redisClient.SIsMember(s.ctx, fmt.Sprintf(configs.ServerUserDevicesKey, fromID), uint32(deviceID)).Result()
+	if err != nil {
+		s.deviceLogger(fromID, deviceID).Errorf("Error checking device: %v", err)
+		http.Error(w, "Error checking device", http.StatusInternalServerError)
+		return
+	} else if !registered {
+		s.deviceLogger(fromID, deviceID).Warn("Refusing connection of unknown device")
+		http.Error(w, "Unknown device", http.StatusForbidden)
 		return
 	}
 
-	// Add user to connectedUsers map
+	// Upgrade HTTP request to WebSocket
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Errorf("Error upgrading to WebSocket: %v", err)
+		return
+	}
+	defer ws.Close()
+
+	key := connKey{from: fromID, device: deviceID, to: toID}
+	conn := s.newDeviceConn(key, ws)
+	// Messages are limited per device of the account, however many connections it opens, and per IP
+	limitKey := deviceKey(fromID, deviceID)
+
+	// Add user to connectedUsers map, messages to it are queued after the ones in its mailbox until they are sent
 	s.mutex.Lock()
-	s.connectedUsers[connKey{from: fromID, to: toID}] = ws
+	s.connectedUsers[key] = conn
 	s.mutex.Unlock()
-	s.logger.Infof("User %s connected, talking to %s", fromID, toID)
+	if err := s.register(key); err != nil {
+		// Messages from other servers are queued instead
+		s.connLogger(key).Errorf("Error registering device: %v", err)
+	}
+	s.connLogger(key).Info("Device connected")
 
-	// Check for queued messages
-	s.retrieveQueuedMessages(toID, fromID, ws)
+	// The device answers pings, it is gone if it does not within PongTimeout
+	ws.SetReadDeadline(time.Now().Add(s.config.PongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(s.config.PongTimeout))
+	})
+
+	// Check for queued messages, including the ones queued before mailboxes
+	if err := s.migrateLegacyQueue(key); err != nil {
+		s.connLogger(key).Errorf("Error migrating queued messages: %v", err)
+	}
+	if !s.retrieveQueuedMessages(key, ws) {
+		// Nothing may be delivered before the mailbox, the device gets it in order when it reconnects
+		s.abort(conn)
+		s.disconnect(key, conn)
+		return
+	}
+	conn.setBacklog(false)
+	go s.runWriter(conn)
 
 	// Listen for incoming messages
 	for {
 		_, message, err := ws.ReadMessage()
 		if err != nil {
-			s.logger.Errorf("Error reading message from user %s: %v", fromID, err)
+			s.connLogger(key).Errorf("Error reading message: %v", err)
+			break
+		}
+
+		if ok, _ := s.messageLimiter.allow(limitKey, ipKey(r)); !ok {
+			// Flooding clients are disconnected, they may reconnect once they slow down
+			s.connLogger(key).Warn("Rate limiting messages, closing connection")
+			closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, common.ErrorRateLimited)
+			ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
 			break
 		}
 
 		var msgObj common.MessageBundle
 		if err := json.Unmarshal(message, &msgObj); err != nil {
-			s.logger.Errorf("Invalid message format from user %s: %v", fromID, err)
+			s.connLogger(key).Errorf("Invalid message format: %v", err)
+			s.metrics.droppedMessages.WithLabelValues(dropInvalid).Inc()
 			continue
 		}
 
 		// Add the sender's ID to the message
 		msgObj.From = fromID
-		s.logger.Infof("Received message from user %s: %s\n", fromID, spew.Sdump(msgObj))
+		msgObj.FromDevice = deviceID
+		s.dumpMessage(&msgObj)
 
-		s.handleMessage(&msgObj)
+		s.handleMessage(key, &msgObj)
 	}
 
-	// Remove user from connectedUsers map when they disconnect
+	s.disconnect(key, conn)
+}
+
+// disconnect removes the connection of a device from connectedUsers, once the messages it did not get are queued
+func (s *Server) disconnect(key connKey, conn *deviceConn) {
+	conn.close()
 	s.mutex.Lock()
-	delete(s.connectedUsers, connKey{from: fromID, to: toID})
+	current := s.connectedUsers[key] == conn
+	if current {
+		delete(s.connectedUsers, key)
+	}
 	s.mutex.Unlock()
-	s.logger.Infof("User %s disconnected", fromID)
+	if current {
+		s.unregister(key)
+	}
+	s.connLogger(key).Info("Device disconnected")
 }
 
 func (s *Server) Close() {
 	s.cancelCtx()
 	// Close all WebSocket connections
-	s.mutex.Lock()
-	for _, conn := range s.connectedUsers {
-		conn.Close()
+	s.closeConns()
+	s.routingMutex.Lock()
+	if s.pubsub != nil {
+		s.pubsub.Close()
 	}
-	s.mutex.Unlock()
+	s.routingMutex.Unlock()
 	s.redisClient.Close()
 }
 
-// Handle sending messages and queuing for offline users
-func (s *Server) handleMessage(msg *common.MessageBundle) {
-	s.mutex.Lock()
-	recipientConn, online := s.connectedUsers[connKey{from: msg.To, to: msg.From}]
-	s.mutex.Unlock()
+// recipientKey returns the connection a message sent on the sender's connection must be delivered to.
+// A message to another user is part of the conversation with the sender, while a message to another
+// device of the sender keeps that device in sync with the conversation the sender is having.
+func recipientKey(sender connKey, msg *common.MessageBundle) connKey {
+	peer := sender.from
+	if msg.To == sender.from {
+		peer = sender.to
+	}
+	return connKey{from: msg.To, device: msg.ToDevice, to: peer}
+}
+
+// Handle sending messages to the recipient device and queuing for offline devices
+func (s *Server) handleMessage(sender connKey, msg *common.MessageBundle) {
+	registered, err := s.redisClient.SIsMember(s.ctx, fmt.Sprintf(configs.ServerUserDevicesKey, msg.To), uint32(msg.ToDevice)).Result()
+	if err != nil {
+		s.messageLogger(msg).Errorf("Error checking recipient device: %v", err)
+		return
+	}
+	if !registered {
+		s.messageLogger(msg).Error("Dropping message to unknown device")
+		s.metrics.droppedMessages.WithLabelValues(dropUnknownDevice).Inc()
+		// Users are registered before they are sent messages, an account that is gone was deleted
+		if exists, err := s.redisClient.Exists(s.ctx, fmt.Sprintf(configs.ServerAccountKey, msg.To)).Result(); err == nil && exists == 0 {
+			s.replyError(sender, &common.ErrorReply{Code: common.ErrorAccountDeleted, To: msg.To, ToDevice: msg.ToDevice})
+		}
+		return
+	}
 
-	if online {
-		// Send the message directly if the recipient is online
-		messageJSON, _ := json.Marshal(msg)
-		if err := recipientConn.WriteMessage(websocket.TextMessage, messageJSON); err != nil {
-			s.logger.Errorf("Error sending message to user %s: %v", msg.To, err)
+	recipient := recipientKey(sender, msg)
+	if s.sendLocal(recipient, msg) {
+		return
+	}
+	if msg.Ephemeral {
+		// Ephemeral messages are never queued, the recipient may be connected to another server
+		if routed, err := s.routeEphemeral(recipient, msg); err != nil {
+			s.messageLogger(msg).Errorf("Error routing message: %v", err)
+		} else if !routed {
+			s.metrics.droppedMessages.WithLabelValues(dropEphemeral).Inc()
 		}
-	} else {
-		// Queue the message in Redis if the recipient is offline
-		s.queueMessage(msg)
+		return
+	}
+	if err := s.queueMessage(recipient, msg); err != nil {
+		// Queue the message in Redis if the recipient is offline, and tell the sender if it cannot be
+		s.messageLogger(msg).Errorf("Error queuing message: %v", err)
+		s.metrics.queueFailed(err)
+		code := common.ErrorInternal
+		if errors.Is(err, ErrQueueFull) {
+			code = common.ErrorQueueFull
+		}
+		s.replyError(sender, &common.ErrorReply{Code: code, To: msg.To, ToDevice: msg.ToDevice})
+		return
+	}
+	// The recipient may be connected to another server, which then delivers it from the mailbox
+	if err := s.notifyMailbox(recipient); err != nil {
+		s.messageLogger(msg).Errorf("Error notifying recipient server: %v", err)
 	}
 }
 
-// Queue a message in Redis
-func (s *Server) queueMessage(msg *common.MessageBundle) {
+// sendLocal sends a message to the recipient if it is connected to this server and not disconnecting
+func (s *Server) sendLocal(recipient connKey, msg *common.MessageBundle) bool {
+	s.mutex.Lock()
+	recipientConn, online := s.connectedUsers[recipient]
+	s.mutex.Unlock()
+	if !online {
+		return false
+	}
+
 	messageJSON, err := json.Marshal(msg)
 	if err != nil {
-		s.logger.Errorf("Error marshalling message from %s to %s: %v", msg.From, msg.To, err)
-		return
+		s.logger.Errorf("Error marshalling message: %v", err)
+		return false
 	}
-	if err := s.redisClient.RPush(s.ctx, fmt.Sprintf(configs.ServerMessageQueueKey, msg.From, msg.To), messageJSON).Err(); err != nil {
-		s.logger.Errorf("Error queuing message from %s to %s: %v", msg.From, msg.To, err)
+	if !recipientConn.deliver(outgoing{data: messageJSON, msg: msg}) {
+		return false
 	}
+	s.metrics.relayedMessages.Inc()
+	return true
 }
 
-// Retrieve queued messages for a user when they reconnect
-func (s *Server) retrieveQueuedMessages(from string, to string, ws *websocket.Conn) {
-	messages, err := s.redisClient.LRange(s.ctx, fmt.Sprintf(configs.ServerMessageQueueKey, from, to), 0, -1).Result()
-	if err != nil {
-		s.logger.Errorf("Error retrieving queued messages from %s to %s: %v", from, to, err)
+// replyError tells the sender of a message that it could not be delivered
+func (s *Server) replyError(sender connKey, reply *common.ErrorReply) {
+	s.mutex.Lock()
+	senderConn, online := s.connectedUsers[sender]
+	s.mutex.Unlock()
+	if !online {
 		return
 	}
 
-	for _, message := range messages {
-		if err := ws.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
-			s.logger.Errorf("Error sending queued message from %s to %s: %v", from, to, err)
-			return
-		}
+	replyJSON, err := json.Marshal(reply)
+	if err != nil {
+		s.logger.Errorf("Error marshalling error reply: %v", err)
+		return
 	}
-
-	// Clear the queue after sending
-	s.redisClient.Del(s.ctx, fmt.Sprintf(configs.ServerMessageQueueKey, from, to))
+	senderConn.deliver(outgoing{data: replyJSON})
 }
 
 func (s *Server) HandlePostKeys(w http.ResponseWriter, r *http.Request) {
-	// Extract userId from the URL query
+	if !s.allowRequest(w, r, s.keyPublishLimiter) {
+		return
+	}
+
+	// Extract userId and deviceID from the URL query
 	vars := mux.Vars(r)
 	userID, ok := vars["userID"]
 	if !ok {
@@ -178,35 +354,83 @@ func (s *Server) HandlePostKeys(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	deviceID, err := common.ParseDeviceID(vars["deviceID"])
+	if err != nil {
+		s.logger.Errorf("No valid deviceID provided in the query: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
 	// Extract the public key from the request body
+	var request common.PublishKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.deviceLogger(userID, deviceID).Errorf("Error decoding keys: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	var userPublicPrekeyBundle alice.BobPublicPrekeyBundle
-	if err := json.NewDecoder(r.Body).Decode(&userPublicPrekeyBundle); err != nil {
-		s.logger.Errorf("Error decoding keys for user %s: %v", userID, err)
+	if err := json.Unmarshal(request.Bundle, &userPublicPrekeyBundle); err != nil {
+		s.deviceLogger(userID, deviceID).Errorf("Error decoding keys: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	// Only the holder of the identity key of the account may publish keys for its devices, and only the bundle
+	// it signed for this device
+	identityKey, err := s.accountIdentity(userID)
+	if errors.Is(err, ErrUnknownUser) {
+		http.Error(w, "Account not registered", http.StatusForbidden)
+		return
+	} else if err != nil {
+		s.userLogger(userID).Errorf("Error retrieving account: %v", err)
+		http.Error(w, "Error retrieving account", http.StatusInternalServerError)
+		return
+	}
+	if err := request.Verify(*identityKey, userID, deviceID, configs.AccountRequestMaxAge); err != nil {
+		s.deviceLogger(userID, deviceID).Warnf("Refusing keys: %v", err)
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	if !s.refuseReplay(w, request.Signature, common.AccountPublishKeys, userID) || !s.allowAccount(w, r, s.keyPublishLimiter, userID) {
+		return
+	}
+	if userPublicPrekeyBundle.IdentityKey != *identityKey || userPublicPrekeyBundle.Verify() != nil {
+		s.deviceLogger(userID, deviceID).Warn("Refusing keys not signed with the identity key of the account")
+		http.Error(w, "Keys not signed with the identity key of the account", http.StatusForbidden)
+		return
+	}
+
 	// Serialize the struct to JSON before storing in Redis
 	data, err := json.Marshal(userPublicPrekeyBundle)
 	if err != nil {
-		s.logger.Errorf("Error serializing keys for user %s: %v", userID, err)
+		s.deviceLogger(userID, deviceID).Errorf("Error serializing keys: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// Publish the public key to Redis
-	if err := s.redisClient.Set(s.ctx, fmt.Sprintf(configs.ServerUserPubKey, userID), data, 0).Err(); err != nil {
-		s.logger.Errorf("Error publishing keys for user %s: %v", userID, err)
+	// Publish the public key to Redis and register the device
+	if _, err := s.redisClient.TxPipelined(s.ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(s.ctx, fmt.Sprintf(configs.ServerUserPubKey, userID, deviceID), data, 0)
+		pipe.SAdd(s.ctx, fmt.Sprintf(configs.ServerUserDevicesKey, userID), uint32(deviceID))
+		pipe.SAdd(s.ctx, configs.ServerDirectoryKey, common.DirectoryHash(userID))
+		return nil
+	}); err != nil {
+		s.deviceLogger(userID, deviceID).Errorf("Error publishing keys: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	s.logger.Infof("Public key published for user %s", userID)
+	s.metrics.keyPublishes.Inc()
+	s.dumpBundles(userID, "Keys published", []common.DevicePrekeyBundle{{DeviceID: deviceID, Bundle: userPublicPrekeyBundle}})
+	s.deviceLogger(userID, deviceID).Info("Public key published")
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *Server) HandleGetKeys(w http.ResponseWriter, r *http.Request) {
+	if !s.allowRequest(w, r, s.keyFetchLimiter) {
+		return
+	}
+
 	// Extract userId from the URL query
 	vars := mux.Vars(r)
 	userID, ok := vars["userID"]
@@ -216,31 +440,61 @@ func (s *Server) HandleGetKeys(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the public key from Redis as a string (JSON)
-	data, err := s.redisClient.Get(s.ctx, fmt.Sprintf(configs.ServerUserPubKey, userID)).Result()
-	if err != nil {
-		s.logger.Errorf("Error retrieving keys for user %s: %v", userID, err)
-		http.Error(w, "Error retrieving keys", http.StatusInternalServerError)
+	bundles, err := s.getDeviceBundles(userID)
+	if errors.Is(err, ErrUnknownUser) {
+		http.Error(w, "Unknown user", http.StatusNotFound)
 		return
-	}
-
-	// Deserialize the JSON string back into the struct
-	var userPublicPrekeyBundle alice.BobPublicPrekeyBundle
-	if err := json.Unmarshal([]byte(data), &userPublicPrekeyBundle); err != nil {
-		s.logger.Errorf("Error decoding keys for user %s: %v", userID, err)
-		http.Error(w, "Error decoding response", http.StatusInternalServerError)
+	} else if err != nil {
+		s.userLogger(userID).Errorf("Error retrieving keys: %v", err)
+		http.Error(w, "Error retrieving keys", http.StatusInternalServerError)
 		return
 	}
 
-	s.logger.Infof("Public key retrieved for user %s %+v", userID, userPublicPrekeyBundle)
+	s.dumpBundles(userID, "Keys fetched", bundles)
+	s.metrics.keyFetches.Inc()
 
 	// Send the public key to the client
 	w.Header().Set("Content-Type", "application/json") // Set JSON content type
-	if err := json.NewEncoder(w).Encode(userPublicPrekeyBundle); err != nil {
-		s.logger.Errorf("Error encoding keys for user %s: %v", userID, err)
+	if err := json.NewEncoder(w).Encode(bundles); err != nil {
+		s.userLogger(userID).Errorf("Error encoding keys: %v", err)
 		http.Error(w, "Error encoding response", http.StatusInternalServerError)
 		return
 	}
 
-	s.logger.Infof("Public key retrieved for user %s", userID)
+	s.userLogger(userID).Info("Public key retrieved")
+}
+
+// getDeviceBundles returns the prekey bundles of all devices of a user, ordered by device ID
+func (s *Server) getDeviceBundles(userID string) ([]common.DevicePrekeyBundle, error) {
+	members, err := s.redisClient.SMembers(s.ctx, fmt.Sprintf(configs.ServerUserDevicesKey, userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, ErrUnknownUser
+	}
+
+	bundles := make([]common.DevicePrekeyBundle, 0, len(members))
+	for _, member := range members {
+		deviceID, err := common.ParseDeviceID(member)
+		if err != nil {
+			return nil, err
+		}
+
+		// Get the public key from Redis as a string (JSON)
+		data, err := s.redisClient.Get(s.ctx, fmt.Sprintf(configs.ServerUserPubKey, userID, deviceID)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("device %d: %w", deviceID, err)
+		}
+
+		// Deserialize the JSON string back into the struct
+		bundle := common.DevicePrekeyBundle{DeviceID: deviceID}
+		if err := json.Unmarshal([]byte(data), &bundle.Bundle); err != nil {
+			return nil, fmt.Errorf("device %d: %w", deviceID, err)
+		}
+		bundles = append(bundles, bundle)
+	}
+
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].DeviceID < bundles[j].DeviceID })
+	return bundles, nil
 }
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"minimal-signal/common"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeFrameTimeout is how long sending a close frame to a client may take
+const closeFrameTimeout = time.Second
+
+// startHandler registers a WebSocket handler, unless the server is shutting down. Then it replies
+// 503 Service Unavailable and returns false. Handlers started must call s.handlers.Done when they return.
+func (s *Server) startHandler(w http.ResponseWriter) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.draining {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return false
+	}
+	s.handlers.Add(1)
+	return true
+}
+
+// Shutdown drains the WebSocket connections. Clients get a close frame telling them to reconnect, and the
+// messages they sent before closing are still delivered, or queued for recipients that are gone.
+// If ctx ends first, the remaining connections are closed and ctx's error is returned.
+// Call it after http.Server.Shutdown, which does not wait for WebSocket connections, and before Close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, common.CloseReasonReconnect)
+	deadline := time.Now().Add(closeFrameTimeout)
+
+	s.mutex.Lock()
+	s.draining = true
+	conns := make([]*websocket.Conn, 0, len(s.connectedUsers)+len(s.provisioningConns))
+	for _, conn := range s.connectedUsers {
+		conns = append(conns, conn.ws)
+	}
+	for _, conn := range s.provisioningConns {
+		conns = append(conns, conn)
+	}
+	s.mutex.Unlock()
+
+	s.logger.Infof("Draining %d WebSocket connections", len(conns))
+	for _, conn := range conns {
+		// The handler reads until the client answers with its own close frame
+		if err := conn.WriteControl(websocket.CloseMessage, closeMsg, deadline); err != nil {
+			s.logger.Warnf("Error sending close frame to %s: %v", s.logAddr(conn.RemoteAddr().String()), err)
+			conn.Close()
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.logger.Warnf("Shutdown timed out, closing the remaining WebSocket connections")
+		s.closeConns()
+		return ctx.Err()
+	}
+}
+
+// closeConns closes every WebSocket connection without close frame
+func (s *Server) closeConns() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.connectedUsers {
+		conn.ws.Close()
+	}
+	for _, conn := range s.provisioningConns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"minimal-signal/common"
+	"minimal-signal/configs"
+	"minimal-signal/crypto/key_ed25519"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer returns a server backed by an in-memory Redis, serving WebSocket connections over HTTP
+func newTestServer(t *testing.T, config *configs.ServerConfig) (*Server, *miniredis.Miniredis, *httptest.Server) {
+	mr := miniredis.RunT(t)
+	s, httpServer := newTestServerWithRedis(t, config, mr)
+	return s, mr, httpServer
+}
+
+// newTestServerWithRedis returns a server backed by mr, which other servers may share
+func newTestServerWithRedis(t *testing.T, config *configs.ServerConfig, mr *miniredis.Miniredis) (*Server, *httptest.Server) {
+	s := NewServer(context.Background(), config, redis.NewClient(&redis.Options{Addr: mr.Addr()}), logrus.New())
+	t.Cleanup(s.Close)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(configs.WebSocketPath, s.HandleConnections)
+	httpServer := httptest.NewServer(mux)
+	t.Cleanup(httpServer.Close)
+	return s, httpServer
+}
+
+// registerTestDevice registers a device of an account in mr, giving the account a new identity key, and returns it
+func registerTestDevice(t *testing.T, mr *miniredis.Miniredis, userID string, deviceID common.DeviceID) key_ed25519.PrivateKey {
+	identityKey, err := key_ed25519.New()
+	require.NoError(t, err)
+	publicKey, err := identityKey.Public()
+	require.NoError(t, err)
+	require.NoError(t, mr.Set(fmt.Sprintf(configs.ServerAccountKey, userID), string(publicKey[:])))
+	_, err = mr.SAdd(fmt.Sprintf(configs.ServerUserDevicesKey, userID), fmt.Sprint(deviceID))
+	require.NoError(t, err)
+	return *identityKey
+}
+
+// testConnectURL returns the URL connecting a device to the server to talk to a peer, signed with identityKey
+func testConnectURL(t *testing.T, httpServer *httptest.Server, identityKey key_ed25519.PrivateKey, from string, deviceID common.DeviceID, to string) string {
+	request, err := common.SignConnectRequest(identityKey, from, deviceID, to)
+	require.NoError(t, err)
+	return fmt.Sprintf("ws%s%s?from=%s&device=%d&to=%s&%s", strings.TrimPrefix(httpServer.URL, "http"), configs.WebSocketPath, from, deviceID, to, request.ConnectQuery().Encode())
+}
+
+// dialTestServer registers the primary device of a user in mr and connects it to the server, to talk to a peer
+func dialTestServer(t *testing.T, mr *miniredis.Miniredis, httpServer *httptest.Server, from string, to string) *websocket.Conn {
+	return dialTestDevice(t, httpServer, registerTestDevice(t, mr, from, common.PrimaryDeviceID), from, common.PrimaryDeviceID, to)
+}
+
+// dialTestDevice connects a device of a registered account to the server, to talk to a peer
+func dialTestDevice(t *testing.T, httpServer *httptest.Server, identityKey key_ed25519.PrivateKey, from string, deviceID common.DeviceID, to string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(testConnectURL(t, httpServer, identityKey, from, deviceID, to), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// connected waits until n devices are connected to s
+func connected(t *testing.T, s *Server, n int) {
+	require.Eventually(t, func() bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return len(s.connectedUsers) == n
+	}, time.Second, 10*time.Millisecond)
+}
+
+// requireRestartClose reads from conn until the server closes it, telling the client to reconnect
+func requireRestartClose(t *testing.T, conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.CloseServiceRestart, closeErr.Code)
+	assert.Equal(t, common.CloseReasonReconnect, closeErr.Text)
+}
+
+func TestShutdownDrainsConnections(t *testing.T) {
+	s, mr, httpServer := newTestServer(t, configs.DefaultServerConfig())
+	mr.SAdd(fmt.Sprintf(configs.ServerUserDevicesKey, "bob"), fmt.Sprint(common.PrimaryDeviceID))
+	alice := dialTestServer(t, mr, httpServer, "alice", "bob")
+	bob := dialTestServer(t, mr, httpServer, "bob", "alice")
+	connected(t, s, 2)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	requireRestartClose(t, bob)
+
+	// A message sent by Alice while the server drains is kept for Bob, who is disconnecting
+	require.NoError(t, alice.WriteJSON(&common.MessageBundle{To: "bob", ToDevice: common.PrimaryDeviceID, Message: []byte("hello")}))
+	requireRestartClose(t, alice)
+
+	select {
+	case err := <-shutdown:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+	assert.Len(t, mailbox(t, mr, connKey{from: "bob", device: common.PrimaryDeviceID, to: "alice"}), 1)
+
+	// New connections are refused
+	_, resp, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws%s%s", strings.TrimPrefix(httpServer.URL, "http"), configs.WebSocketPath), nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s, mr, httpServer := newTestServer(t, configs.DefaultServerConfig())
+	conn := dialTestServer(t, mr, httpServer, "alice", "bob")
+	connected(t, s, 1)
+
+	// The client never answers the close frame
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	connected(t, s, 0)
+}